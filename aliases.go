@@ -0,0 +1,188 @@
+package main
+
+import (
+	"cmp"
+	"go/ast"
+	"go/token"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// aliasRename is an import whose name must change to match the aliases
+// map of the config file.
+type aliasRename struct {
+	index int    // into sourceFile.imports
+	from  string // name the file uses today
+	to    string // alias the config wants; "" drops the alias
+}
+
+// assumedName is the package name a reader would assume for an import
+// without an alias, using the same heuristic as goimports: the last path
+// element, skipping a major version suffix such as /v2 and a "go-" prefix,
+// cut at the first character that cannot appear in an identifier.
+func assumedName(importPath string) string {
+	base := path.Base(importPath)
+	if version, ok := strings.CutPrefix(base, "v"); ok {
+		if _, err := strconv.Atoi(version); err == nil && path.Dir(importPath) != "." {
+			base = path.Base(path.Dir(importPath))
+		}
+	}
+	base = strings.TrimPrefix(base, "go-")
+	if i := strings.IndexFunc(base, func(r rune) bool {
+		return r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}); i >= 0 {
+		base = base[:i]
+	}
+
+	return base
+}
+
+// localName is the name an import is referred to by in the file.
+func (imp importInfo) localName() string {
+	if imp.name != "" {
+		return imp.name
+	}
+
+	return assumedName(imp.path)
+}
+
+// planAliases records the imports whose alias differs from the one the
+// config demands. A rename that would give two imports the same name in
+// the file, or give an import the name of something the file declares, is
+// not planned but reported as a warning, since no rewrite can satisfy it.
+func (f *sourceFile) planAliases(cfg config) {
+	if !cfg.normalizesAliases() || cfg.disabled[violationAlias] {
+		return
+	}
+
+	taken := make(map[string]int, len(f.imports))
+	for _, imp := range f.imports {
+		taken[imp.localName()]++
+	}
+	for i, imp := range f.imports {
+		want, ok := cfg.wantedAlias(imp.path)
+		if !ok || imp.unused || imp.name == want || imp.name == "_" || imp.name == "." {
+			continue
+		}
+		if want != "" && (!token.IsIdentifier(want) || want == "_") {
+			cfg.log.warnf("%s:%d: the alias rule for %q gives %q, which is not a valid alias",
+				f.path, imp.line, imp.path, want)
+
+			continue
+		}
+		rename := aliasRename{index: i, from: imp.localName(), to: want}
+		newName := cmp.Or(want, assumedName(imp.path))
+		if newName != rename.from && taken[newName] > 0 {
+			cfg.log.warnf("%s:%d: cannot import %q as %s: the name is already used by another import",
+				f.path, imp.line, imp.path, newName)
+
+			continue
+		}
+		if newName != rename.from && f.declared[newName] {
+			cfg.log.warnf("%s:%d: cannot import %q as %s: the name is declared in the file",
+				f.path, imp.line, imp.path, newName)
+
+			continue
+		}
+		taken[rename.from]--
+		taken[newName]++
+		f.renames = append(f.renames, rename)
+	}
+}
+
+// collectPackageRefs indexes the identifiers that may refer to an imported
+// package: the X of a selector expression that the parser could not resolve
+// to a declaration in the file. Locals shadowing the package name resolve
+// and are left out. The names that do resolve, from top-level declarations
+// down to parameters and locals, are collected as declared.
+func (f *sourceFile) collectPackageRefs(astFile *ast.File) {
+	f.pkgRefs = make(map[string][]int)
+	f.declared = make(map[string]bool)
+	ast.Inspect(astFile, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.ImportSpec:
+			return false
+		case *ast.Ident:
+			if n.Obj != nil { //nolint:staticcheck // the syntactic resolution is all we need
+				f.declared[n.Name] = true
+			}
+		case *ast.SelectorExpr:
+			if id, ok := n.X.(*ast.Ident); ok && id.Obj == nil { //nolint:staticcheck // the syntactic resolution is all we need
+				f.pkgRefs[id.Name] = append(f.pkgRefs[id.Name], f.fset.Position(id.Pos()).Offset)
+			}
+		}
+
+		return true
+	})
+}
+
+// markUnused flags, for -remove-unused, the imports whose name the file
+// never refers to. Blank and dot imports, whose use cannot be seen, and
+// cgo's "C" are kept. So is an import without an alias whose last path
+// element is not an identifier, such as "gopkg.in/yaml.v3": the name
+// assumedName guesses for it may not be the package's real one, which the
+// file may well use. Like goimports without its package loader, this
+// trusts that any other package is named after the last element of its
+// path.
+func (f *sourceFile) markUnused(cfg config) {
+	if !cfg.removeUnused || cfg.disabled[violationUnused] {
+		return
+	}
+
+	for i, imp := range f.imports {
+		if imp.name == "_" || imp.name == "." || imp.path == "C" || len(f.pkgRefs[imp.localName()]) > 0 {
+			continue
+		}
+		if imp.name == "" && !token.IsIdentifier(path.Base(imp.path)) {
+			cfg.log.warnf("%s:%d: %q looks unused but is kept: its package name cannot be told from the path; import it under an alias to have it checked",
+				f.path, imp.line, imp.path)
+
+			continue
+		}
+		f.imports[i].unused = true
+	}
+}
+
+// usedImports returns the imports the rewrite writes: all but those
+// markUnused flagged, plus those findMissing added.
+func (f *sourceFile) usedImports() []importInfo {
+	used := slices.DeleteFunc(slices.Clone(f.imports), func(imp importInfo) bool { return imp.unused })
+
+	return append(used, f.added...)
+}
+
+// applyAliases renames the planned imports, in the import list and in every
+// reference to them in the file. References are rewritten in place, so no
+// line numbers move.
+func (f *sourceFile) applyAliases() {
+	if len(f.renames) == 0 {
+		return
+	}
+
+	type edit struct {
+		offset   int
+		from, to string
+	}
+	var edits []edit
+	for _, r := range f.renames {
+		imp := &f.imports[r.index]
+		imp.name = r.to
+		to := imp.localName()
+		if to == r.from {
+			continue
+		}
+		for _, offset := range f.pkgRefs[r.from] {
+			edits = append(edits, edit{offset: offset, from: r.from, to: to})
+		}
+	}
+	slices.SortFunc(edits, func(a, b edit) int { return cmp.Compare(b.offset, a.offset) })
+
+	content := slices.Clone(f.content)
+	for _, e := range edits {
+		content = slices.Concat(content[:e.offset], []byte(e.to), content[e.offset+len(e.from):])
+	}
+	f.content = content
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/token"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+// fileConfig is the JSON configuration file passed with -config. It holds
+// settings that are too unwieldy for a command-line flag.
+type fileConfig struct {
+	// Classify assigns imports to groups by expression; the first rule
+	// that matches wins, and imports no rule matches fall back to the
+	// prefix-based classification.
+	Classify []classifyRule `json:"classify"`
+	// Groups assigns single import paths to a group outright, ahead of the
+	// classify rules and prefixes. Only the exact path matches, not the
+	// packages below it.
+	Groups map[string]string `json:"groups"`
+	// Aliases maps import paths to the alias they must be imported under;
+	// an empty alias means the import must have none.
+	Aliases map[string]string `json:"aliases"`
+	// AliasRules derive aliases from patterns, for conventions such as
+	// corev1 for k8s.io/api/core/v1. The first rule whose regular
+	// expression matches an import path gives its alias, with $1-style
+	// references to submatches expanded. Aliases takes precedence.
+	AliasRules []aliasRule `json:"aliasRules"`
+	// Exclude lists files and directories to skip, as filepath.Match
+	// patterns. Relative patterns are relative to the directory of the
+	// config file, so the result doesn't depend on where the tool runs.
+	Exclude []string `json:"exclude"`
+	// Include lists the files and directories to check when no path is
+	// given on the command line, as filepath.Match patterns relative to
+	// the directory of the config file; without it, that whole directory
+	// is checked.
+	Include []string `json:"include"`
+	// Banned lists import paths that must not be imported at all, such as
+	// deprecated packages. A path ending in "/..." bans everything below
+	// it as well.
+	Banned []string `json:"banned"`
+	// ImportGroups replaces the standard, external, shared, and internal
+	// groups with groups of its own, in this order. An import belongs to
+	// the first group with a matcher it satisfies, or to the one catch-all
+	// group if none does.
+	ImportGroups []groupDefinition `json:"importGroups"`
+}
+
+// groupDefinition is an entry of importGroups. A group matches the
+// standard library with Std, import paths at or below one of its Prefixes,
+// paths matching one of its regular expression Patterns, and the exact
+// Paths listed.
+type groupDefinition struct {
+	Name     string   `json:"name"`
+	Std      bool     `json:"std"`
+	Prefixes []string `json:"prefixes"`
+	Patterns []string `json:"patterns"`
+	Paths    []string `json:"paths"`
+	CatchAll bool     `json:"catchAll"`
+}
+
+type classifyRule struct {
+	Group string `json:"group"`
+	Match string `json:"match"`
+}
+
+type aliasRule struct {
+	Pattern string `json:"pattern"`
+	Alias   string `json:"alias"`
+}
+
+// aliasPattern is a compiled aliasRule.
+type aliasPattern struct {
+	pattern *regexp.Regexp
+	alias   string
+}
+
+// classifier is a compiled classifyRule.
+type classifier struct {
+	group importGroup
+	expr  string
+	match pathMatcher
+}
+
+func loadConfigFile(path string) (fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fileConfig{}, err
+	}
+
+	var fc fileConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&fc)
+	if err != nil {
+		return fileConfig{}, fmt.Errorf("cannot parse %s: %w", path, err)
+	}
+
+	return fc, nil
+}
+
+func (fc fileConfig) classifiers() ([]classifier, error) {
+	classifiers := make([]classifier, 0, len(fc.Classify))
+	for i, rule := range fc.Classify {
+		group, ok := lookupGroup(rule.Group)
+		if !ok {
+			return nil, fmt.Errorf("classify[%d]: unknown import group %q", i, rule.Group)
+		}
+		match, err := compileMatcher(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("classify[%d]: invalid match %q: %w", i, rule.Match, err)
+		}
+		classifiers = append(classifiers, classifier{group: group, expr: rule.Match, match: match})
+	}
+
+	return classifiers, nil
+}
+
+// customGroups compiles the importGroups into classifiers, in order, with
+// a final one for the catch-all group that matches every path, and returns
+// the groups defined. A group named like a built-in one, such as standard,
+// is that group, so flags that refer to it, like -std-subgroups, still
+// apply. stdPackages is the -std-list package list, if any.
+func (fc fileConfig) customGroups(stdPackages map[string]bool) ([]classifier, []importGroup, error) {
+	if len(fc.ImportGroups) == 0 {
+		return nil, nil, nil
+	}
+
+	var classifiers []classifier
+	var groups []importGroup
+	var catchAll *classifier
+	for i, def := range fc.ImportGroups {
+		name := strings.TrimSpace(def.Name)
+		if name == "" || strings.ContainsAny(name, ",+") {
+			return nil, nil, fmt.Errorf("importGroups[%d]: invalid group name %q", i, def.Name)
+		}
+		group := registerGroup(name)
+		if slices.Contains(groups, group) {
+			return nil, nil, fmt.Errorf("importGroups[%d]: group %q is defined more than once", i, name)
+		}
+		groups = append(groups, group)
+
+		var matchers []pathMatcher
+		var exprs []string
+		if def.Std {
+			matchers = append(matchers, func(p string) bool { return isStandard(p, stdPackages) })
+			exprs = append(exprs, "std")
+		}
+		for _, prefix := range def.Prefixes {
+			matchers = append(matchers, func(p string) bool { return hasPathPrefix(p, prefix) })
+			exprs = append(exprs, "prefix "+prefix)
+		}
+		for _, pattern := range def.Patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, nil, fmt.Errorf("importGroups[%d]: invalid pattern %q: %w", i, pattern, err)
+			}
+			matchers = append(matchers, re.MatchString)
+			exprs = append(exprs, "pattern "+pattern)
+		}
+		for _, path := range def.Paths {
+			matchers = append(matchers, func(p string) bool { return p == path })
+			exprs = append(exprs, "path "+path)
+		}
+
+		if def.CatchAll {
+			if catchAll != nil {
+				return nil, nil, fmt.Errorf("importGroups[%d]: %q and %q cannot both be the catchAll group", i, catchAll.group, name)
+			}
+			catchAll = &classifier{group: group, expr: "everything else", match: func(string) bool { return true }}
+		}
+		if len(matchers) == 0 {
+			if !def.CatchAll {
+				return nil, nil, fmt.Errorf("importGroups[%d]: group %q matches nothing (give it std, prefixes, patterns, or paths, or make it the catchAll)", i, name)
+			}
+
+			continue
+		}
+		classifiers = append(classifiers, classifier{
+			group: group,
+			expr:  strings.Join(exprs, ", "),
+			match: func(p string) bool { return slices.ContainsFunc(matchers, func(m pathMatcher) bool { return m(p) }) },
+		})
+	}
+	if catchAll == nil {
+		return nil, nil, errors.New("importGroups: one group must be the catchAll, for the imports no other group matches")
+	}
+
+	return append(classifiers, *catchAll), groups, nil
+}
+
+func (fc fileConfig) groupOverrides() (map[string]importGroup, error) {
+	if len(fc.Groups) == 0 {
+		return nil, nil
+	}
+	overrides := make(map[string]importGroup, len(fc.Groups))
+	for _, importPath := range slices.Sorted(maps.Keys(fc.Groups)) {
+		group, ok := lookupGroup(fc.Groups[importPath])
+		if !ok {
+			return nil, fmt.Errorf("groups: unknown import group %q for %q", fc.Groups[importPath], importPath)
+		}
+		overrides[importPath] = group
+	}
+
+	return overrides, nil
+}
+
+func (fc fileConfig) aliasPatterns() ([]aliasPattern, error) {
+	patterns := make([]aliasPattern, 0, len(fc.AliasRules))
+	for i, rule := range fc.AliasRules {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("aliasRules[%d]: invalid pattern %q: %w", i, rule.Pattern, err)
+		}
+		patterns = append(patterns, aliasPattern{pattern: pattern, alias: rule.Alias})
+	}
+
+	return patterns, nil
+}
+
+// wantedAlias returns the alias the config file wants importPath imported
+// under, "" for none, and whether it has a say at all.
+func (cfg config) wantedAlias(importPath string) (string, bool) {
+	if alias, ok := cfg.aliases[importPath]; ok {
+		return alias, true
+	}
+	for _, p := range cfg.aliasPatterns {
+		match := p.pattern.FindStringSubmatchIndex(importPath)
+		if match != nil {
+			return string(p.pattern.ExpandString(nil, p.alias, importPath, match)), true
+		}
+	}
+
+	return "", false
+}
+
+// normalizesAliases reports whether the config file has aliases to enforce.
+func (cfg config) normalizesAliases() bool {
+	return len(cfg.aliases) > 0 || len(cfg.aliasPatterns) > 0
+}
+
+// needsPackageRefs reports whether files must be parsed in full to find
+// the references to their imports.
+func (cfg config) needsPackageRefs() bool {
+	return cfg.normalizesAliases() || cfg.removeUnused || cfg.addMissing
+}
+
+func (fc fileConfig) checkBanned() error {
+	for i, path := range fc.Banned {
+		if strings.TrimSuffix(path, "/...") == "" {
+			return fmt.Errorf("banned[%d]: invalid import path %q", i, path)
+		}
+	}
+
+	return nil
+}
+
+// banned reports whether importPath is on the banned list of the config
+// file.
+func (cfg config) banned(importPath string) bool {
+	for _, path := range cfg.bannedPaths {
+		if prefix, ok := strings.CutSuffix(path, "/..."); ok {
+			if hasPathPrefix(importPath, prefix) {
+				return true
+			}
+		} else if importPath == path {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (fc fileConfig) checkAliases() error {
+	for _, importPath := range slices.Sorted(maps.Keys(fc.Aliases)) {
+		alias := fc.Aliases[importPath]
+		if alias != "" && (!token.IsIdentifier(alias) || alias == "_") {
+			return fmt.Errorf("aliases: %q is not a valid alias for %q", alias, importPath)
+		}
+	}
+
+	return nil
+}
+
+// excludePatterns resolves the exclude patterns against dir, the directory
+// of the config file as named on the command line. A symlinked config file
+// therefore applies to the tree it is linked into, not the one it lives in.
+func (fc fileConfig) excludePatterns(dir string) ([]string, error) {
+	patterns := make([]string, 0, len(fc.Exclude))
+	for i, pattern := range fc.Exclude {
+		pattern = filepath.FromSlash(pattern)
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		pattern, err := filepath.Abs(pattern)
+		if err != nil {
+			return nil, err
+		}
+		_, err = filepath.Match(pattern, "")
+		if err != nil {
+			return nil, fmt.Errorf("exclude[%d]: invalid pattern %q: %w", i, fc.Exclude[i], err)
+		}
+		patterns = append(patterns, pattern)
+	}
+
+	return patterns, nil
+}
+
+// includePaths expands the include patterns against dir, the directory of
+// the config file, into the paths a run without path arguments checks.
+// Matches the exclude patterns cover are left out.
+func (fc fileConfig) includePaths(dir string, exclude []string) ([]string, error) {
+	if len(fc.Include) == 0 {
+		return []string{dir}, nil
+	}
+
+	var paths []string
+	for i, pattern := range fc.Include {
+		pattern = filepath.FromSlash(pattern)
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("include[%d]: invalid pattern %q: %w", i, fc.Include[i], err)
+		}
+		for _, match := range matches {
+			if !slices.Contains(paths, match) && !excludedBy(exclude, match) {
+				paths = append(paths, match)
+			}
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("include: no file or directory matches %s", strings.Join(fc.Include, ", "))
+	}
+
+	return paths, nil
+}
+
+// excluded reports whether path, or a directory it lies in, matches one of
+// the exclude patterns of the config file.
+func (cfg config) excluded(path string) bool {
+	return excludedBy(cfg.exclude, path)
+}
+
+func excludedBy(patterns []string, path string) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	for {
+		for _, pattern := range patterns {
+			if ok, _ := filepath.Match(pattern, path); ok {
+				return true
+			}
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return false
+		}
+		path = parent
+	}
+}
+
+// printConfig writes the configuration a run would use once flags and the
+// config file are resolved, for -validate-config.
+func printConfig(w io.Writer, cfg config) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if cfg.module != nil {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\n", filepath.Base(cfg.module.path), cfg.module.path)
+	}
+	if cfg.modules != nil {
+		_, _ = fmt.Fprintf(tw, "internal-prefix\t%s\n", "(the module path in the go.mod nearest each file)")
+	}
+	if len(cfg.internalPrefixes) > 0 {
+		_, _ = fmt.Fprintf(tw, "internal-prefix\t%s\n", strings.Join(cfg.internalPrefixes, ", "))
+	}
+	if cfg.stdPackages != nil {
+		_, _ = fmt.Fprintf(tw, "std-list\t%s\n", cfg.goVersion)
+	}
+	if cfg.sharedPrefix != "" {
+		_, _ = fmt.Fprintf(tw, "shared-prefix\t%s\n", cfg.sharedPrefix)
+	}
+	blocks := make([]string, 0, len(cfg.groupOrder))
+	for _, block := range cfg.importBlocks() {
+		blocks = append(blocks, strings.ReplaceAll(joinGroups(block), ", ", "+"))
+	}
+	_, _ = fmt.Fprintf(tw, "import-order\t%s\n", strings.Join(blocks, ", "))
+	_, _ = fmt.Fprintf(tw, "sort\t%s\n", cmp.Or(cfg.sort, sortASCII))
+	_, _ = fmt.Fprintf(tw, "blank-imports\t%s\n", cmp.Or(cfg.blankImports, blankImportsKeep))
+	if len(cfg.parenthesize) > 0 {
+		_, _ = fmt.Fprintf(tw, "parenthesize\t%s\n", strings.Join(slices.Sorted(maps.Keys(cfg.parenthesize)), ", "))
+	}
+	_, _ = fmt.Fprintf(tw, "internal-sort\t%s\n", cfg.internalSort)
+	if len(cfg.stdSubgroups) > 0 {
+		_, _ = fmt.Fprintf(tw, "std-subgroups\t%s\n", strings.Join(cfg.stdSubgroups, ", "))
+	}
+	_, _ = fmt.Fprintf(tw, "preserve-subgroups\t%t\n", cfg.preserveSubgroups)
+	if len(cfg.disabled) > 0 {
+		kinds := make([]string, 0, len(cfg.disabled))
+		for _, kind := range violationKinds {
+			if cfg.disabled[kind] {
+				kinds = append(kinds, string(kind))
+			}
+		}
+		_, _ = fmt.Fprintf(tw, "disable\t%s\n", strings.Join(kinds, ", "))
+	}
+	for _, importPath := range slices.Sorted(maps.Keys(cfg.groupOverrides)) {
+		_, _ = fmt.Fprintf(tw, "group %s\t%s\n", importPath, cfg.groupOverrides[importPath])
+	}
+	for _, c := range cfg.classifiers {
+		_, _ = fmt.Fprintf(tw, "classify %s\t%s\n", c.group, c.expr)
+	}
+	for _, c := range cfg.customGroups {
+		_, _ = fmt.Fprintf(tw, "import-group %s\t%s\n", c.group, c.expr)
+	}
+	for _, pattern := range cfg.exclude {
+		_, _ = fmt.Fprintf(tw, "exclude\t%s\n", pattern)
+	}
+	for _, path := range cfg.bannedPaths {
+		_, _ = fmt.Fprintf(tw, "banned\t%s\n", path)
+	}
+	for _, importPath := range slices.Sorted(maps.Keys(cfg.aliases)) {
+		_, _ = fmt.Fprintf(tw, "alias %s\t%s\n", importPath, cmp.Or(cfg.aliases[importPath], "(none)"))
+	}
+	for _, p := range cfg.aliasPatterns {
+		_, _ = fmt.Fprintf(tw, "alias rule %s\t%s\n", p.pattern, cmp.Or(p.alias, "(none)"))
+	}
+	_ = tw.Flush()
+}
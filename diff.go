@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+// diffOp is one line of an edit script: kept (' '), removed ('-'), or
+// added ('+').
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// unifiedDiff returns the changes from a to b in the unified format of
+// diff -u, with the headers naming the files aName and bName, or nil when
+// there are none.
+func unifiedDiff(aName, bName string, a, b []byte) []byte {
+	if bytes.Equal(a, b) {
+		return nil
+	}
+	ops := diffLines(splitLines(a), splitLines(b))
+
+	// aAt and bAt count the lines of a and b before each op.
+	aAt, bAt := make([]int, len(ops)+1), make([]int, len(ops)+1)
+	for i, op := range ops {
+		aAt[i+1], bAt[i+1] = aAt[i], bAt[i]
+		if op.kind != '+' {
+			aAt[i+1]++
+		}
+		if op.kind != '-' {
+			bAt[i+1]++
+		}
+	}
+
+	var out bytes.Buffer
+	_, _ = fmt.Fprintf(&out, "--- %s\n+++ %s\n", aName, bName)
+	for i := 0; i < len(ops); {
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+
+		// A hunk runs on while the changes are close enough for their
+		// context to touch, and ends with the context after the last one.
+		start, end := max(i-diffContext, 0), i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+
+				continue
+			}
+			next := end
+			for next < len(ops) && ops[next].kind == ' ' {
+				next++
+			}
+			if next == len(ops) || next-end > 2*diffContext {
+				end = min(end+diffContext, len(ops))
+
+				break
+			}
+			end = next
+		}
+
+		writeHunkHeader(&out, aAt[start], aAt[end]-aAt[start], bAt[start], bAt[end]-bAt[start])
+		for _, op := range ops[start:end] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+
+	return out.Bytes()
+}
+
+// gitDiff is unifiedDiff with the a/ and b/ prefixes of git diff, for a
+// file reported under path. Paths below the working directory are made
+// relative to it, so git apply can be run from there.
+func gitDiff(path string, a, b []byte) []byte {
+	if abs, err := filepath.Abs(path); err == nil {
+		if wd, err := os.Getwd(); err == nil {
+			if rel, err := filepath.Rel(wd, abs); err == nil && filepath.IsLocal(rel) {
+				path = rel
+			}
+		}
+	}
+	name := filepath.ToSlash(path)
+
+	return unifiedDiff("a/"+name, "b/"+name, a, b)
+}
+
+// writePatch writes the fixes of the flagged files, in the order they were
+// reported, to a single patch file for -patch-out. The file is written even
+// when there is nothing to fix, so CI always has an artifact to keep.
+func writePatch(path string, flagged []*violationError) error {
+	var patch bytes.Buffer
+	for _, file := range flagged {
+		patch.Write(file.patch)
+	}
+
+	return os.WriteFile(path, patch.Bytes(), 0o644)
+}
+
+// writeHunkHeader writes the @@ line of a hunk covering count lines after
+// the first skip lines of each side. An empty side is numbered by the line
+// before it, as diff does.
+func writeHunkHeader(out *bytes.Buffer, aSkip, aCount, bSkip, bCount int) {
+	aStart, bStart := aSkip+1, bSkip+1
+	if aCount == 0 {
+		aStart--
+	}
+	if bCount == 0 {
+		bStart--
+	}
+	_, _ = fmt.Fprintf(out, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+}
+
+// splitLines splits content into lines that keep their "\n".
+func splitLines(content []byte) []string {
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
+
+// diffLines returns a shortest edit script turning a into b. The lines the
+// two share at the start and end are split off first: an import fix only
+// touches the top of a file, which keeps the search below small.
+func diffLines(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var ops []diffOp
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{kind: ' ', line: line})
+	}
+	ops = append(ops, myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{kind: ' ', line: line})
+	}
+
+	return ops
+}
+
+// myersDiff is the O(ND) algorithm of Eugene Myers, "An O(ND) Difference
+// Algorithm and Its Variations": it searches edit scripts of growing
+// length d, recording for every diagonal k the furthest x reached, then
+// walks the recorded rounds back from the end to recover the script.
+func myersDiff(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+	var trace [][]int
+
+search:
+	for d := 0; d <= n+m; d++ {
+		trace = append(trace, slices.Clone(v))
+		for k := -d; k <= d; k += 2 {
+			x := v[offset+k-1] + 1
+			if k == -d || k != d && v[offset+k-1] < v[offset+k+1] {
+				x = v[offset+k+1]
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	var ops []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		prevK := k - 1
+		if k == -d || k != d && v[offset+k-1] < v[offset+k+1] {
+			prevK = k + 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{kind: ' ', line: a[x-1]})
+			x, y = x-1, y-1
+		}
+		if x == prevX {
+			ops = append(ops, diffOp{kind: '+', line: b[y-1]})
+			y--
+		} else {
+			ops = append(ops, diffOp{kind: '-', line: a[x-1]})
+			x--
+		}
+	}
+	for x > 0 {
+		ops = append(ops, diffOp{kind: ' ', line: a[x-1]})
+		x--
+	}
+	slices.Reverse(ops)
+
+	return ops
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// changedFiles lists the source files that differ between -since and HEAD,
+// relative to the working directory, for checking only what a branch
+// touched. Files the walk would skip are left out too, as are files that
+// no longer exist because they were deleted or renamed away.
+func changedFiles(cfg config) ([]string, error) {
+	return gitFiles(cfg, "git diff against "+cfg.since, "diff", "--name-only", "--relative", "-z", cfg.since+"...HEAD")
+}
+
+// stagedFiles lists the source files added, copied, or modified in the
+// index, relative to the working directory, for -staged. partial holds
+// those that also have unstaged changes: the file on disk is not what will
+// be committed, so -fix must not stage it.
+func stagedFiles(cfg config) (files []string, partial map[string]bool, err error) {
+	files, err = gitFiles(cfg, "git diff --cached", "diff", "--cached", "--name-only", "--relative", "-z", "--diff-filter=ACM")
+	if err != nil {
+		return nil, nil, err
+	}
+	unstaged, err := gitFiles(cfg, "git diff", "diff", "--name-only", "--relative", "-z")
+	if err != nil {
+		return nil, nil, err
+	}
+	partial = make(map[string]bool)
+	for _, name := range unstaged {
+		partial[name] = true
+	}
+
+	return files, partial, nil
+}
+
+// stageFixes stages the files -staged -fix fixed, so the commit includes
+// the fixes.
+func stageFixes(flagged []*violationError) error {
+	args := []string{"add", "--"}
+	for _, file := range flagged {
+		if file.fixed {
+			args = append(args, file.path)
+		}
+	}
+	if len(args) == 2 {
+		return nil
+	}
+	_, err := git("git add", args...)
+
+	return err
+}
+
+// gitFiles runs a git command listing files, NUL-separated, and returns
+// those a walk would check, naming the command as what in errors.
+func gitFiles(cfg config, what string, args ...string) ([]string, error) {
+	out, err := git(what, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for name := range strings.SplitSeq(string(out), "\x00") {
+		if name == "" || !cfg.isSource(name) || cfg.inSkippedDir(name) || cfg.excluded(name) {
+			continue
+		}
+		_, err := os.Stat(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, filepath.FromSlash(name))
+	}
+
+	return files, nil
+}
+
+// git runs git with args and returns its output. Errors carry what git
+// printed to stderr, under what.
+func git(what string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %s", what, msg)
+		}
+
+		return nil, fmt.Errorf("%s: %w", what, err)
+	}
+
+	return out, nil
+}
+
+// inSkippedDir reports whether a slash-separated relative path lies in a
+// directory that walking the tree would skip.
+func (cfg config) inSkippedDir(name string) bool {
+	dirs := strings.Split(name, "/")
+	for _, dir := range dirs[:len(dirs)-1] {
+		if cfg.skipDir(dir) {
+			return true
+		}
+	}
+
+	return false
+}
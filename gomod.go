@@ -0,0 +1,386 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Classification modes accepted by -mode.
+const (
+	modePrefix = "prefix"
+	modeGoMod  = "gomod"
+	modeGoWork = "gowork"
+)
+
+// modFile holds the parts of a go.mod file the tool cares about. The format
+// is simple enough that parsing it by hand keeps the tool dependency-free.
+//
+// With -mode=gowork a modFile stands for a whole go.work workspace instead:
+// path is the go.work file, module is empty, and the other fields merge
+// those of the go.mod files of the modules it uses.
+type modFile struct {
+	path    string
+	module  string
+	require []string
+	// localReplaces are the modules replaced by a directory on disk, which
+	// are developed alongside the module itself.
+	localReplaces []string
+	// workspace lists the paths of the modules a go.work file uses.
+	workspace []string
+	// replaced maps the modules replaced by another module, or by a
+	// directory inside this one, to the import path of the replacement:
+	// the same packages can then be imported under both.
+	replaced map[string]string
+	// versions holds the version of each required module and of each
+	// module replacing one, and replaceDirs the directory replacing a
+	// module, as written: -add-missing looks for their packages there.
+	versions    map[string]string
+	replaceDirs map[string]string
+}
+
+// findGoMod returns the go.mod governing dir: the first one found walking
+// up from dir, like the go command does.
+func findGoMod(dir string) (string, error) {
+	return findUp(dir, "go.mod")
+}
+
+// findGoWork returns the go.work governing dir, found the same way.
+func findGoWork(dir string) (string, error) {
+	return findUp(dir, "go.work")
+}
+
+func findUp(dir, name string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("no %s found in the current directory or any parent", name)
+		}
+		dir = parent
+	}
+}
+
+func loadGoMod(path string) (*modFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	mod, err := parseGoMod(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", path, err)
+	}
+	mod.path = path
+
+	return mod, nil
+}
+
+// parseGoMod reads the module path, the required modules, and the replaced
+// ones from the contents of a go.mod file.
+// Both the single-line and the parenthesized block forms of a directive are
+// understood; other directives are skipped.
+func parseGoMod(data string) (*modFile, error) {
+	mod := &modFile{
+		replaced:    make(map[string]string),
+		versions:    make(map[string]string),
+		replaceDirs: make(map[string]string),
+	}
+	err := parseDirectives(data, func(verb, path string, fields []string) error {
+		switch verb {
+		case "module":
+			mod.module = path
+		case "require":
+			mod.require = append(mod.require, path)
+			if len(fields) > 1 {
+				mod.versions[path] = fields[1]
+			}
+		case "replace":
+			arrow := slices.Index(fields, "=>")
+			if arrow < 0 || arrow == len(fields)-1 {
+				return errors.New("replace needs => and a replacement")
+			}
+			target, err := unquoteModPath(fields[arrow+1])
+			if err != nil {
+				return err
+			}
+			switch {
+			case !isLocalPath(target):
+				mod.replaced[path] = target
+				if arrow+2 < len(fields) {
+					mod.versions[target] = fields[arrow+2]
+				}
+			case !slices.Contains(mod.localReplaces, path):
+				mod.localReplaces = append(mod.localReplaces, path)
+				mod.replaceDirs[path] = target
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if mod.module == "" {
+		return nil, errors.New("no module directive")
+	}
+	// A directory inside the module is importable under the module path
+	// too; others are out of reach.
+	for replaced, target := range mod.replaceDirs {
+		dir := filepath.ToSlash(filepath.Clean(target))
+		switch {
+		case dir == ".":
+			mod.replaced[replaced] = mod.module
+		case !filepath.IsAbs(target) && dir != ".." && !strings.HasPrefix(dir, "../"):
+			mod.replaced[replaced] = mod.module + "/" + dir
+		}
+	}
+
+	return mod, nil
+}
+
+// parseGoWork returns the directories of the use directives in the contents
+// of a go.work file, which shares the syntax of go.mod.
+func parseGoWork(data string) ([]string, error) {
+	var uses []string
+	err := parseDirectives(data, func(verb, path string, _ []string) error {
+		if verb == "use" {
+			uses = append(uses, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(uses) == 0 {
+		return nil, errors.New("no use directive")
+	}
+
+	return uses, nil
+}
+
+// parseDirectives calls directive for every directive in the contents of a
+// go.mod or go.work file, with its first argument unquoted and all of them
+// as written. Both the single-line and the parenthesized block forms of a
+// directive are understood.
+func parseDirectives(data string, directive func(verb, arg string, fields []string) error) error {
+	block := ""
+	for i, line := range strings.Split(data, "\n") {
+		if before, _, ok := strings.Cut(line, "//"); ok {
+			line = before
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		verb := block
+		switch {
+		case block != "" && fields[0] == ")":
+			block = ""
+
+			continue
+		case block == "" && len(fields) == 2 && fields[1] == "(":
+			block = fields[0]
+
+			continue
+		case block == "":
+			verb, fields = fields[0], fields[1:]
+		}
+		if len(fields) == 0 {
+			return fmt.Errorf("line %d: missing argument to %s", i+1, verb)
+		}
+
+		arg, err := unquoteModPath(fields[0])
+		if err == nil {
+			err = directive(verb, arg, fields)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// loadGoWork reads the go.work file at path and the go.mod file of every
+// module it uses, into a modFile standing for the whole workspace.
+func loadGoWork(path string) (*modFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	uses, err := parseGoWork(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", path, err)
+	}
+
+	work := &modFile{path: path, replaced: make(map[string]string)}
+	for _, dir := range uses {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(filepath.Dir(path), filepath.FromSlash(dir))
+		}
+		mod, err := loadGoMod(filepath.Join(dir, "go.mod"))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		work.workspace = append(work.workspace, mod.module)
+		work.require = append(work.require, mod.require...)
+		for _, replaced := range mod.localReplaces {
+			if !slices.Contains(work.localReplaces, replaced) {
+				work.localReplaces = append(work.localReplaces, replaced)
+			}
+		}
+		maps.Copy(work.replaced, mod.replaced)
+	}
+
+	return work, nil
+}
+
+// internalPrefixes are the import path prefixes -mode=gomod and
+// -mode=gowork take as internal: the module or the modules of the
+// workspace, and whatever they replace with a local directory.
+func (m *modFile) internalPrefixes() []string {
+	prefixes := slices.Clone(m.workspace)
+	if m.module != "" {
+		prefixes = append(prefixes, m.module)
+	}
+	for _, replaced := range m.localReplaces {
+		if !slices.Contains(prefixes, replaced) {
+			prefixes = append(prefixes, replaced)
+		}
+	}
+
+	return prefixes
+}
+
+// String names the module, or the workspace, and what they require, for
+// warnUnrequired.
+func (m *modFile) String() string {
+	if m.module == "" {
+		return "the modules of " + m.path + " or any module they require"
+	}
+
+	return "module " + m.module + " or any module it requires"
+}
+
+// isLocalPath reports whether the target of a replace directive is a
+// directory rather than a module path, by the rule the go command uses: it
+// is absolute or starts with ./ or ../.
+func isLocalPath(target string) bool {
+	return filepath.IsAbs(target) || target == "." || target == ".." ||
+		strings.HasPrefix(target, "/") ||
+		strings.HasPrefix(target, "./") || strings.HasPrefix(target, "../") ||
+		strings.HasPrefix(target, `.\`) || strings.HasPrefix(target, `..\`)
+}
+
+func unquoteModPath(s string) (string, error) {
+	if strings.HasPrefix(s, `"`) || strings.HasPrefix(s, "`") {
+		return strconv.Unquote(s)
+	}
+
+	return s, nil
+}
+
+// requires reports whether importPath lies in the module itself or in one
+// of the modules it requires.
+func (m *modFile) requires(importPath string) bool {
+	if hasPathPrefix(importPath, m.module) {
+		return true
+	}
+	for _, req := range slices.Concat(m.workspace, m.require) {
+		if hasPathPrefix(importPath, req) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// moduleFinder supplies the internal prefix when neither -internal-prefix
+// nor -mode gives one: the module path in the go.mod nearest each file.
+// The files of a directory share their go.mod, so lookups are cached by
+// directory; files are checked concurrently, hence the mutex.
+type moduleFinder struct {
+	mu    sync.Mutex
+	byDir map[string]string
+}
+
+func newModuleFinder() *moduleFinder {
+	return &moduleFinder{byDir: make(map[string]string)}
+}
+
+// modulePath returns the module path of the go.mod governing dir.
+func (m *moduleFinder) modulePath(dir string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if module, ok := m.byDir[dir]; ok {
+		return module, nil
+	}
+	path, err := findGoMod(dir)
+	if err != nil {
+		return "", errors.New("no -internal-prefix given, and no go.mod found in its directory or any parent")
+	}
+	mod, err := loadGoMod(path)
+	if err != nil {
+		return "", err
+	}
+	if mod.module == "" {
+		return "", fmt.Errorf("%s has no module directive", path)
+	}
+	m.byDir[dir] = mod.module
+
+	return mod.module, nil
+}
+
+// withModulePrefix returns cfg with the module path of the go.mod above
+// the file name as its internal prefix, for a moduleFinder.
+func (cfg config) withModulePrefix(fsys fs.FS, name string) (config, error) {
+	dir, err := fileDir(fsys, name)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return cfg, fmt.Errorf("%s: no -internal-prefix given, and no go.mod to take it from", displayPath(fsys, name))
+	}
+	if err != nil {
+		return cfg, err
+	}
+	module, err := cfg.modules.modulePath(dir)
+	if err != nil {
+		return cfg, fmt.Errorf("%s: %w", displayPath(fsys, name), err)
+	}
+	cfg.internalPrefixes = []string{module}
+
+	return cfg, nil
+}
+
+// fileDir returns the absolute OS directory of the file name, or an error
+// wrapping errors.ErrUnsupported when fsys is not backed by one.
+func fileDir(fsys fs.FS, name string) (string, error) {
+	var dir string
+	switch fsys := fsys.(type) {
+	case osFS:
+		dir = filepath.Dir(fsys.path(name))
+	case *stdinFS:
+		// -stdin-filename, if given, says where the source belongs.
+		dir = filepath.Dir(fsys.name)
+	default:
+		return "", fmt.Errorf("%s: %w", name, errors.ErrUnsupported)
+	}
+
+	return filepath.Abs(dir)
+}
@@ -3,35 +3,62 @@
 //
 // Imports are split into three groups — standard library, external, and
 // internal (matched by -internal-prefix) — sorted alphabetically within each
-// group and separated by single blank lines. Multiple import declarations
-// are merged into one block; aliases and comments attached to imports are
-// preserved.
+// group and separated by single blank lines. An optional fourth group of
+// company-wide shared imports (matched by -shared-prefix) sits between
+// external and internal. Multiple import declarations are merged into one
+// block; aliases and comments attached to imports are preserved. Without
+// -internal-prefix, each file takes the module path in the go.mod nearest
+// it as its internal prefix.
 //
 // Usage:
 //
-//	import-tidy -internal-prefix=<prefix> [-import-order=standard,external,internal] [-fix] <path>...
+//	import-tidy [-internal-prefix=<prefix>] [-import-order=standard,external,internal] [-fix | -list] <path>...
+//	import-tidy explain [-internal-prefix=<prefix>] [-import-order=...] <file>
 //
 // Without -fix the tool reports files whose imports need reorganizing and
-// exits with code 1; with -fix it rewrites them in place.
+// exits with code 1; with -fix it rewrites them in place. -list reports the
+// same files but prints only their paths, like gofmt -l. -watch keeps the
+// tool running and processes files again whenever they change. -config
+// names a JSON file whose classify rules assign imports to groups by
+// expression, and whose groups map overrides the group of single paths.
+// The explain subcommand prints the group and sorted position of each
+// import in a file.
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"go/ast"
-	"go/format"
 	"go/parser"
+	"go/printer"
 	"go/token"
+	"go/version"
 	"io"
 	"io/fs"
+	"maps"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
+// Exit codes. CI tells issues a developer has to fix (exitIssuesFound)
+// from a run that could not check everything (exitError), such as a usage
+// error, an unreadable file, or a file that is not valid Go.
 const (
 	exitOK          = 0
 	exitIssuesFound = 1
@@ -43,19 +70,310 @@ type importGroup int
 const (
 	standardLibrary importGroup = iota
 	externalLibrary
+	sharedLibrary
 	internalLibrary
 )
 
 var groupNames = map[string]importGroup{
 	"standard": standardLibrary,
 	"external": externalLibrary,
+	"shared":   sharedLibrary,
 	"internal": internalLibrary,
 }
 
+// groupSynonyms are other names a group may be given by.
+var groupSynonyms = map[string]importGroup{
+	"std":         standardLibrary,
+	"stdlib":      standardLibrary,
+	"third-party": externalLibrary,
+	"thirdparty":  externalLibrary,
+	"local":       internalLibrary,
+}
+
+// customGroupNames holds the names of the groups the importGroups of a
+// config file define beyond the built-in ones, numbered after
+// internalLibrary in the order they were first seen. A name keeps its
+// number once registered, so it means the same group in every config.
+var customGroupNames struct {
+	sync.Mutex
+	names []string
+}
+
+// lookupGroup returns the group with the given name or synonym, ignoring
+// case and surrounding white space.
+func lookupGroup(name string) (importGroup, bool) {
+	return findGroup(name, false)
+}
+
+// registerGroup returns the group with the given name, registering it as a
+// custom group if it is neither built in nor registered yet.
+func registerGroup(name string) importGroup {
+	group, _ := findGroup(name, true)
+
+	return group
+}
+
+func findGroup(name string, register bool) (importGroup, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if group, ok := groupNames[name]; ok {
+		return group, true
+	}
+	if group, ok := groupSynonyms[name]; ok {
+		return group, true
+	}
+	customGroupNames.Lock()
+	defer customGroupNames.Unlock()
+	i := slices.Index(customGroupNames.names, name)
+	if i < 0 {
+		if !register {
+			return 0, false
+		}
+		i = len(customGroupNames.names)
+		customGroupNames.names = append(customGroupNames.names, name)
+	}
+
+	return internalLibrary + 1 + importGroup(i), true
+}
+
+func (g importGroup) String() string {
+	for name, group := range groupNames {
+		if group == g {
+			return name
+		}
+	}
+	customGroupNames.Lock()
+	defer customGroupNames.Unlock()
+	if i := int(g - internalLibrary - 1); i >= 0 && i < len(customGroupNames.names) {
+		return customGroupNames.names[i]
+	}
+
+	return fmt.Sprintf("group(%d)", int(g))
+}
+
+// Orders accepted by -internal-sort.
+const (
+	internalSortAlpha = "alpha"
+	internalSortDepth = "depth"
+)
+
+// Orders accepted by -sort. sortBytewise is the name the default went by
+// before the others existed, still accepted as a synonym of sortASCII.
+const (
+	sortASCII           = "ascii"
+	sortBytewise        = "bytewise"
+	sortCaseInsensitive = "case-insensitive"
+	sortSegments        = "segments"
+	sortModuleAware     = "module-aware"
+	sortUpperFirst      = "upper-first"
+	sortNone            = "none"
+)
+
+// sortComparators maps each -sort order to the comparator for it. Both the
+// fix and the check for violationSortOrder order a group with it, so they
+// cannot disagree.
+var sortComparators = map[string]func(cfg config) func(a, b importInfo) int{
+	sortASCII:           func(config) func(a, b importInfo) int { return compareImports },
+	sortBytewise:        func(config) func(a, b importInfo) int { return compareImports },
+	sortCaseInsensitive: func(config) func(a, b importInfo) int { return compareCaseInsensitive },
+	sortSegments:        func(config) func(a, b importInfo) int { return compareSegments },
+	sortModuleAware:     compareModules,
+	sortUpperFirst:      func(config) func(a, b importInfo) int { return compareUpperFirst },
+	sortNone:            func(config) func(a, b importInfo) int { return keepSourceOrder },
+}
+
+// Orders accepted by -blank-imports.
+const (
+	blankImportsKeep = "keep"
+	blankImportsSort = "sort"
+)
+
+// Lone imports -parenthesize keeps in an import block.
+const (
+	parenthesizeBlank = "blank"
+	parenthesizeDot   = "dot"
+)
+
 type config struct {
-	internalPrefix string
-	groupOrder     []importGroup
-	fix            bool
+	internalPrefixes []string
+	// modules, set when no flag gives the internal prefix, takes it from
+	// the go.mod of each file instead.
+	modules           *moduleFinder
+	sharedPrefix      string
+	groupOrder        []importGroup
+	joined            map[importGroup]bool
+	fix               bool
+	preserveSubgroups bool
+	stdSubgroups      []string
+	maxLineLength     int
+	internalSort      string
+	sort              string
+	blankImports      string
+	parenthesize      map[string]bool // names of lone imports kept in parentheses
+	list              bool
+	count             bool
+	format            string
+	quiet             bool
+	verbose           bool
+	diff              bool
+	watch             bool
+	errorOnEmpty      bool
+	maxFileSize       int64
+	jobs              int
+	groupOverrides    map[string]importGroup
+	classifiers       []classifier
+	customGroups      []classifier // the importGroups of the config file, catch-all last
+	bannedPaths       []string
+	aliases           map[string]string
+	aliasPatterns     []aliasPattern
+	extensions        []string
+	lenientParse      bool
+	removeUnused      bool
+	addMissing        bool
+	stdByName         map[string][]string // package name -> standard library paths, for -add-missing
+	packages          *packageIndex       // the other packages -add-missing may import
+	since             string
+	staged            bool
+	stdout            bool
+	suggest           bool
+	includeHidden     bool
+	interactive       bool
+	stdinFilename     string
+	disabled          map[violationKind]bool
+	outDir            string
+	patchOut          string
+	rewriteReport     bool
+	warnOnly          bool
+	verify            bool
+	assumeGofmt       bool
+	backupSuffix      string // -backup: where the original goes, appended to its path
+	cpuProfile        string
+	memProfile        string
+	exclude           []string
+	goVersion         string
+	stdPackages       map[string]bool
+	prompt            *prompter
+	module            *modFile
+	validateConfig    bool
+	log               *logger
+}
+
+// Formats accepted by -log-format.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logger writes notices and warnings to stderr. It is safe for concurrent
+// use by the -jobs workers. With -log-format=json every message is a JSON
+// line instead, and each file processed is logged as an event too.
+type logger struct {
+	out   io.Writer
+	quiet bool
+	json  bool
+	mu    sync.Mutex
+}
+
+// logEvent is one line of -log-format=json output.
+type logEvent struct {
+	Event      string   `json:"event"`
+	File       string   `json:"file,omitempty"`
+	DurationMS *float64 `json:"duration_ms,omitempty"`
+	Message    string   `json:"message,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+func (l *logger) noticef(format string, args ...any) {
+	l.printf("notice", "Notice: ", format, args...)
+}
+
+func (l *logger) warnf(format string, args ...any) {
+	l.printf("warning", "Warning: ", format, args...)
+}
+
+// errorf reports an error that fails the run. Unlike notices and warnings,
+// errors are shown even with -quiet.
+func (l *logger) errorf(format string, args ...any) {
+	if l.json {
+		l.write(logEvent{Event: "error", Error: fmt.Sprintf(format, args...)})
+
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = fmt.Fprintf(l.out, "Error: "+format+"\n", args...)
+}
+
+// skipf notes that the file at path is skipped, and why.
+func (l *logger) skipf(path, format string, args ...any) {
+	if l.json {
+		if !l.quiet {
+			l.write(logEvent{Event: "skipped", File: path, Message: fmt.Sprintf(format, args...)})
+		}
+
+		return
+	}
+	l.noticef("skipping %s: "+format, append([]any{path}, args...)...)
+}
+
+// fileDone logs, for -log-format=json, how processing the file at
+// path that started at start ended: err is what checkFile returned.
+func (l *logger) fileDone(path string, start time.Time, err error) {
+	if l.quiet {
+		return
+	}
+	duration := float64(time.Since(start).Microseconds()) / 1000
+	event := logEvent{Event: "visited", File: path, DurationMS: &duration}
+	var verr *violationError
+	switch {
+	case errors.As(err, &verr) && verr.fixed:
+		event.Event = "changed"
+	case errors.As(err, &verr):
+		event.Event = "flagged"
+	case err != nil:
+		event.Event = "error"
+		event.Error = err.Error()
+	}
+	l.write(event)
+}
+
+// printf writes a message with the given prefix as text, or as the given
+// event for -log-format=json.
+func (l *logger) printf(event, prefix, format string, args ...any) {
+	if l.quiet {
+		return
+	}
+	if l.json {
+		l.write(logEvent{Event: event, Message: fmt.Sprintf(format, args...)})
+
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = fmt.Fprintf(l.out, prefix+format+"\n", args...)
+}
+
+// buffered returns a logger like l that writes to buf instead, so that a
+// file checked concurrently with others can have its output flushed later,
+// in walk order.
+func (l *logger) buffered(buf *bytes.Buffer) *logger {
+	return &logger{out: buf, quiet: l.quiet, json: l.json}
+}
+
+// flush writes what a buffered logger collected in buf.
+func (l *logger) flush(buf *bytes.Buffer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.out.Write(buf.Bytes())
+}
+
+func (l *logger) write(event logEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.out.Write(append(line, '\n'))
 }
 
 func main() {
@@ -63,6 +381,10 @@ func main() {
 }
 
 func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) > 0 && args[0] == "explain" {
+		return runExplain(args[1:], stdout, stderr)
+	}
+
 	cfg, paths, err := parseArgs(args, stderr)
 	if errors.Is(err, flag.ErrHelp) {
 		return exitOK
@@ -73,39 +395,377 @@ func run(args []string, stdout, stderr io.Writer) int {
 		return exitError
 	}
 
-	flagged := make([]string, 0, len(paths))
-	for _, target := range paths {
-		files, err := processPath(target, cfg)
+	for _, prefix := range cfg.internalPrefixes {
+		if !strings.ContainsAny(prefix, "./") {
+			cfg.log.warnf("-internal-prefix %q contains no \".\" or \"/\" and will not match any module path; "+
+				"did you mean a full module path such as \"github.com/%s\"?", prefix, prefix)
+		}
+	}
+
+	if cfg.validateConfig {
+		printConfig(stdout, cfg)
+
+		return exitOK
+	}
+
+	stopProfiles, err := startProfiles(cfg)
+	if err != nil {
+		fprintln(stderr, "Error:", err)
+
+		return exitError
+	}
+	defer func() {
+		err := stopProfiles()
+		if err != nil {
+			fprintln(stderr, "Error:", err)
+		}
+	}()
+
+	if cfg.interactive {
+		if !isTerminal(os.Stdin) {
+			fprintln(stderr, "Error: -interactive needs a terminal on stdin")
+
+			return exitError
+		}
+		cfg.prompt = newPrompter(os.Stdin, stdout)
+	}
+
+	if cfg.watch {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		return watch(ctx, paths, cfg, stdout, stderr)
+	}
+
+	if slices.Equal(paths, []string{stdinPath}) {
+		return runStdin(os.Stdin, cfg, stdout, stderr)
+	}
+	if cfg.stdout {
+		return runStdout(paths[0], cfg, stdout, stderr)
+	}
+
+	if cfg.since != "" {
+		paths, err = changedFiles(cfg)
+		if err != nil {
+			fprintln(stderr, "Error:", err)
+
+			return exitError
+		}
+	}
+	var partial map[string]bool
+	if cfg.staged {
+		paths, partial, err = stagedFiles(cfg)
 		if err != nil {
 			fprintln(stderr, "Error:", err)
 
 			return exitError
 		}
+	}
+
+	// A target that fails is reported and the run moves on to the next, so
+	// one unreadable file doesn't hide the results for all the others.
+	failed := false
+	flagged := make([]*violationError, 0, len(paths))
+	for _, target := range paths {
+		targetCfg := cfg
+		if partial[target] && cfg.fix {
+			// Staging the fix would stage the unstaged changes with it.
+			cfg.log.warnf("%s has unstaged changes; checking it without fixing", target)
+			targetCfg.fix, targetCfg.prompt = false, nil
+		}
+		files, err := processPath(target, targetCfg)
+		if errors.Is(err, errNoGoFiles) && !cfg.errorOnEmpty {
+			cfg.log.warnf("%v", err)
+
+			continue
+		}
+		// The files a walk could not check were reported one by one.
+		if err != nil && !errors.Is(err, errUnchecked) {
+			cfg.log.errorf("%v", err)
+		}
+		failed = failed || err != nil
 		flagged = append(flagged, files...)
 	}
+	if cfg.staged && cfg.fix {
+		err = stageFixes(flagged)
+		if err != nil {
+			cfg.log.errorf("%v", err)
+			failed = true
+		}
+	}
+
+	return reportResults(cfg, flagged, failed, stdout, stderr)
+}
+
+// reportResults prints the files flagged by a run in the configured output
+// format and returns the exit code. failed is set when any target could not
+// be processed.
+func reportResults(cfg config, flagged []*violationError, failed bool, stdout, stderr io.Writer) int {
+	if cfg.patchOut != "" {
+		err := writePatch(cfg.patchOut, flagged)
+		if err != nil {
+			fprintln(stderr, "Error:", err)
+
+			return exitError
+		}
+	}
+
+	if cfg.count {
+		fprintln(stdout, len(flagged))
+		if failed {
+			return exitError
+		}
 
-	label := "needs formatting:"
-	if cfg.fix {
-		label = "fixed:"
+		return exitOK
 	}
-	for _, file := range flagged {
-		fprintln(stdout, label, file)
+
+	if cfg.format != formatText {
+		write := writeJSONReport
+		if cfg.format == formatSARIF {
+			level := "error"
+			if cfg.warnOnly {
+				level = "warning"
+			}
+			write = func(w io.Writer, flagged []*violationError) error {
+				return writeSARIFReport(w, flagged, level)
+			}
+		}
+		err := write(stdout, flagged)
+		if err != nil {
+			fprintln(stderr, "Error:", err)
+
+			return exitError
+		}
+	} else {
+		for _, file := range flagged {
+			printResult(stdout, cfg, file)
+		}
+		if !cfg.quiet && !cfg.list {
+			if cfg.log.json {
+				var summary strings.Builder
+				printSummary(&summary, cfg, flagged)
+				if summary.Len() > 0 {
+					cfg.log.write(logEvent{Event: "summary", Message: strings.TrimSuffix(summary.String(), "\n")})
+				}
+			} else {
+				printSummary(stderr, cfg, flagged)
+			}
+		}
 	}
 
+	if failed {
+		return exitError
+	}
+	// -warn-only reports the issues but lets the run pass, while a check is
+	// being rolled out.
+	if cfg.warnOnly {
+		return exitOK
+	}
 	if len(flagged) > 0 && !cfg.fix {
 		return exitIssuesFound
 	}
+	// Fixes declined at an -interactive prompt or not written to a
+	// read-only file are still issues, and so are banned imports, which no
+	// fix removes.
+	if slices.ContainsFunc(flagged, func(file *violationError) bool {
+		return !file.fixed || file.has(violationBanned)
+	}) {
+		return exitIssuesFound
+	}
+
+	return exitOK
+}
+
+// runExplain prints how each import of a single file is classified and
+// where it ends up after sorting, without touching the file. It is meant
+// for debugging -internal-prefix and -import-order.
+func runExplain(args []string, stdout, stderr io.Writer) int {
+	cfg, paths, err := parseArgs(args, stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+	if err == nil && len(paths) != 1 {
+		err = errors.New("explain takes exactly one file")
+	}
+	if err != nil {
+		fprintln(stderr, "Error:", err)
+
+		return exitError
+	}
+
+	file, err := loadSourceFile(newOSFS(filepath.Dir(paths[0]), ""), filepath.Base(paths[0]), cfg)
+	if err != nil {
+		fprintln(stderr, "Error:", err)
+
+		return exitError
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fprintln(tw, "POSITION\tGROUP\tLINE\tIMPORT")
+	position := 0
+	for _, section := range importSections(dedupeImports(file.usedImports()), cfg, file.compare(cfg)) {
+		for _, imp := range section {
+			position++
+			spec := imp.literal
+			if imp.name != "" {
+				spec = imp.name + " " + spec
+			}
+			_, _ = fmt.Fprintf(tw, "%d\t%s\t%d\t%s\n", position, imp.group, imp.line, spec)
+		}
+	}
+	_ = tw.Flush()
 
 	return exitOK
 }
 
+func printResult(w io.Writer, cfg config, file *violationError) {
+	switch {
+	case cfg.quiet:
+		return
+	case cfg.list:
+		fprintln(w, file.path)
+
+		return
+	case file.fixed:
+		fprintln(w, "fixed:", file.path)
+		for _, m := range file.moves {
+			fprintln(w, "\t"+m.String())
+		}
+	case cfg.diff && file.diff != nil:
+		_, _ = w.Write(file.diff)
+	case slices.ContainsFunc(file.violations, func(v violation) bool { return v.kind != violationBanned }):
+		fprintln(w, "needs formatting:", file.path)
+	}
+	// Banned imports need a person to remove them, so they are listed
+	// one by one; -verbose lists the other violations too.
+	for _, v := range file.violations {
+		if v.kind == violationBanned || cfg.verbose {
+			_, _ = fmt.Fprintf(w, "%s:%d:%d: %s\n", file.path, v.line, v.column, v)
+		}
+	}
+}
+
+// cliFlags holds the values of the command-line flags.
+type cliFlags struct {
+	internalPrefix    string
+	local             string
+	mode              string
+	stdList           bool
+	goVersion         string
+	sharedPrefix      string
+	importOrder       string
+	partialOrder      bool
+	fix               bool
+	diff              bool
+	assumeGofmt       bool
+	verify            bool
+	backup            bool
+	backupSuffix      string
+	warnOnly          bool
+	rewriteReport     bool
+	patchOut          string
+	outDir            string
+	toStdout          bool
+	interactive       bool
+	preserveSubgroups bool
+	stdSubgroups      string
+	sortOrder         string
+	parenthesize      string
+	blankImports      string
+	internalSort      string
+	removeUnused      bool
+	addMissing        bool
+	maxLineLength     int
+	list              bool
+	count             bool
+	format            string
+	logFormat         string
+	quiet             bool
+	verbose           bool
+	watchMode         bool
+	errorOnEmpty      bool
+	maxFileSize       int64
+	jobs              int
+	extensions        string
+	lenientParse      bool
+	stdinFilename     string
+	since             string
+	staged            bool
+	cpuProfile        string
+	memProfile        string
+	configPath        string
+	disable           string
+	rules             string
+	includeHidden     bool
+	suggest           bool
+	validateConfig    bool
+}
+
+// newCLIFlags registers the command-line flags on flags.
+func newCLIFlags(flags *flag.FlagSet) *cliFlags {
+	f := &cliFlags{}
+	flags.StringVar(&f.internalPrefix, "internal-prefix", "", "comma-separated prefixes identifying internal imports (required unless -mode=gomod, -mode=gowork, or the -config file sets importGroups)")
+	flags.StringVar(&f.local, "local", "", "goimports-compatible alias for -internal-prefix; both are merged when given together")
+	flags.StringVar(&f.mode, "mode", modePrefix, "classification mode: prefix, gomod (internal prefix and known modules from the nearest go.mod), or gowork (every module of the nearest go.work)")
+	flags.BoolVar(&f.stdList, "std-list", false, "classify standard library imports by the package list of -go-version instead of by the absence of a dot")
+	flags.StringVar(&f.goVersion, "go-version", "", "Go release whose standard library -std-list uses (default "+stdlibVersion+")")
+	flags.StringVar(&f.sharedPrefix, "shared-prefix", "", "prefix identifying company-wide shared imports, grouped between external and internal")
+	flags.StringVar(&f.importOrder, "import-order", "", "comma-separated import group order (default standard,external[,shared],internal)")
+	flags.BoolVar(&f.partialOrder, "partial-import-order", false, "allow -import-order to omit groups, appending them in default order")
+	flags.BoolVar(&f.fix, "fix", false, "rewrite files instead of just reporting issues")
+	flags.BoolVar(&f.fix, "w", false, "alias for -fix, as in gofmt")
+	flags.BoolVar(&f.diff, "d", false, "print the changes a fix would make as unified diffs instead of the paths of the files, as gofmt -d does")
+	flags.BoolVar(&f.assumeGofmt, "assume-gofmt", false, "trust that files are gofmt-formatted, valid Go: parse and verify only up to the end of the imports")
+	flags.BoolVar(&f.verify, "verify", false, "after -fix writes a file, read it back and restore the original if it no longer parses")
+	flags.BoolVar(&f.backup, "backup", false, "before -fix overwrites a file, save the original next to it under -backup-suffix")
+	flags.StringVar(&f.backupSuffix, "backup-suffix", ".orig", "suffix appended to the path of a -backup copy")
+	flags.BoolVar(&f.warnOnly, "warn-only", false, "report issues as warnings and exit 0 even when files need formatting; errors still exit 2")
+	flags.BoolVar(&f.rewriteReport, "rewrite-report", false, "with -fix, list the imports each fix moved, with their line and group before and after")
+	flags.StringVar(&f.patchOut, "patch-out", "", "write the fixes for all files that need them to this file, as one patch for git apply, instead of fixing them")
+	flags.StringVar(&f.outDir, "out-dir", "", "like -fix, but write fixed files to a tree mirroring their paths under this directory, leaving the originals alone")
+	flags.BoolVar(&f.toStdout, "stdout", false, "write the fixed content of the single file given to stdout, leaving the file alone")
+	flags.BoolVar(&f.interactive, "interactive", false, "like -fix, but show each file's diff and ask before writing it; needs a terminal")
+	flags.BoolVar(&f.preserveSubgroups, "preserve-subgroups", false, "keep blank lines inside a group as subsection boundaries")
+	flags.StringVar(&f.stdSubgroups, "std-subgroups", "", "comma-separated standard library prefixes (e.g. net,os) that each get their own blank-line separated block")
+	flags.StringVar(&f.sortOrder, "sort", sortASCII, "order within each group: ascii (byte values), case-insensitive, segments (path element by element), module-aware (by module, then segments), upper-first (paths with a capitalized segment first), or none (source order)")
+	flags.StringVar(&f.parenthesize, "parenthesize", "", "comma-separated kinds of lone import kept in an import block rather than collapsed to one line: blank, dot")
+	flags.StringVar(&f.blankImports, "blank-imports", blankImportsKeep, "order of blank (_) imports within each group: keep (sorted among the other imports, but in source order among themselves), or sort")
+	flags.StringVar(&f.internalSort, "internal-sort", internalSortAlpha, "order within the internal group: alpha, or depth (shallower paths first)")
+	flags.BoolVar(&f.removeUnused, "remove-unused", false, "report imports the file never refers to, and drop them when fixing, like goimports; blank, dot, and cgo imports are kept")
+	flags.BoolVar(&f.addMissing, "add-missing", false, "report packages the file refers to without importing them, from the standard library or the module and its dependencies, and add the imports when fixing, like goimports")
+	flags.IntVar(&f.maxLineLength, "max-line-length", 0, "move trailing import comments above the import when the line would exceed this many bytes (0 disables)")
+	flags.BoolVar(&f.list, "list", false, "only print the paths of files whose imports need formatting")
+	flags.BoolVar(&f.list, "l", false, "alias for -list, as in gofmt")
+	flags.BoolVar(&f.count, "count", false, "only print the number of files whose imports need formatting, and exit 0")
+	flags.StringVar(&f.format, "format", formatText, "output format: text, json, or sarif")
+	flags.StringVar(&f.logFormat, "log-format", logFormatText, "format of notices, warnings, and errors on stderr: text, or json (one event per line, including each file processed)")
+	flags.BoolVar(&f.quiet, "quiet", false, "print nothing but errors; rely on the exit code")
+	flags.BoolVar(&f.verbose, "verbose", false, "print each violation under its file, as path:line:column: message")
+	flags.BoolVar(&f.watchMode, "watch", false, "keep running and re-check .go files as they change")
+	flags.BoolVar(&f.errorOnEmpty, "error-on-empty", false, "fail instead of warning when a directory contains no .go files")
+	flags.Int64Var(&f.maxFileSize, "max-file-size", 0, "skip files larger than this many bytes (0 means unlimited)")
+	flags.IntVar(&f.jobs, "jobs", 0, "number of files to check concurrently (0 means one per CPU, 1 is serial)")
+	flags.StringVar(&f.extensions, "extensions", ".go", "comma-separated file name suffixes processed when walking directories, e.g. .go,.go.tmpl")
+	flags.BoolVar(&f.lenientParse, "lenient-parse", false, "tidy the import block of files that don't parse as Go, e.g. templates, by locating it textually")
+	flags.StringVar(&f.stdinFilename, "stdin-filename", "", "path the source read from stdin (path argument -) is reported and resolved as, e.g. for -mode=gomod")
+	flags.StringVar(&f.since, "since", "", "process only the files changed between this git ref and HEAD instead of path arguments")
+	flags.BoolVar(&f.staged, "staged", false, "process only the files staged for commit instead of path arguments, and with -fix stage the fixes too, for a pre-commit hook")
+	flags.StringVar(&f.cpuProfile, "cpuprofile", "", "write a CPU profile of the run to this file, for go tool pprof")
+	flags.StringVar(&f.memProfile, "memprofile", "", "write a heap profile to this file when the run ends, for go tool pprof")
+	flags.StringVar(&f.configPath, "config", "", "JSON configuration file, e.g. with classify rules")
+	flags.StringVar(&f.disable, "disable", "", "comma-separated violation kinds to neither report nor fix, e.g. sort-order,extra-blank")
+	flags.StringVar(&f.rules, "rules", "", "comma-separated violation kinds to report and fix, disabling all others, e.g. wrong-order")
+	flags.BoolVar(&f.includeHidden, "include-hidden", false, "walk directories whose name starts with \".\", such as .git, which are skipped by default")
+	flags.BoolVar(&f.suggest, "suggest", false, "warn about external imports that share an owner, such as github.com/acme/, with the internal prefix")
+	flags.BoolVar(&f.validateConfig, "validate-config", false, "check the flags and -config file, print the effective configuration, and exit")
+
+	return f
+}
+
 func parseArgs(args []string, stderr io.Writer) (config, []string, error) {
 	flags := flag.NewFlagSet("import-tidy", flag.ContinueOnError)
 	flags.SetOutput(stderr)
-	internalPrefix := flags.String("internal-prefix", "", "prefix identifying internal imports (required)")
-	importOrder := flags.String("import-order", "standard,external,internal", "comma-separated import group order")
-	fix := flags.Bool("fix", false, "rewrite files instead of just reporting issues")
-
+	f := newCLIFlags(flags)
 	err := flags.Parse(args)
 	if err != nil {
 		return config{}, nil, err
@@ -114,361 +774,2514 @@ func parseArgs(args []string, stderr io.Writer) (config, []string, error) {
 	var paths []string
 	for _, arg := range flags.Args() {
 		if arg == "--fix" || arg == "-fix" {
-			*fix = true
+			f.fix = true
+
+			continue
+		}
+		paths = append(paths, arg)
+	}
+
+	internalPrefixes, module, err := f.resolveMode()
+	if err != nil {
+		return config{}, nil, err
+	}
+	err = f.checkOutputFlags(paths)
+	if err != nil {
+		return config{}, nil, err
+	}
+	paths, err = f.resolvePaths(paths)
+	if err != nil {
+		return config{}, nil, err
+	}
+	err = f.checkReportFlags()
+	if err != nil {
+		return config{}, nil, err
+	}
+
+	cfg := config{
+		internalPrefixes: internalPrefixes,
+		module:           module,
+		sharedPrefix:     f.sharedPrefix,
+		fix:              f.fix || f.interactive || f.outDir != "",
+		interactive:      f.interactive,
+		stdinFilename:    f.stdinFilename,
+		outDir:           f.outDir,
+		patchOut:         f.patchOut,
+		rewriteReport:    f.rewriteReport,
+		warnOnly:         f.warnOnly,
+		verify:           f.verify,
+		assumeGofmt:      f.assumeGofmt,
+		backupSuffix:     f.backupSuffix,
+		cpuProfile:       f.cpuProfile,
+		memProfile:       f.memProfile,
+		stdSubgroups:     splitList(f.stdSubgroups),
+		maxLineLength:    f.maxLineLength,
+		internalSort:     f.internalSort,
+		sort:             f.sortOrder,
+		blankImports:     f.blankImports,
+		list:             f.list,
+		count:            f.count,
+		format:           f.format,
+		quiet:            f.quiet,
+		verbose:          f.verbose,
+		diff:             f.diff,
+		watch:            f.watchMode,
+		errorOnEmpty:     f.errorOnEmpty,
+		maxFileSize:      f.maxFileSize,
+		jobs:             f.jobs,
+		extensions:       splitList(f.extensions),
+		lenientParse:     f.lenientParse,
+		removeUnused:     f.removeUnused,
+		addMissing:       f.addMissing,
+		since:            f.since,
+		staged:           f.staged,
+		stdout:           f.toStdout,
+		suggest:          f.suggest,
+		includeHidden:    f.includeHidden,
+		validateConfig:   f.validateConfig,
+		log:              &logger{out: stderr, quiet: f.quiet, json: f.logFormat == logFormatJSON},
+	}
+	err = f.parseValues(&cfg)
+	if err == nil {
+		err = f.loadStdlib(&cfg)
+	}
+	if err != nil {
+		return config{}, nil, err
+	}
+	customOrder, paths, err := f.applyConfigFile(&cfg, paths)
+	if err != nil {
+		return config{}, nil, err
+	}
+	err = f.resolveGroups(&cfg, customOrder)
+	if err != nil {
+		return config{}, nil, err
+	}
+
+	return cfg, paths, nil
+}
+
+// resolveMode returns the internal prefixes given by -internal-prefix and
+// -local, or, with -mode=gomod or -mode=gowork, by the nearest go.mod or
+// go.work, which it returns too.
+func (f *cliFlags) resolveMode() ([]string, *modFile, error) {
+	internalPrefixes := splitList(f.internalPrefix)
+	for _, prefix := range splitList(f.local) {
+		if !slices.Contains(internalPrefixes, prefix) {
+			internalPrefixes = append(internalPrefixes, prefix)
+		}
+	}
+
+	switch f.mode {
+	case modePrefix:
+		// Without -internal-prefix, the prefix comes from the go.mod of
+		// each file, unless the config file defines importGroups, which is
+		// checked once it is loaded.
+		return internalPrefixes, nil, nil
+	case modeGoMod, modeGoWork:
+		modeFile, find, load := "go.mod", findGoMod, loadGoMod
+		if f.mode == modeGoWork {
+			modeFile, find, load = "go.work", findGoWork, loadGoWork
+		}
+		if len(internalPrefixes) > 0 {
+			return nil, nil, fmt.Errorf("-internal-prefix and -local cannot be combined with -mode=%s, which takes the prefix from %s", f.mode, modeFile)
+		}
+		dir := "."
+		if f.stdinFilename != "" {
+			dir = filepath.Dir(f.stdinFilename)
+		}
+		path, err := find(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		module, err := load(path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return module.internalPrefixes(), module, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown -mode %q (valid: prefix, gomod, gowork)", f.mode)
+	}
+}
+
+// checkOutputFlags rejects combinations of the flags that say where fixes
+// go: -fix, -interactive, -out-dir, -stdout, -backup, and -patch-out.
+func (f *cliFlags) checkOutputFlags(paths []string) error {
+	if slices.Contains(paths, stdinPath) && (len(paths) > 1 || f.since != "" || f.watchMode || f.interactive || f.outDir != "") {
+		return errors.New("- (standard input) cannot be combined with other paths, -since, -watch, -interactive, or -out-dir")
+	}
+	if f.toStdout && (len(paths) != 1 || paths[0] == stdinPath || f.staged || f.since != "") {
+		return errors.New("-stdout requires exactly one file path")
+	}
+	if f.toStdout && (f.fix || f.interactive || f.outDir != "" || f.watchMode || f.list || f.count || f.patchOut != "" || f.rewriteReport) {
+		return errors.New("-stdout cannot be combined with -fix, -interactive, -out-dir, -watch, -list, -count, -patch-out, or -rewrite-report")
+	}
+	if f.outDir != "" && (f.list || f.count || f.verify) {
+		return errors.New("-out-dir cannot be combined with -list, -count, or -verify")
+	}
+	switch {
+	case !f.backup:
+		f.backupSuffix = "" // no backups are written, and none are skipped
+	case !f.fix && !f.interactive:
+		return errors.New("-backup requires -fix or -interactive")
+	case f.outDir != "" || slices.Contains(paths, stdinPath):
+		return errors.New("-backup cannot be combined with -out-dir or - (standard input)")
+	case f.backupSuffix == "" || strings.ContainsAny(f.backupSuffix, `/\`):
+		return fmt.Errorf("invalid -backup-suffix %q", f.backupSuffix)
+	}
+	if f.patchOut != "" && (f.fix || f.interactive || f.outDir != "" || f.watchMode) {
+		return errors.New("-patch-out cannot be combined with -fix, -interactive, -out-dir, or -watch")
+	}
+	if f.warnOnly && (f.fix || f.interactive || f.outDir != "") {
+		return errors.New("-warn-only cannot be combined with -fix, -interactive, or -out-dir")
+	}
+	if f.rewriteReport && !f.fix && !f.interactive && f.outDir == "" {
+		return errors.New("-rewrite-report requires -fix, -interactive, or -out-dir")
+	}
+
+	return nil
+}
+
+// resolvePaths returns the path arguments, or standard input when nothing
+// says what to check, and checks them against -stdin-filename, -since, and
+// -staged.
+func (f *cliFlags) resolvePaths(paths []string) ([]string, error) {
+	// Like gofmt, read the source from stdin when nothing else says what to
+	// check, so editors can pipe a buffer through without a temp file.
+	if len(paths) == 0 && !f.validateConfig && f.since == "" && !f.staged && f.configPath == "" {
+		if f.watchMode || f.interactive || f.outDir != "" || f.backup {
+			return nil, errors.New("path to a file or directory is required")
+		}
+		paths = []string{stdinPath}
+	}
+	if f.stdinFilename != "" && !slices.Contains(paths, stdinPath) {
+		return nil, errors.New("-stdin-filename requires the path argument - (standard input)")
+	}
+	if f.since != "" && len(paths) > 0 {
+		return nil, errors.New("-since cannot be combined with path arguments")
+	}
+	// git would read such a ref as one of its options.
+	if strings.HasPrefix(f.since, "-") {
+		return nil, fmt.Errorf("-since %q is not a git ref", f.since)
+	}
+	if f.staged && (len(paths) > 0 || f.since != "" || f.watchMode || f.outDir != "") {
+		return nil, errors.New("-staged cannot be combined with path arguments, -since, -watch, or -out-dir")
+	}
+
+	return paths, nil
+}
 
+// checkReportFlags rejects combinations of the flags that say how results
+// are reported.
+func (f *cliFlags) checkReportFlags() error {
+	if f.list && f.fix {
+		return errors.New("-list cannot be combined with -fix")
+	}
+	if f.diff && (f.fix || f.interactive || f.outDir != "" || f.toStdout || f.list || f.count || f.format != formatText) {
+		return errors.New("-d cannot be combined with -fix, -interactive, -out-dir, -stdout, -list, -count, or -format")
+	}
+	if f.verbose && (f.quiet || f.list || f.count || f.format != formatText) {
+		return errors.New("-verbose cannot be combined with -quiet, -list, -count, or -format")
+	}
+	if f.interactive && (f.list || f.count || f.watchMode || f.format != formatText) {
+		return errors.New("-interactive cannot be combined with -list, -count, -watch, or -format")
+	}
+	if !slices.Contains([]string{formatText, formatJSON, formatSARIF}, f.format) {
+		return fmt.Errorf("unknown -format %q (valid: text, json, sarif)", f.format)
+	}
+	if f.logFormat != logFormatText && f.logFormat != logFormatJSON {
+		return fmt.Errorf("unknown -log-format %q (valid: text, json)", f.logFormat)
+	}
+	if f.list && f.format != formatText {
+		return errors.New("-list cannot be combined with -format")
+	}
+	if f.count && (f.fix || f.list || f.format != formatText) {
+		return errors.New("-count cannot be combined with -fix, -list, or -format")
+	}
+
+	return nil
+}
+
+// parseValues checks the values of the flags that shape the fixes, and
+// stores the parsed -parenthesize, -disable, and -rules in cfg.
+func (f *cliFlags) parseValues(cfg *config) error {
+	if f.removeUnused && f.lenientParse {
+		return errors.New("-remove-unused cannot be combined with -lenient-parse, which does not parse the code that uses the imports")
+	}
+	if f.addMissing && f.lenientParse {
+		return errors.New("-add-missing cannot be combined with -lenient-parse, which does not parse the code that uses the imports")
+	}
+	if f.maxFileSize < 0 {
+		return errors.New("-max-file-size must not be negative")
+	}
+	if f.internalSort != internalSortAlpha && f.internalSort != internalSortDepth {
+		return fmt.Errorf("unknown -internal-sort %q (valid: alpha, depth)", f.internalSort)
+	}
+	if _, ok := sortComparators[f.sortOrder]; !ok {
+		return fmt.Errorf("unknown -sort %q (valid: ascii, case-insensitive, segments, module-aware, upper-first, none)", f.sortOrder)
+	}
+	if f.blankImports != blankImportsKeep && f.blankImports != blankImportsSort {
+		return fmt.Errorf("unknown -blank-imports %q (valid: keep, sort)", f.blankImports)
+	}
+	cfg.parenthesize = make(map[string]bool)
+	for _, kind := range splitList(f.parenthesize) {
+		if kind != parenthesizeBlank && kind != parenthesizeDot {
+			return fmt.Errorf("unknown -parenthesize %q (valid: blank, dot)", kind)
+		}
+		cfg.parenthesize[kind] = true
+	}
+	disabled, err := parseDisabled(f.disable)
+	if err != nil {
+		return fmt.Errorf("invalid -disable: %w", err)
+	}
+	if f.rules != "" {
+		unselected, err := parseRules(f.rules)
+		if err != nil {
+			return fmt.Errorf("invalid -rules: %w", err)
+		}
+		for kind := range unselected {
+			disabled[kind] = true
+		}
+	}
+	cfg.disabled = disabled
+	cfg.preserveSubgroups = f.preserveSubgroups || disabled[violationExtraBlank]
+	if f.jobs < 0 {
+		return errors.New("-jobs must not be negative")
+	}
+	if f.maxLineLength < 0 {
+		return errors.New("-max-line-length must not be negative")
+	}
+
+	return nil
+}
+
+// loadStdlib loads the standard library package lists that -std-list and
+// -add-missing use into cfg.
+func (f *cliFlags) loadStdlib(cfg *config) error {
+	var err error
+	switch {
+	case f.stdList:
+		f.goVersion = cmp.Or(f.goVersion, stdlibVersion)
+		cfg.stdPackages, err = stdPackages(f.goVersion)
+		if err != nil {
+			return err
+		}
+	case f.goVersion != "" && !f.addMissing:
+		return errors.New("-go-version requires -std-list or -add-missing")
+	}
+	cfg.goVersion = f.goVersion
+	if f.addMissing {
+		cfg.stdByName, err = stdPackagesByName(cmp.Or(f.goVersion, stdlibVersion))
+		if err != nil {
+			return err
+		}
+		cfg.packages = newPackageIndex()
+	}
+
+	return nil
+}
+
+// applyConfigFile stores the settings of the -config file in cfg and
+// returns the order of its importGroups, if it defines any, and the paths
+// to check, which it takes from the file when there are no path arguments.
+func (f *cliFlags) applyConfigFile(cfg *config, paths []string) ([]importGroup, []string, error) {
+	if f.configPath == "" {
+		return nil, paths, nil
+	}
+	fc, err := loadConfigFile(f.configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The importGroups go first: the other settings may name them.
+	var customOrder []importGroup
+	cfg.customGroups, customOrder, err = fc.customGroups(cfg.stdPackages)
+	if err == nil {
+		cfg.groupOverrides, err = fc.groupOverrides()
+	}
+	if err == nil {
+		cfg.classifiers, err = fc.classifiers()
+	}
+	if err == nil {
+		err = fc.checkAliases()
+	}
+	if err == nil {
+		cfg.aliasPatterns, err = fc.aliasPatterns()
+	}
+	if err == nil {
+		err = fc.checkBanned()
+	}
+	if err == nil {
+		cfg.exclude, err = fc.excludePatterns(filepath.Dir(f.configPath))
+	}
+	// Without path arguments, the config file says what to check.
+	if err == nil && len(paths) == 0 && f.since == "" && !f.staged {
+		paths, err = fc.includePaths(filepath.Dir(f.configPath), cfg.exclude)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", f.configPath, err)
+	}
+	cfg.aliases = fc.Aliases
+	cfg.bannedPaths = fc.Banned
+
+	return customOrder, paths, nil
+}
+
+// resolveGroups works out the import groups in use, from the -config file's
+// importGroups or the flags, checks that the config file names only those,
+// and stores their order in cfg.
+func (f *cliFlags) resolveGroups(cfg *config, customOrder []importGroup) error {
+	if customOrder != nil && (len(cfg.internalPrefixes) > 0 || f.sharedPrefix != "" || f.mode != modePrefix) {
+		return fmt.Errorf("%s: importGroups cannot be combined with -internal-prefix, -local, -shared-prefix, or -mode", f.configPath)
+	}
+	if customOrder == nil && f.mode == modePrefix && len(cfg.internalPrefixes) == 0 {
+		cfg.modules = newModuleFinder()
+	}
+	usesShared := slices.ContainsFunc(cfg.classifiers, func(c classifier) bool { return c.group == sharedLibrary })
+	for _, group := range cfg.groupOverrides {
+		usesShared = usesShared || group == sharedLibrary
+	}
+
+	groups := []importGroup{standardLibrary, externalLibrary, internalLibrary}
+	switch {
+	case customOrder != nil:
+		groups = customOrder
+	case f.sharedPrefix != "" || usesShared:
+		groups = []importGroup{standardLibrary, externalLibrary, sharedLibrary, internalLibrary}
+	}
+	// With importGroups, the built-in groups are only there if defined.
+	for i, c := range cfg.classifiers {
+		if !slices.Contains(groups, c.group) {
+			return fmt.Errorf("%s: classify[%d]: import group %q is not in use (valid: %s)", f.configPath, i, c.group, joinGroups(groups))
+		}
+	}
+	for _, importPath := range slices.Sorted(maps.Keys(cfg.groupOverrides)) {
+		if group := cfg.groupOverrides[importPath]; !slices.Contains(groups, group) {
+			return fmt.Errorf("%s: groups: import group %q for %q is not in use (valid: %s)", f.configPath, group, importPath, joinGroups(groups))
+		}
+	}
+	orderSpec, joined, err := joinedGroups(f.importOrder)
+	if err != nil {
+		return fmt.Errorf("invalid -import-order: %w", err)
+	}
+	cfg.groupOrder, err = parseImportOrder(orderSpec, groups, f.partialOrder)
+	if err != nil {
+		return fmt.Errorf("invalid -import-order: %w", err)
+	}
+	cfg.joined = joined
+
+	return nil
+}
+
+// parseImportOrder resolves the -import-order list against the groups in
+// use, given in their default order. Every group must be named exactly
+// once; with partial set, groups left out are appended in default order
+// instead, so no imports are ever dropped. An empty spec selects the
+// default order.
+func parseImportOrder(spec string, groups []importGroup, partial bool) ([]importGroup, error) {
+	if strings.TrimSpace(spec) == "" {
+		return groups, nil
+	}
+
+	var order []importGroup
+	seen := make(map[importGroup]bool, len(groups))
+
+	for part := range strings.SplitSeq(spec, ",") {
+		name := strings.TrimSpace(part)
+		if name == "" {
+			continue
+		}
+		group, ok := lookupGroup(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown import group %q (valid: %s)", name, joinGroups(groups))
+		}
+		if !slices.Contains(groups, group) {
+			return nil, fmt.Errorf("import group %q is not in use (valid: %s)", name, joinGroups(groups))
+		}
+		if seen[group] {
+			return nil, fmt.Errorf("import group %q is listed more than once", name)
+		}
+		seen[group] = true
+		order = append(order, group)
+	}
+
+	for _, group := range groups {
+		if seen[group] {
+			continue
+		}
+		if !partial {
+			return nil, fmt.Errorf("import group %q is missing (use -partial-import-order to append omitted groups)", group)
+		}
+		order = append(order, group)
+	}
+
+	return order, nil
+}
+
+// joinedGroups handles the "+" of -import-order, as in
+// "standard+external,internal": a group after "+" shares the block of the
+// group before it, with no blank line between them. It returns the spec with
+// "+" read as "," for parseImportOrder, and the set of groups joined to the
+// group before them. Unknown group names are left for parseImportOrder to
+// report.
+func joinedGroups(spec string) (string, map[importGroup]bool, error) {
+	joined := make(map[importGroup]bool)
+	for part := range strings.SplitSeq(spec, ",") {
+		names := strings.Split(part, "+")
+		if len(names) == 1 {
+			continue
+		}
+		for i, name := range names {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				return "", nil, fmt.Errorf("%q: \"+\" must join two group names", strings.TrimSpace(part))
+			}
+			if group, ok := lookupGroup(name); ok && i > 0 {
+				joined[group] = true
+			}
+		}
+	}
+
+	return strings.ReplaceAll(spec, "+", ","), joined, nil
+}
+
+// enforcedKinds are the violation kinds that cannot be disabled, as every
+// fix enforces them: multiple-decls, since the other rules are checked on a
+// single declaration, and those describing the layout the rewrite writes.
+var enforcedKinds = []violationKind{
+	violationMultipleDecls,
+	violationWrongOrder,
+	violationMissingBlank,
+	violationSharedLine,
+	violationDuplicate,
+	violationBlankAfterParen,
+	violationBlankBeforeParen,
+	violationBlankAfterDecl,
+	violationLayout,
+}
+
+// parseDisabled reads the -disable list of violation kinds. Disabling
+// extra-blank keeps blank lines inside groups, which is what
+// -preserve-subgroups does, so parseArgs turns that on. The enforcedKinds
+// cannot be disabled: a disabled kind is skipped by fixes as well as checks.
+func parseDisabled(value string) (map[violationKind]bool, error) {
+	disabled, err := parseKinds(value)
+	if err != nil {
+		return nil, err
+	}
+	for _, kind := range enforcedKinds {
+		if disabled[kind] {
+			return nil, fmt.Errorf("%s cannot be disabled: every fix enforces it", kind)
+		}
+	}
+
+	return disabled, nil
+}
+
+// parseRules reads the -rules list of violation kinds to enforce and
+// returns all the others, to be disabled as with -disable. With only
+// wrong-order selected, a fix moves groups into place but keeps the order
+// and blank lines within each. The enforcedKinds are always enforced.
+func parseRules(value string) (map[violationKind]bool, error) {
+	selected, err := parseKinds(value)
+	if err != nil {
+		return nil, err
+	}
+	unselected := make(map[violationKind]bool)
+	for _, kind := range violationKinds {
+		if !selected[kind] && !slices.Contains(enforcedKinds, kind) {
+			unselected[kind] = true
+		}
+	}
+
+	return unselected, nil
+}
+
+func parseKinds(value string) (map[violationKind]bool, error) {
+	kinds := make(map[violationKind]bool)
+	for _, name := range splitList(value) {
+		kind := violationKind(name)
+		if !slices.Contains(violationKinds, kind) {
+			return nil, fmt.Errorf("unknown violation kind %q", name)
+		}
+		kinds[kind] = true
+	}
+
+	return kinds, nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for item := range strings.SplitSeq(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func joinGroups(groups []importGroup) string {
+	names := make([]string, len(groups))
+	for i, group := range groups {
+		names[i] = group.String()
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// importBlocks returns the group order split into the blank line separated
+// blocks of the output: one group per block, except for groups joined with
+// "+" in -import-order, which share the block of the group before them.
+func (cfg config) importBlocks() [][]importGroup {
+	var blocks [][]importGroup
+	for _, group := range cfg.groupOrder {
+		if n := len(blocks); n > 0 && cfg.joined[group] {
+			blocks[n-1] = append(blocks[n-1], group)
+
+			continue
+		}
+		blocks = append(blocks, []importGroup{group})
+	}
+
+	return blocks
+}
+
+// sharesBlock reports whether group is joined with another group in one
+// block.
+func (cfg config) sharesBlock(group importGroup) bool {
+	i := slices.Index(cfg.groupOrder, group)
+
+	return cfg.joined[group] || i+1 < len(cfg.groupOrder) && cfg.joined[cfg.groupOrder[i+1]]
+}
+
+func processPath(target string, cfg config) ([]*violationError, error) {
+	target, info, err := statTarget(target)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return processDirectory(target, cfg)
+	}
+	if cfg.tooLarge(target, info) {
+		return nil, nil
+	}
+
+	verr, err := collectViolations(checkImports(target, cfg))
+	if errors.Is(err, fs.ErrPermission) {
+		return nil, fmt.Errorf("permission denied: %s", target)
+	}
+	if err != nil || verr == nil {
+		return nil, err
+	}
+
+	return []*violationError{verr}, nil
+}
+
+// statTarget resolves a path argument. A trailing "/..." is accepted the way
+// the go command spells "this directory and everything below it"; plain
+// directories are walked recursively anyway, so it only has to name one.
+func statTarget(target string) (string, fs.FileInfo, error) {
+	root, recursive := strings.CutSuffix(target, "/...")
+	if target == "..." {
+		root, recursive = ".", true
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return "", nil, err
+	}
+	if recursive && !info.IsDir() {
+		return "", nil, fmt.Errorf("%s: not a directory", target)
+	}
+
+	return root, info, nil
+}
+
+var skippedDirs = map[string]bool{
+	"vendor":       true,
+	"testdata":     true,
+	"node_modules": true,
+}
+
+// errNoGoFiles reports a directory without a single .go file to check,
+// which usually means a mistyped path.
+var errNoGoFiles = errors.New("no Go files found")
+
+func processDirectory(root string, cfg config) ([]*violationError, error) {
+	flagged, err := processFS(newOSFS(root, cfg.outDir), cfg)
+	if errors.Is(err, errNoGoFiles) || errors.Is(err, errUnchecked) {
+		return flagged, fmt.Errorf("%s: %w", root, err)
+	}
+
+	return flagged, err
+}
+
+// processFS checks every .go file in fsys. Directories on disk go through
+// here as well as read-only filesystems such as module zips, for which -fix
+// degrades to reporting.
+//
+// Files are checked by up to cfg.jobs workers, but results are collected in
+// walk order, so the output is the same whatever the degree of parallelism.
+// A file the process may not read or write, or one that is not valid Go, is
+// reported as it comes up and the walk goes on; the run still fails in the
+// end.
+func processFS(fsys fs.FS, cfg config) ([]*violationError, error) {
+	var names []string
+	found := false
+
+	err := walkGoFiles(fsys, cfg, func(name string, info fs.FileInfo) error {
+		found = true
+		if !cfg.tooLarge(displayPath(fsys, name), info) {
+			names = append(names, name)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errNoGoFiles
+	}
+
+	results := make([]*violationError, len(names))
+	errs := make([]error, len(names))
+	// Each file logs to its own buffer, flushed in walk order below, so
+	// that stderr does not depend on how the files were scheduled.
+	logs := make([]bytes.Buffer, len(names))
+	work := make(chan int)
+	// After the first error the remaining files are skipped rather than
+	// fixed, as they would have been by a serial walk.
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+	for range min(cfg.workers(), len(names)) {
+		wg.Go(func() {
+			for i := range work {
+				if failed.Load() {
+					continue
+				}
+				fileCfg := cfg
+				fileCfg.log = cfg.log.buffered(&logs[i])
+				results[i], errs[i] = collectViolations(checkFile(fsys, names[i], fileCfg))
+				if errs[i] != nil && !skippable(errs[i]) {
+					failed.Store(true)
+				}
+			}
+		})
+	}
+	for i := range names {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	var flagged []*violationError
+	unchecked := 0
+	for i, verr := range results {
+		cfg.log.flush(&logs[i])
+		switch {
+		case errors.Is(errs[i], fs.ErrPermission):
+			cfg.log.errorf("permission denied: %s", displayPath(fsys, names[i]))
+			unchecked++
+		case skippable(errs[i]):
+			cfg.log.errorf("%v", errs[i])
+			unchecked++
+		case errs[i] != nil:
+			return flagged, errs[i]
+		case verr != nil:
+			flagged = append(flagged, verr)
+		}
+	}
+	if unchecked > 0 {
+		return flagged, fmt.Errorf("%d of %d files %w", unchecked, len(names), errUnchecked)
+	}
+
+	return flagged, nil
+}
+
+// errUnchecked reports a walk that went on past files it could not check.
+var errUnchecked = errors.New("could not be checked")
+
+// skippable reports whether a walk goes on past a file that failed with
+// err: one it may not access, or one that is not valid Go.
+func skippable(err error) bool {
+	var perr *parseError
+
+	return errors.Is(err, fs.ErrPermission) || errors.As(err, &perr)
+}
+
+// workers is the number of files checked concurrently: -jobs, or one per
+// CPU when it is unset. -interactive checks files serially.
+func (cfg config) workers() int {
+	if cfg.interactive {
+		return 1 // one prompt at a time
+	}
+	if cfg.jobs > 0 {
+		return cfg.jobs
+	}
+
+	return runtime.GOMAXPROCS(0)
+}
+
+// walkGoFiles calls visit for every .go file in fsys (or every file with
+// one of the -extensions), skipping vendored, test-data, hidden, and
+// underscore-prefixed directories, and whatever the config file excludes.
+func walkGoFiles(fsys fs.FS, cfg config, visit func(name string, info fs.FileInfo) error) error {
+	return fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			base := entry.Name()
+			if name != "." && (cfg.skipDir(base) || cfg.excluded(displayPath(fsys, name))) {
+				return fs.SkipDir
+			}
+
+			return nil
+		}
+
+		if !cfg.isSource(name) || cfg.excluded(displayPath(fsys, name)) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		return visit(name, info)
+	})
+}
+
+// isSource reports whether a directory walk should process the named file.
+// -backup copies are never processed, whatever their suffix.
+func (cfg config) isSource(name string) bool {
+	if cfg.backupSuffix != "" && strings.HasSuffix(name, cfg.backupSuffix) {
+		return false
+	}
+	if len(cfg.extensions) == 0 {
+		return strings.HasSuffix(name, ".go")
+	}
+
+	return slices.ContainsFunc(cfg.extensions, func(ext string) bool { return strings.HasSuffix(name, ext) })
+}
+
+// skipDir reports whether a directory walk leaves out the directory with
+// the given base name. Hidden directories such as .git are walked only with
+// -include-hidden.
+func (cfg config) skipDir(base string) bool {
+	return skippedDirs[base] || !cfg.includeHidden && strings.HasPrefix(base, ".") || strings.HasPrefix(base, "_")
+}
+
+// collectViolations separates a file's violations, which the walk keeps
+// going past, from errors that must abort the run.
+func collectViolations(err error) (*violationError, error) {
+	var verr *violationError
+	if errors.As(err, &verr) {
+		return verr, nil
+	}
+
+	return nil, err
+}
+
+// tooLarge reports whether the file exceeds -max-file-size and should be
+// skipped without being read. Large generated files are the usual culprit.
+func (cfg config) tooLarge(path string, info fs.FileInfo) bool {
+	if cfg.maxFileSize == 0 || info.Size() <= cfg.maxFileSize {
+		return false
+	}
+	cfg.log.skipf(path, "%d bytes exceeds -max-file-size=%d", info.Size(), cfg.maxFileSize)
+
+	return true
+}
+
+// checkImports runs checkFile on a file given by its OS path.
+func checkImports(filePath string, cfg config) error {
+	return checkFile(newOSFS(filepath.Dir(filePath), cfg.outDir), filepath.Base(filePath), cfg)
+}
+
+// checkFile validates a single file and, with -fix on a writable
+// filesystem, rewrites it. It returns a *violationError when the imports
+// were not tidy (whether or not they were fixed), a *parseError when the
+// file is not valid Go, and the underlying error for IO failures.
+func checkFile(fsys fs.FS, name string, cfg config) (err error) {
+	if cfg.log.json {
+		start := time.Now()
+		defer func() { cfg.log.fileDone(displayPath(fsys, name), start, err) }()
+	}
+
+	if cfg.modules != nil {
+		cfg, err = cfg.withModulePrefix(fsys, name)
+		if err != nil {
+			return err
+		}
+	}
+	file, err := loadSourceFile(fsys, name, cfg)
+	if err != nil {
+		return err
+	}
+
+	// Nothing to group: no import declarations at all, or only empty
+	// "import ()" blocks, which are left for gofmt/goimports to deal with,
+	// unless -add-missing has imports to add.
+	if len(file.imports) == 0 && len(file.added) == 0 {
+		return nil
+	}
+	file.warnUnrequired(cfg)
+	file.suggestInternal(cfg)
+	file.warnSpellings(cfg)
+	violations := slices.DeleteFunc(file.validate(cfg), func(v violation) bool { return cfg.disabled[v.kind] })
+	banned := slices.DeleteFunc(file.bannedImports(cfg), func(v violation) bool { return cfg.disabled[v.kind] })
+	if len(violations) == 0 {
+		if len(banned) > 0 {
+			return &violationError{path: file.path, violations: banned}
+		}
+
+		return nil
+	}
+	writable, ok := fsys.(writeFileFS)
+	if !cfg.fix || !ok {
+		verr := &violationError{path: file.path, violations: append(violations, banned...)}
+		if cfg.patchOut != "" || cfg.diff {
+			original := file.source()
+			fixed, err := file.tidy(cfg)
+			if err != nil {
+				return err
+			}
+			if cfg.patchOut != "" {
+				verr.patch = gitDiff(file.path, original, fixed)
+			}
+			if cfg.diff {
+				verr.diff = unifiedDiff(file.path+".orig", file.path, original, fixed)
+			}
+		}
+
+		return verr
+	}
+
+	// Stat only now: clean files, the common case, never need their mode.
+	info, err := fs.Stat(fsys, name)
+	if err != nil {
+		return err
+	}
+	// A read-only file, such as a vendored one on CI, is spotted before any
+	// work goes into a fix that could not be written.
+	if cfg.outDir == "" && info.Mode().Perm()&0o200 == 0 {
+		cfg.log.warnf("permission denied: %s is read-only and will not be fixed", file.path)
+
+		return &violationError{path: file.path, violations: append(violations, banned...)}
+	}
+
+	original := file.source()
+	fixed, err := file.tidy(cfg)
+	if err != nil {
+		return err
+	}
+	if cfg.prompt != nil && !cfg.prompt.confirm(file.path, original, fixed) {
+		return &violationError{path: file.path, violations: append(violations, banned...)}
+	}
+
+	if cfg.backupSuffix != "" {
+		err = writable.WriteFile(name+cfg.backupSuffix, original, info.Mode())
+		if err != nil {
+			return fmt.Errorf("cannot back up %s: %w", file.path, err)
+		}
+	}
+	err = writable.WriteFile(name, fixed, info.Mode())
+	if err != nil {
+		return err
+	}
+	if cfg.verify {
+		err = file.verifyWrite(writable, name, original, info.Mode())
+		if err != nil {
+			return err
+		}
+	}
+
+	verr := &violationError{path: file.path, violations: append(violations, banned...), fixed: true}
+	if cfg.rewriteReport {
+		verr.moves = file.moves(fixed)
+	}
+
+	return verr
+}
+
+// bannedImports reports the imports on the banned list of the config file.
+// No fix removes them; they are kept apart from the layout violations.
+func (f *sourceFile) bannedImports(cfg config) []violation {
+	var violations []violation
+	for _, imp := range f.imports {
+		if cfg.banned(imp.path) {
+			violations = append(violations, violation{kind: violationBanned, line: imp.line, column: imp.column, path: imp.path})
+		}
+	}
+
+	return violations
+}
+
+// verifyWrite is -verify: it reads the file just written back and parses
+// it again, restoring the original content when it no longer parses. tidy
+// has already parsed the new content, so this guards against the write
+// itself going wrong.
+func (f *sourceFile) verifyWrite(fsys writeFileFS, name string, original []byte, perm fs.FileMode) error {
+	written, err := fs.ReadFile(fsys, name)
+	if err == nil {
+		err = f.checkParses(written)
+	}
+	if err == nil {
+		return nil
+	}
+
+	restoreErr := fsys.WriteFile(name, original, perm)
+	if restoreErr != nil {
+		return fmt.Errorf("fixed %s %w, and restoring the original failed: %w", f.path, err, restoreErr)
+	}
+
+	return fmt.Errorf("fixed %s %w (original restored)", f.path, err)
+}
+
+// warnUnrequired warns, with -mode=gomod or -mode=gowork, about imports that
+// look like they belong to a module go.mod doesn't know about: they are not
+// in the standard library, not in the module (or workspace) itself, and not
+// required. Such an import is usually a typo or a missing require, and its
+// grouping is only a guess.
+func (f *sourceFile) warnUnrequired(cfg config) {
+	if cfg.module == nil {
+		return
+	}
+	for _, imp := range f.imports {
+		if imp.group != standardLibrary && !cfg.module.requires(imp.path) {
+			cfg.log.warnf("%s:%d: %q is not provided by %s",
+				f.path, imp.line, imp.path, cfg.module)
+		}
+	}
+}
+
+// suggestInternal warns, with -suggest, about external imports under the
+// same owner as an internal prefix: both paths start with the same host and
+// first path element, as github.com/acme/tools and github.com/acme/api do.
+// Such an import is often internal code the prefix was meant to cover.
+func (f *sourceFile) suggestInternal(cfg config) {
+	if !cfg.suggest {
+		return
+	}
+	for _, imp := range f.imports {
+		if imp.group != externalLibrary {
+			continue
+		}
+		for _, prefix := range cfg.internalPrefixes {
+			if owner, ok := ownerPrefix(prefix); ok && hasPathPrefix(imp.path, owner) {
+				cfg.log.warnf("%s:%d: %q is grouped as external but shares %s/ with -internal-prefix %s; check your prefix",
+					f.path, imp.line, imp.path, owner, prefix)
+
+				break
+			}
+		}
+	}
+}
+
+// warnSpellings warns about internal packages imported under another
+// spelling, which Go sees as a different package: a path that matches an
+// internal prefix only when case is ignored, or, with -mode=gomod or
+// -mode=gowork, one imported both under a replaced module path and under
+// the path of its replacement.
+func (f *sourceFile) warnSpellings(cfg config) {
+	imported := make(map[string]importInfo, len(f.imports))
+	for _, imp := range f.imports {
+		if _, ok := imported[imp.path]; !ok {
+			imported[imp.path] = imp
+		}
+	}
+	for _, imp := range f.imports {
+		if !slices.ContainsFunc(cfg.internalPrefixes, func(p string) bool { return hasPathPrefix(imp.path, p) }) {
+			for _, p := range cfg.internalPrefixes {
+				if n := len(p); n > 0 && len(imp.path) >= n && strings.EqualFold(imp.path[:n], p) && hasPathPrefix(imp.path, imp.path[:n]) {
+					cfg.log.warnf("%s:%d: %q is spelled differently from -internal-prefix %s; did you mean %q?",
+						f.path, imp.line, imp.path, p, p+imp.path[n:])
+
+					break
+				}
+			}
+		}
+		if cfg.module == nil {
+			continue
+		}
+		for _, from := range slices.Sorted(maps.Keys(cfg.module.replaced)) {
+			if !hasPathPrefix(imp.path, from) {
+				continue
+			}
+			to := cfg.module.replaced[from]
+			if other, ok := imported[to+imp.path[len(from):]]; ok {
+				cfg.log.warnf("%s:%d: %q and %q (line %d) spell the same package, as %s replaces %s with %s",
+					f.path, imp.line, imp.path, other.path, other.line, cfg.module.path, from, to)
+			}
+		}
+	}
+}
+
+// ownerPrefix returns the first two elements of an import path prefix, such
+// as github.com/acme of github.com/acme/api. It reports false when prefix
+// has no more than two elements, as nothing outside it can then share them.
+func ownerPrefix(prefix string) (string, bool) {
+	elems := strings.SplitN(strings.Trim(prefix, "/"), "/", 3)
+	if len(elems) < 3 {
+		return "", false
+	}
+
+	return elems[0] + "/" + elems[1], true
+}
+
+// parseError reports a file that could not be parsed as Go source.
+type parseError struct {
+	path string
+	err  error
+	// goVersion is the release the //go:build line of the file asks for,
+	// when it is newer than the parser: the syntax may just be too new.
+	goVersion string
+}
+
+func (e *parseError) Error() string {
+	if e.goVersion != "" {
+		return fmt.Sprintf("cannot parse %s: %v (its //go:build line requires %s, newer than the %s import-tidy was built with)",
+			e.path, e.err, e.goVersion, runtime.Version())
+	}
+
+	return "cannot parse " + e.path + ": " + e.err.Error()
+}
+
+func (e *parseError) Unwrap() error {
+	return e.err
+}
+
+// newerGoVersion returns the Go release the //go:build line of content
+// requires, if it is newer than the one this binary was built with: go/parser
+// knows the syntax of that release and the ones before it. The package clause
+// and the comments above it are all that has to parse.
+func newerGoVersion(content []byte) string {
+	header, err := parser.ParseFile(token.NewFileSet(), "", content, parser.PackageClauseOnly|parser.ParseComments)
+	if err != nil || header.GoVersion == "" {
+		return ""
+	}
+	built := runtime.Version()
+	if !version.IsValid(built) || version.Compare(header.GoVersion, built) <= 0 {
+		return ""
+	}
+
+	return header.GoVersion
+}
+
+// violationError reports a file whose imports are not tidy. fixed is set
+// when the file has already been rewritten.
+type violationError struct {
+	path       string
+	violations []violation
+	fixed      bool
+	patch      []byte // -patch-out: the fix as a unified diff
+	diff       []byte // -d: the same, as gofmt -d prints it
+	moves      []importMove
+}
+
+// has reports whether the file has a violation of the given kind.
+func (e *violationError) has(kind violationKind) bool {
+	return slices.ContainsFunc(e.violations, func(v violation) bool { return v.kind == kind })
+}
+
+func (e *violationError) Error() string {
+	return fmt.Sprintf("%s: %d import violation(s)", e.path, len(e.violations))
+}
+
+type violationKind string
+
+const (
+	violationMultipleDecls    violationKind = "multiple-decls"
+	violationWrongOrder       violationKind = "wrong-order"
+	violationMissingBlank     violationKind = "missing-blank"
+	violationExtraBlank       violationKind = "extra-blank"
+	violationSortOrder        violationKind = "sort-order"
+	violationSharedLine       violationKind = "shared-line"
+	violationDuplicate        violationKind = "duplicate"
+	violationLongLine         violationKind = "long-line"
+	violationBlankAfterParen  violationKind = "blank-after-paren"
+	violationBlankBeforeParen violationKind = "blank-before-paren"
+	violationBlankAfterDecl   violationKind = "blank-after-decl"
+	violationAlias            violationKind = "alias"
+	violationLayout           violationKind = "layout"
+	violationBanned           violationKind = "banned"
+	violationUnused           violationKind = "unused"
+	violationMissing          violationKind = "missing"
+)
+
+type violation struct {
+	kind   violationKind
+	line   int
+	column int
+	path   string
+	alias  string // the alias the config wants, for violationAlias
+}
+
+func (v violation) String() string {
+	switch v.kind {
+	case violationMultipleDecls:
+		return "imports are split across multiple declarations"
+	case violationWrongOrder:
+		return fmt.Sprintf("%q is in the wrong group order", v.path)
+	case violationMissingBlank:
+		return fmt.Sprintf("missing blank line before %q", v.path)
+	case violationExtraBlank:
+		return fmt.Sprintf("unexpected blank line before %q", v.path)
+	case violationSortOrder:
+		return fmt.Sprintf("%q is not sorted alphabetically", v.path)
+	case violationSharedLine:
+		return fmt.Sprintf("%q shares a line with the previous import", v.path)
+	case violationDuplicate:
+		return fmt.Sprintf("%q is imported more than once under the same name", v.path)
+	case violationLongLine:
+		return fmt.Sprintf("trailing comment on %q makes the line too long", v.path)
+	case violationBlankAfterParen:
+		return `unexpected blank line after "import ("`
+	case violationBlankBeforeParen:
+		return `unexpected blank line before the closing ")"`
+	case violationBlankAfterDecl:
+		return "the import declaration must be followed by exactly one blank line"
+	case violationAlias:
+		if v.alias == "" {
+			return fmt.Sprintf("%q should be imported without an alias", v.path)
+		}
+
+		return fmt.Sprintf("%q should be imported as %s", v.path, v.alias)
+	case violationLayout:
+		return "import declaration is not laid out the way -fix writes it"
+	case violationBanned:
+		return fmt.Sprintf("%q is banned by the configuration", v.path)
+	case violationUnused:
+		return fmt.Sprintf("%q is imported but not used", v.path)
+	case violationMissing:
+		return fmt.Sprintf("%q is used but not imported", v.path)
+	}
+
+	return string(v.kind)
+}
+
+type sourceFile struct {
+	path    string
+	content []byte
+	// lenientSource is the real content of a file loaded by -lenient-parse;
+	// content then holds the stand-in from maskImportBlock.
+	lenientSource []byte
+	// importsOnly is set by -assume-gofmt: the file is parsed, and the
+	// rewrite verified, only up to the end of the imports.
+	importsOnly bool
+	fset        *token.FileSet
+	decls       []*ast.GenDecl
+	imports     []importInfo
+	nosort      bool
+	// closing holds the free-floating comment groups after the last spec
+	// of a declaration, and rparenComment the first comment following a
+	// ")" (any others join closing). The rewrite keeps them at the end of
+	// the block.
+	closing       [][]string
+	rparenComment string
+	// lparenComment is the comment following the "(" of the first
+	// declaration on the same line, typically a //nolint meant for the whole
+	// block, which the rewrite keeps there. Those of later declarations
+	// join closing.
+	lparenComment string
+	// added holds the imports -add-missing found missing, which the
+	// rewrite adds; packageLine is the line of the package clause, below
+	// which they go when the file has no import declaration yet.
+	added       []importInfo
+	packageLine int
+	// carried holds the comments past the end of a declaration that the
+	// rendered block takes along: the first one after a ")", and that of a
+	// lone import spec. splice cuts them from any line they share with
+	// other code.
+	carried  []*ast.Comment
+	renames  []aliasRename
+	pkgRefs  map[string][]int // package name -> byte offsets of references
+	declared map[string]bool  // names declared in the file, which no import may be renamed to
+}
+
+// nosortDirective, placed anywhere inside an import block, keeps the
+// imports of each group in their source order, e.g. when blank imports must
+// run their init functions in sequence. Grouping still applies.
+const nosortDirective = "//import-tidy:nosort"
+
+func (f *sourceFile) compare(cfg config) func(a, b importInfo) int {
+	if f.nosort || cfg.disabled[violationSortOrder] {
+		return keepSourceOrder
+	}
+	compare := compareImports
+	if comparator, ok := sortComparators[cfg.sort]; ok {
+		compare = comparator(cfg)
+	}
+	if cfg.internalSort == internalSortDepth {
+		compare = internalByDepth(compare)
+	}
+
+	return compare
+}
+
+func hasNosortDoc(imp importInfo) bool {
+	return slices.Contains(imp.doc, nosortDirective)
+}
+
+type importInfo struct {
+	path      string
+	literal   string
+	group     importGroup
+	name      string
+	doc       []string
+	comment   string
+	subgroup  int
+	line      int
+	column    int
+	startLine int
+	endLine   int
+	// floating holds the free-floating comment groups between the previous
+	// spec and this one's doc, which a blank line separates from it. They
+	// move with the spec when it is sorted.
+	floating [][]string
+	// unused is set by -remove-unused for an import the file never refers
+	// to; the rewrite drops it.
+	unused bool
+}
+
+func loadSourceFile(fsys fs.FS, name string, cfg config) (*sourceFile, error) {
+	content, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	path := displayPath(fsys, name)
+
+	// Object resolution is only needed to tell package references from
+	// shadowing locals when aliases are being normalized or unused imports
+	// removed. Otherwise, with -assume-gofmt, nothing past the imports is
+	// needed at all.
+	mode := parser.ParseComments | parser.SkipObjectResolution
+	importsOnly := cfg.assumeGofmt && !cfg.needsPackageRefs()
+	switch {
+	case cfg.needsPackageRefs():
+		mode = parser.ParseComments
+	case importsOnly:
+		mode |= parser.ImportsOnly
+	}
+	fset := token.NewFileSet()
+	astFile, err := parser.ParseFile(fset, path, content, mode)
+	var lenientSource []byte
+	if err != nil && cfg.lenientParse {
+		if masked, ok := maskImportBlock(content); ok {
+			maskedFile, maskedErr := parser.ParseFile(fset, path, masked, mode)
+			if maskedErr == nil {
+				astFile, err = maskedFile, nil
+				lenientSource, content = content, masked
+			}
+		}
+	}
+	if err != nil {
+		return nil, &parseError{path: path, err: err, goVersion: newerGoVersion(content)}
+	}
+
+	file := &sourceFile{
+		path:          path,
+		content:       content,
+		lenientSource: lenientSource,
+		importsOnly:   importsOnly,
+		fset:          fset,
+		packageLine:   fset.Position(astFile.Name.End()).Line,
+	}
+	// A blank line between two specs of the same group inside one
+	// declaration starts a new subgroup; -preserve-subgroups keeps those.
+	subgroups := make(map[importGroup]int)
+	for _, decl := range astFile.Decls {
+		genDecl, ok := decl.(*ast.GenDecl)
+		if !ok || genDecl.Tok != token.IMPORT {
+			continue
+		}
+		file.decls = append(file.decls, genDecl)
+		file.nosort = file.nosort || hasDirective(astFile, genDecl, nosortDirective)
+		firstInDecl := len(file.imports)
+		lparen := lparenComment(astFile, fset, genDecl)
+		if lparen != nil {
+			if file.lparenComment == "" {
+				file.lparenComment = lparen.List[0].Text
+			} else {
+				file.closing = append(file.closing, commentLines(lparen))
+			}
+		}
+		floating := floatingComments(astFile, genDecl, lparen)
+		for _, spec := range genDecl.Specs {
+			importSpec, ok := spec.(*ast.ImportSpec)
+			if !ok {
+				continue
+			}
+			imp, err := newImportInfo(fset, importSpec, cfg)
+			if err != nil {
+				return nil, &parseError{path: path, err: err}
+			}
+			// The doc comment of a declaration merged into the first one
+			// moves with its import: as the doc of a lone spec, or ahead of
+			// the first spec of a block.
+			if doc := genDecl.Doc; doc != nil && len(file.decls) > 1 && len(file.imports) == firstInDecl {
+				if !genDecl.Lparen.IsValid() {
+					imp.doc = append(commentLines(doc), imp.doc...)
+				} else {
+					imp.floating = append([][]string{commentLines(doc)}, imp.floating...)
+				}
+				imp.startLine = fset.Position(doc.Pos()).Line
+			}
+			for len(floating) > 0 && floating[0].End() < importSpec.Pos() {
+				if len(imp.floating) == 0 {
+					imp.startLine = fset.Position(floating[0].Pos()).Line
+				}
+				imp.floating = append(imp.floating, commentLines(floating[0]))
+				floating = floating[1:]
+			}
+			if len(file.imports) > firstInDecl {
+				prev := file.imports[len(file.imports)-1]
+				if prev.group == imp.group && imp.startLine-prev.endLine > 1 {
+					subgroups[imp.group]++
+				}
+			}
+			imp.subgroup = subgroups[imp.group]
+			if !genDecl.Lparen.IsValid() {
+				// The parser only takes a comment ending the line as the
+				// spec's; one followed by code, as in
+				// import "os" /* c */ ; var x = 1, goes with it all the same.
+				comment := trailingComment(astFile, fset, content, importSpec.End())
+				if importSpec.Comment != nil {
+					comment = importSpec.Comment.List[0]
+				} else if comment != nil {
+					imp.comment = comment.Text
+				}
+				if comment != nil {
+					file.carried = append(file.carried, comment)
+				}
+			}
+			file.imports = append(file.imports, imp)
+		}
+		for _, group := range floating {
+			file.closing = append(file.closing, commentLines(group))
+		}
+		if comment := rparenComment(astFile, fset, content, genDecl); comment != nil {
+			if file.rparenComment == "" {
+				file.rparenComment = comment.Text
+			} else {
+				file.closing = append(file.closing, []string{comment.Text})
+			}
+			file.carried = append(file.carried, comment)
+		}
+	}
+	if cfg.needsPackageRefs() {
+		file.collectPackageRefs(astFile)
+		file.markUnused(cfg)
+		file.findMissing(cfg, fsys, name, astFile)
+		file.planAliases(cfg)
+	}
+
+	return file, nil
+}
+
+// floatingComments returns the comment groups inside the parentheses of
+// decl that are neither the doc nor the trailing comment of a spec, in
+// source order. Groups holding nosortDirective are left out, as is lparen,
+// the comment after the "(": both apply to the whole block and are rendered
+// at its top.
+func floatingComments(astFile *ast.File, decl *ast.GenDecl, lparen *ast.CommentGroup) []*ast.CommentGroup {
+	if !decl.Lparen.IsValid() {
+		return nil
+	}
+	attached := map[*ast.CommentGroup]bool{lparen: true}
+	for _, spec := range decl.Specs {
+		if importSpec, ok := spec.(*ast.ImportSpec); ok {
+			attached[importSpec.Doc] = true
+			attached[importSpec.Comment] = true
+		}
+	}
+
+	var floating []*ast.CommentGroup
+	for _, group := range astFile.Comments {
+		if group.Pos() < decl.Lparen || group.End() > decl.Rparen || attached[group] {
+			continue
+		}
+		if slices.ContainsFunc(group.List, func(c *ast.Comment) bool { return strings.TrimSpace(c.Text) == nosortDirective }) {
+			continue
+		}
+		floating = append(floating, group)
+	}
+
+	return floating
+}
+
+// lparenComment returns the comment group that follows the "(" of decl on
+// the same line, if any.
+func lparenComment(astFile *ast.File, fset *token.FileSet, decl *ast.GenDecl) *ast.CommentGroup {
+	if !decl.Lparen.IsValid() {
+		return nil
+	}
+	line := fset.Position(decl.Lparen).Line
+	for _, group := range astFile.Comments {
+		if group.Pos() > decl.Lparen && group.End() < decl.Rparen && fset.Position(group.Pos()).Line == line {
+			return group
+		}
+	}
+
+	return nil
+}
+
+// rparenComment returns the comment that follows the ")" of decl on the
+// same line, if any.
+func rparenComment(astFile *ast.File, fset *token.FileSet, src []byte, decl *ast.GenDecl) *ast.Comment {
+	if !decl.Rparen.IsValid() {
+		return nil
+	}
+
+	return trailingComment(astFile, fset, src, decl.Rparen+1)
+}
+
+// trailingComment returns the comment that follows end on the same line,
+// if any. Only the first comment counts: the lines below it are outside
+// the declaration and stay where they are. So does a comment after code
+// sharing the line, as in ") ; var x = 1 // x", which belongs to that code.
+func trailingComment(astFile *ast.File, fset *token.FileSet, src []byte, end token.Pos) *ast.Comment {
+	line := fset.Position(end).Line
+	for _, group := range astFile.Comments {
+		if group.Pos() >= end && fset.Position(group.Pos()).Line == line {
+			between := src[fset.Position(end).Offset:fset.Position(group.Pos()).Offset]
+			if len(bytes.Trim(between, " \t;")) > 0 {
+				return nil
+			}
+
+			return group.List[0]
+		}
+	}
+
+	return nil
+}
+
+func commentLines(group *ast.CommentGroup) []string {
+	lines := make([]string, 0, len(group.List))
+	for _, comment := range group.List {
+		lines = append(lines, comment.Text)
+	}
+
+	return lines
+}
+
+// hasDirective reports whether a comment inside decl consists of directive.
+func hasDirective(astFile *ast.File, decl *ast.GenDecl, directive string) bool {
+	for _, group := range astFile.Comments {
+		if group.Pos() < decl.Pos() || group.End() > decl.End() {
+			continue
+		}
+		for _, comment := range group.List {
+			if strings.TrimSpace(comment.Text) == directive {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func newImportInfo(fset *token.FileSet, spec *ast.ImportSpec, cfg config) (importInfo, error) {
+	// The path is unquoted for classification and sorting. The literal is
+	// rendered as written, but formatting the block spells it canonically,
+	// as gofmt does: an escape or a raw string becomes a plain quoted path
+	// naming the same package. go/parser already rejects malformed paths,
+	// so this only guards against guessing at one.
+	importPath, err := strconv.Unquote(spec.Path.Value)
+	if err != nil {
+		return importInfo{}, fmt.Errorf("%s: invalid import path literal %s", fset.Position(spec.Path.Pos()), spec.Path.Value)
+	}
+	// It does accept any string, though, and an empty one would otherwise
+	// be classified as standard library and sorted to the top.
+	if reason := invalidImportPath(importPath); reason != "" {
+		return importInfo{}, fmt.Errorf("%s: invalid import path %s: %s", fset.Position(spec.Path.Pos()), spec.Path.Value, reason)
+	}
+
+	info := importInfo{
+		path:      importPath,
+		literal:   spec.Path.Value,
+		group:     determineImportGroup(importPath, cfg),
+		line:      fset.Position(spec.Pos()).Line,
+		column:    fset.Position(spec.Pos()).Column,
+		startLine: fset.Position(spec.Pos()).Line,
+		endLine:   fset.Position(spec.End()).Line,
+	}
+	if spec.Name != nil {
+		info.name = spec.Name.Name
+	}
+	if spec.Doc != nil {
+		for _, comment := range spec.Doc.List {
+			info.doc = append(info.doc, comment.Text)
+		}
+		info.startLine = fset.Position(spec.Doc.Pos()).Line
+	}
+	if spec.Comment != nil && len(spec.Comment.List) > 0 {
+		info.comment = spec.Comment.List[0].Text
+		info.endLine = fset.Position(spec.Comment.End()).Line
+	}
+
+	return info, nil
+}
+
+// invalidImportPath returns why importPath obviously cannot name a package,
+// or "" if it might. Only an empty path and control characters or invalid
+// UTF-8 count; paths that are merely unusual, such as one with a space, are
+// left for the compiler to judge.
+func invalidImportPath(importPath string) string {
+	if importPath == "" {
+		return "empty path"
+	}
+	if !utf8.ValidString(importPath) {
+		return "invalid UTF-8"
+	}
+	for _, r := range importPath {
+		if !unicode.IsPrint(r) && r != ' ' {
+			return fmt.Sprintf("character %q not allowed", r)
+		}
+	}
+
+	return ""
+}
+
+// determineImportGroup classifies an import path. An exact-path override
+// from the config file decides first, then its classify rules, in order,
+// then its importGroups, if any, whose custom group names are numbered by
+// the package-level customGroupNames registry. Otherwise, when both an
+// internal and the shared prefix match, the longer (more specific) one
+// wins. Anything else is external, unless it is in the standard library:
+// on the -std-list package list, or without one, without a dot in its
+// first path element.
+func determineImportGroup(importPath string, cfg config) importGroup {
+	if group, ok := cfg.groupOverrides[importPath]; ok {
+		return group
+	}
+	for _, c := range cfg.classifiers {
+		if c.match(importPath) {
+			return c.group
+		}
+	}
+	// The importGroups of the config file end in a catch-all, so the
+	// prefixes never get a say when it defines any.
+	for _, c := range cfg.customGroups {
+		if c.match(importPath) {
+			return c.group
+		}
+	}
+
+	internalPrefix := ""
+	for _, prefix := range cfg.internalPrefixes {
+		if hasPathPrefix(importPath, prefix) && len(prefix) > len(internalPrefix) {
+			internalPrefix = prefix
+		}
+	}
+	internal := internalPrefix != ""
+	shared := hasPathPrefix(importPath, cfg.sharedPrefix)
+	switch {
+	case internal && shared:
+		if len(cfg.sharedPrefix) > len(internalPrefix) {
+			return sharedLibrary
+		}
+
+		return internalLibrary
+	case internal:
+		return internalLibrary
+	case shared:
+		return sharedLibrary
+	}
+
+	if isStandard(importPath, cfg.stdPackages) {
+		return standardLibrary
+	}
+
+	return externalLibrary
+}
+
+// isStandard reports whether importPath is in the standard library: on the
+// -std-list package list stdPackages, or without one, without a dot in its
+// first path element.
+func isStandard(importPath string, stdPackages map[string]bool) bool {
+	if stdPackages != nil {
+		return stdPackages[importPath]
+	}
+	firstSegment, _, _ := strings.Cut(importPath, "/")
+
+	return !strings.Contains(firstSegment, ".")
+}
+
+// hasPathPrefix reports whether importPath is prefix itself or lies below
+// it, matching whole path segments only.
+func hasPathPrefix(importPath, prefix string) bool {
+	if prefix == "" {
+		return false
+	}
+
+	return importPath == prefix || strings.HasPrefix(importPath, prefix+"/")
+}
+
+func (f *sourceFile) validate(cfg config) []violation {
+	var missing []violation
+	for _, imp := range f.added {
+		missing = append(missing, violation{kind: violationMissing, line: imp.line, column: imp.column, path: imp.path})
+	}
+	if len(f.decls) == 0 {
+		return missing
+	}
+	if len(f.decls) > 1 {
+		violations := make([]violation, 0, len(f.decls)-1)
+		for _, decl := range f.decls[1:] {
+			violations = append(violations, violation{
+				kind:   violationMultipleDecls,
+				line:   f.fset.Position(decl.Pos()).Line,
+				column: f.fset.Position(decl.Pos()).Column,
+			})
+		}
+		for _, imp := range f.imports {
+			if imp.unused {
+				violations = append(violations, violation{kind: violationUnused, line: imp.line, column: imp.column, path: imp.path})
+			}
+		}
+
+		return append(violations, missing...)
+	}
+
+	position := make(map[importGroup]int, len(cfg.groupOrder))
+	for i, block := range cfg.importBlocks() {
+		for _, group := range block {
+			position[group] = i
+		}
+	}
+
+	violations := missing
+	report := func(kind violationKind, imp importInfo) {
+		violations = append(violations, violation{kind: kind, line: imp.line, column: imp.column, path: imp.path})
+	}
+	seen := make(map[importKey]bool, len(f.imports))
+	for _, imp := range f.imports {
+		if seen[imp.key()] {
+			report(violationDuplicate, imp)
+		}
+		seen[imp.key()] = true
+		if commentTooLong(imp, f.single(f.imports, cfg), cfg) {
+			report(violationLongLine, imp)
+		}
+	}
+	for _, imp := range f.imports {
+		if imp.unused {
+			report(violationUnused, imp)
+		}
+	}
+	for _, r := range f.renames {
+		imp := f.imports[r.index]
+		violations = append(violations, violation{kind: violationAlias, line: imp.line, column: imp.column, path: imp.path, alias: r.to})
+	}
+
+	if decl := f.decls[0]; decl.Lparen.IsValid() {
+		lparen, rparen := f.fset.Position(decl.Lparen).Line, f.fset.Position(decl.Rparen).Line
+		if lparen+1 < rparen && f.blankLine(lparen+1) {
+			violations = append(violations, violation{kind: violationBlankAfterParen, line: lparen + 1, column: 1})
+		}
+		if rparen-1 > lparen+1 && f.blankLine(rparen-1) {
+			violations = append(violations, violation{kind: violationBlankBeforeParen, line: rparen - 1, column: 1})
+		}
+	}
+	if line, ok := f.blankAfterDecl(); !ok {
+		violations = append(violations, violation{kind: violationBlankAfterDecl, line: line, column: 1})
+	}
+
+	keepBlanks := cfg.blankImports != blankImportsSort
+	for i := 1; i < len(f.imports); i++ {
+		prev, curr := f.imports[i-1], f.imports[i]
+		sameGroup := prev.group == curr.group
+		sameBlock := position[prev.group] == position[curr.group]
+		blankBetween := curr.startLine-prev.endLine > 1
+		section := cfg.subsection(curr.group)
+		split := sameGroup && section != nil && section(prev) != section(curr)
+
+		switch {
+		case curr.startLine <= prev.endLine:
+			report(violationSharedLine, curr) // e.g. import ("fmt"; "os")
+		case position[curr.group] < position[prev.group]:
+			report(violationWrongOrder, curr)
+		case (!sameBlock || split) && !blankBetween:
+			report(violationMissingBlank, curr)
+		case sameBlock && blankBetween && !split && !cfg.keepsBlankLines(curr.group):
+			report(violationExtraBlank, curr)
+		}
+		switch {
+		case split:
+			if section(prev) > section(curr) {
+				report(violationSortOrder, curr)
+			}
+		case keepBlanks && (prev.name == "_" || curr.name == "_"):
+			// Checked below.
+		case sameBlock && (!sameGroup || prev.subgroup == curr.subgroup) && f.compare(cfg)(prev, curr) > 0:
+			report(violationSortOrder, curr)
+		}
+	}
+	// Under -blank-imports=keep, blank imports take the places sorting
+	// gives them in source order, which comparing neighbors cannot check:
+	// compare with the order the rewrite writes instead.
+	if keepBlanks && len(violations) == 0 {
+		source := dedupeImports(f.usedImports())
+		written := slices.Concat(importSections(source, cfg, f.compare(cfg))...)
+		for i, imp := range source {
+			if imp.name == "_" && written[i].key() != imp.key() {
+				report(violationSortOrder, imp)
+			}
+		}
+	}
+
+	// Whatever the rules above don't cover, such as indentation, comment
+	// alignment, or the spacing around the declaration, is checked against
+	// the rewrite itself, so that a clean check means -fix changes nothing.
+	// Most clean files pass the cheap comparison of laidOut first.
+	if len(violations) == 0 && !f.laidOut(cfg) {
+		spliced, err := f.splice(cfg)
+		if err != nil || !bytes.Equal(spliced, f.source()) {
+			pos := f.fset.Position(f.decls[0].Pos())
+			violations = append(violations, violation{kind: violationLayout, line: pos.Line, column: pos.Column})
+		}
+	}
+
+	return violations
+}
+
+// laidOut reports whether splicing would leave the file as it is, judging
+// by the bytes of the import declaration and the lines around it alone: a
+// single declaration without comments, written exactly as rendered, with
+// one blank line before and after it. Without comments, the rendering is
+// what formatting it gives. False only means the whole file has to be
+// spliced to tell.
+func (f *sourceFile) laidOut(cfg config) bool {
+	if len(f.decls) != 1 || len(f.carried) > 0 || len(f.added) > 0 || len(f.renames) > 0 ||
+		f.lenientSource != nil || len(f.usedImports()) == 0 {
+		return false
+	}
+	block := f.renderImportDecl(cfg)
+	if strings.Contains(block, "//") || strings.Contains(block, "/*") {
+		return false
+	}
+
+	decl := f.decls[0]
+	tf := f.fset.File(decl.Pos())
+	start, end := tf.Offset(decl.Pos()), tf.Offset(decl.End())
+	line, endLine := tf.Line(decl.Pos()), tf.Line(decl.End())
+	if tf.LineStart(line) != decl.Pos() || end < len(f.content) && f.content[end] != '\n' ||
+		string(f.content[start:end]) != block || bytes.Contains(f.content, []byte("\r\n")) {
+		return false
+	}
+	if f.blankLine(1) || decl.Doc == nil && (line < 3 || !f.blankLine(line-1) || f.blankLine(line-2)) {
+		return false
+	}
+
+	return f.blankLine(endLine+1) && endLine+2 <= tf.LineCount() && !f.blankLine(endLine+2)
+}
+
+// source is the content of the file as it is on disk.
+func (f *sourceFile) source() []byte {
+	if f.lenientSource != nil {
+		return f.lenientSource
+	}
+
+	return f.content
+}
+
+// blankAfterDecl reports whether the import declaration is followed by
+// exactly one blank line before the code after it, as gofmt has it, and
+// otherwise the first line that should be that blank line. Nothing but
+// blank lines after the declaration is fine.
+func (f *sourceFile) blankAfterDecl() (int, bool) {
+	tf := f.fset.File(f.decls[0].Pos())
+	end := f.fset.Position(f.decls[0].End()).Line
+	for _, comment := range f.carried {
+		if f.fset.Position(comment.Pos()).Line == end {
+			end = max(end, f.fset.Position(comment.End()).Line)
+		}
+	}
+	next := end + 1
+	for next <= tf.LineCount() && f.blankLine(next) {
+		next++
+	}
+
+	return end + 1, next > tf.LineCount() || next == end+2
+}
+
+// blankLine reports whether the given line of the file holds nothing but
+// white space. It looks the line up in the file set rather than splitting
+// the content, which matters for the clean files most runs consist of.
+func (f *sourceFile) blankLine(line int) bool {
+	tf := f.fset.File(f.decls[0].Pos())
+	if line < 1 || line > tf.LineCount() {
+		return false
+	}
+	end := len(f.content)
+	if line < tf.LineCount() {
+		end = tf.Offset(tf.LineStart(line + 1))
+	}
+
+	return len(bytes.TrimSpace(f.content[tf.Offset(tf.LineStart(line)):end])) == 0
+}
+
+func (f *sourceFile) tidy(cfg config) ([]byte, error) {
+	tidied, err := f.splice(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Splicing the block in can still break the file, e.g. a template
+	// whose lines around the block are not Go, so the result is parsed
+	// again before anything is written.
+	err = f.checkParses(tidied)
+	if err != nil {
+		return nil, fmt.Errorf("reorganized %s %w (file left unchanged)", f.path, err)
+	}
+
+	return tidied, nil
+}
+
+// splice returns the file with its import declarations replaced by the
+// rendered block, unverified.
+func (f *sourceFile) splice(cfg config) ([]byte, error) {
+	f.applyAliases()
+	// Imports added to a file without any go right below the package
+	// clause.
+	insertLine := f.packageLine + 1
+	if len(f.decls) > 0 {
+		insertLine = f.fset.Position(f.decls[0].Pos()).Line
+	}
+	// With every import unused, the declarations go away with nothing in
+	// their place, doc comment and all.
+	empty := len(f.usedImports()) == 0
+
+	removed := make(map[int]bool)
+	cuts := make(map[int][][2]int)
+	for i, decl := range f.decls {
+		start, end := f.fset.Position(decl.Pos()), f.fset.Position(decl.End())
+		if (i > 0 || empty) && decl.Doc != nil {
+			start = f.fset.Position(decl.Doc.Pos())
+		}
+		for line := start.Line; line <= end.Line; line++ {
+			removed[line] = true
+		}
+		cut(cuts, start, end)
+	}
+	for _, comment := range f.carried {
+		start, end := f.fset.Position(comment.Pos()), f.fset.Position(comment.End())
+		for line := start.Line; line <= end.Line; line++ {
+			removed[line] = true
+		}
+		cut(cuts, start, end)
+	}
+
+	var block string
+	if !empty {
+		var err error
+		block, err = formatImportDecl(f.renderImportDecl(cfg))
+		if err != nil {
+			return nil, fmt.Errorf("reorganized %s does not format cleanly (file left unchanged): %w", f.path, err)
+		}
+	}
+
+	// Blank lines at the top of the file are dropped, and the new block is
+	// separated by exactly one blank line from the package clause (or
+	// whatever precedes the imports) and from whatever follows, whatever
+	// the original spacing was. A doc comment directly above the block
+	// stays attached to it; decl.Pos() is the import keyword, so those
+	// lines are kept in place, not removed. Every other line is copied
+	// byte for byte, except for a blank line doubled by removing a merged
+	// declaration. A file with CRLF line endings keeps them. Code or
+	// comments sharing a line with a declaration, as in
+	// "package p; import "os"" or ") ; var x = 1", are not part of it and
+	// are kept on lines of their own: before the block if they precede the
+	// first declaration, in place otherwise. A template (-lenient-parse)
+	// keeps whatever lines precede the block as they are: they are not Go.
+	lenient := f.lenientSource != nil
+	var out []string
+	afterBlock, droppedDecl := false, false
+	source := f.source()
+	blankLine := ""
+	if bytes.Contains(source, []byte("\r\n")) {
+		blankLine = "\r"
+		block = strings.ReplaceAll(block, "\n", "\r\n") + "\r"
+	}
+	for i, line := range strings.Split(string(source), "\n") {
+		lineNo := i + 1
+		blank := strings.TrimSpace(line) == ""
+		var before, rest string
+		if len(cuts[lineNo]) > 0 {
+			before, rest = leftovers(line, cuts[lineNo], blankLine)
+			if lineNo != insertLine && before != "" {
+				if rest != "" {
+					before = strings.TrimSuffix(before, blankLine) + " " + rest
+				}
+				before, rest = "", before
+			}
+		}
+		if lineNo == insertLine && empty {
+			if before != "" {
+				out = append(out, before)
+			}
+		} else if lineNo == insertLine {
+			if before != "" {
+				out = append(out, before)
+			}
+			if !lenient && (len(f.decls) == 0 || f.decls[0].Doc == nil) {
+				out = trimTrailingBlankLines(out)
+				if len(out) > 0 {
+					out = append(out, blankLine)
+				}
+			}
+			out = append(out, block)
+			afterBlock = true
+		}
+		if removed[lineNo] {
+			if rest == "" {
+				droppedDecl = true
+
+				continue
+			}
+			line, blank = rest, false
+		}
+		if (len(out) == 0 && blank && !lenient) || (afterBlock && blank) || (droppedDecl && blank && out[len(out)-1] == blankLine) {
 			continue
 		}
-		paths = append(paths, arg)
-	}
-
-	if *internalPrefix == "" {
-		return config{}, nil, errors.New("-internal-prefix is required")
-	}
-	if len(paths) == 0 {
-		return config{}, nil, errors.New("path to a file or directory is required")
+		droppedDecl = false
+		if afterBlock {
+			out = append(out, blankLine)
+			afterBlock = false
+		}
+		out = append(out, line)
 	}
 
-	groupOrder, err := parseImportOrder(*importOrder)
-	if err != nil {
-		return config{}, nil, fmt.Errorf("invalid -import-order: %w", err)
+	spliced := []byte(strings.Join(out, "\n"))
+	if bytes.HasSuffix(source, []byte("\n")) && !bytes.HasSuffix(spliced, []byte("\n")) {
+		spliced = append(spliced, '\n')
 	}
 
-	return config{
-		internalPrefix: *internalPrefix,
-		groupOrder:     groupOrder,
-		fix:            *fix,
-	}, paths, nil
+	return spliced, nil
 }
 
-func parseImportOrder(spec string) ([]importGroup, error) {
-	var order []importGroup
-	seen := make(map[importGroup]bool, len(groupNames))
-
-	for part := range strings.SplitSeq(spec, ",") {
-		name := strings.TrimSpace(part)
-		if name == "" {
-			continue
+// checkParses reports, as the end of a sentence about the file, why content
+// no longer parses. A template is not Go, so only its import block is
+// located and parsed.
+func (f *sourceFile) checkParses(content []byte) error {
+	if f.lenientSource == nil {
+		mode := parser.SkipObjectResolution
+		if f.importsOnly {
+			mode |= parser.ImportsOnly
 		}
-		group, ok := groupNames[name]
-		if !ok {
-			return nil, fmt.Errorf("unknown import group %q (valid: standard, external, internal)", name)
-		}
-		if seen[group] {
-			continue
+		_, err := parser.ParseFile(token.NewFileSet(), f.path, content, mode)
+		if err != nil {
+			return fmt.Errorf("is not valid Go: %w", err)
 		}
-		seen[group] = true
-		order = append(order, group)
+
+		return nil
 	}
 
-	for _, group := range []importGroup{standardLibrary, externalLibrary, internalLibrary} {
-		if !seen[group] {
-			order = append(order, group)
-		}
+	masked, ok := maskImportBlock(content)
+	if !ok {
+		return errors.New("has no recognizable import block")
+	}
+	_, err := parser.ParseFile(token.NewFileSet(), f.path, masked, parser.ImportsOnly)
+	if err != nil {
+		return fmt.Errorf("has an invalid import block: %w", err)
 	}
 
-	return order, nil
+	return nil
 }
 
-func processPath(target string, cfg config) ([]string, error) {
-	info, err := os.Stat(target)
+// formatImportDecl runs a rendered import declaration through formatSource
+// on its own, which aligns trailing comments the way gofmt does. The rest of
+// the file never goes through the printer: code outside the imports is left
+// to gofmt, byte for byte.
+func formatImportDecl(decl string) (string, error) {
+	const header = "package p\n\n"
+	formatted, err := formatSource([]byte(header + decl + "\n"))
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	if info.IsDir() {
-		return processDirectory(target, cfg)
-	}
+	return strings.TrimSuffix(strings.TrimPrefix(string(formatted), header), "\n"), nil
+}
 
-	changed, err := checkImports(target, cfg)
-	if err != nil || !changed {
+// formatSource prints src the way gofmt does, except that it leaves the
+// order of imports alone: format.Source would re-sort every run of imports
+// and undo nosortDirective.
+func formatSource(src []byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", src, parser.ParseComments|parser.SkipObjectResolution)
+	if err != nil {
 		return nil, err
 	}
 
-	return []string{target}, nil
-}
+	var buf bytes.Buffer
+	printerConfig := printer.Config{Mode: printer.UseSpaces | printer.TabIndent, Tabwidth: 8}
+	err = printerConfig.Fprint(&buf, fset, file)
+	if err != nil {
+		return nil, err
+	}
 
-var skippedDirs = map[string]bool{
-	"vendor":       true,
-	"testdata":     true,
-	"node_modules": true,
+	return buf.Bytes(), nil
 }
 
-func processDirectory(root string, cfg config) ([]string, error) {
-	var flagged []string
-
-	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
-		if err != nil {
-			return err
+// leftovers returns what remains of a line once the byte ranges in cuts,
+// which belong to import declarations, are taken out: the text before the
+// first cut, and the rest. A range ending at -1 runs to the end of the
+// line. The kept bytes are copied verbatim, string literals and comments
+// included; only the semicolons and spaces separating them from a cut are
+// trimmed, and pieces the cuts split apart are joined by a space. Either
+// result is empty if nothing else is left; otherwise it ends in eol, which
+// restores a CRLF line ending.
+func leftovers(line string, cuts [][2]int, eol string) (before, rest string) {
+	line = strings.TrimSuffix(line, "\r")
+	kept := make([]bool, len(line))
+	for i := range kept {
+		kept[i] = true
+	}
+	first := len(line)
+	for _, cut := range cuts {
+		end := cut[1]
+		if end < 0 || end > len(line) {
+			end = len(line)
 		}
+		for i := cut[0]; i < end; i++ {
+			kept[i] = false
+		}
+		first = min(first, cut[0])
+	}
 
-		if entry.IsDir() {
-			name := entry.Name()
-			if path != root && (skippedDirs[name] || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
-				return filepath.SkipDir
-			}
+	var pieces []string
+	for i := first; i < len(line); {
+		if !kept[i] {
+			i++
 
-			return nil
+			continue
 		}
-
-		if !strings.HasSuffix(path, ".go") {
-			return nil
+		start := i
+		for i < len(line) && kept[i] {
+			i++
 		}
-
-		changed, err := checkImports(path, cfg)
-		if err != nil {
-			return err
+		piece := strings.TrimLeft(line[start:i], " \t;")
+		if i < len(line) {
+			piece = strings.TrimRight(piece, " \t;")
 		}
-		if changed {
-			flagged = append(flagged, path)
+		if piece != "" {
+			pieces = append(pieces, piece)
 		}
-
-		return nil
-	})
-
-	return flagged, err
-}
-
-func checkImports(filePath string, cfg config) (bool, error) {
-	file, err := loadSourceFile(filePath, cfg.internalPrefix)
-	if err != nil {
-		return false, err
 	}
-
-	if len(file.decls) == 0 || !file.needsTidy(cfg.groupOrder) {
-		return false, nil
+	if before = strings.TrimRight(line[:first], " \t;"); before != "" {
+		before += eol
 	}
-	if !cfg.fix {
-		return true, nil
+	if len(pieces) > 0 {
+		rest = strings.Join(pieces, " ") + eol
 	}
 
-	fixed, err := file.tidy(cfg.groupOrder)
-	if err != nil {
-		return false, err
+	return before, rest
+}
+
+// cut records the byte range from start to end in cuts, keyed by line,
+// for leftovers.
+func cut(cuts map[int][][2]int, start, end token.Position) {
+	if start.Line == end.Line {
+		cuts[start.Line] = append(cuts[start.Line], [2]int{start.Column - 1, end.Column - 1})
+
+		return
 	}
+	cuts[start.Line] = append(cuts[start.Line], [2]int{start.Column - 1, -1})
+	cuts[end.Line] = append(cuts[end.Line], [2]int{0, end.Column - 1})
+}
 
-	err = os.WriteFile(filePath, fixed, file.mode)
-	if err != nil {
-		return false, err
+func trimTrailingBlankLines(lines []string) []string {
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
 	}
 
-	return true, nil
+	return lines
 }
 
-type sourceFile struct {
-	path    string
-	content []byte
-	mode    fs.FileMode
-	fset    *token.FileSet
-	decls   []*ast.GenDecl
-	imports []importInfo
-}
+// importIndent prefixes each spec inside a parenthesized import block. It
+// matches what gofmt emits, so the rendered block is already in its final
+// form before formatSource runs; if formatting fails the file is left
+// untouched rather than written with hand-built indentation.
+const importIndent = "\t"
 
-type importInfo struct {
-	path      string
-	group     importGroup
-	name      string
-	doc       []string
-	comment   string
-	startLine int
-	endLine   int
-}
+func (f *sourceFile) renderImportDecl(cfg config) string {
+	var b strings.Builder
 
-func loadSourceFile(path, internalPrefix string) (*sourceFile, error) {
-	info, err := os.Stat(path)
-	if err != nil {
-		return nil, err
+	imports := dedupeImports(f.usedImports())
+	if cfg.maxLineLength > 0 {
+		imports = slices.Clone(imports)
+		for i, imp := range imports {
+			if commentTooLong(imp, f.single(imports, cfg), cfg) {
+				imports[i].doc = append(slices.Clip(imp.doc), imp.comment)
+				imports[i].comment = ""
+			}
+		}
 	}
+	if f.single(imports, cfg) {
+		for _, group := range imports[0].floating {
+			for _, line := range group {
+				b.WriteString(line)
+				b.WriteByte('\n')
+			}
+			b.WriteByte('\n')
+		}
+		for _, doc := range imports[0].doc {
+			b.WriteString(doc)
+			b.WriteByte('\n')
+		}
+		b.WriteString("import ")
+		writeImportLine(&b, imports[0])
 
-	content, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
+		return b.String()
 	}
 
-	fset := token.NewFileSet()
-	astFile, err := parser.ParseFile(fset, path, content, parser.ParseComments)
-	if err != nil {
-		return nil, err
+	b.WriteString("import (")
+	if f.lparenComment != "" {
+		b.WriteString(" " + f.lparenComment)
 	}
-
-	file := &sourceFile{
-		path:    path,
-		content: content,
-		mode:    info.Mode(),
-		fset:    fset,
+	b.WriteByte('\n')
+	if f.nosort && !slices.ContainsFunc(imports, hasNosortDoc) {
+		// The directive was a free-floating comment, which the rewrite
+		// would otherwise drop; keep it at the top of the block.
+		b.WriteString(importIndent + nosortDirective + "\n")
 	}
-	for _, decl := range astFile.Decls {
-		genDecl, ok := decl.(*ast.GenDecl)
-		if !ok || genDecl.Tok != token.IMPORT {
-			continue
+	for i, section := range importSections(imports, cfg, f.compare(cfg)) {
+		if i > 0 {
+			b.WriteByte('\n')
 		}
-		file.decls = append(file.decls, genDecl)
-		for _, spec := range genDecl.Specs {
-			importSpec, ok := spec.(*ast.ImportSpec)
-			if !ok {
-				continue
+		for _, imp := range section {
+			for _, group := range imp.floating {
+				for _, line := range group {
+					b.WriteString(importIndent)
+					b.WriteString(line)
+					b.WriteByte('\n')
+				}
+				b.WriteByte('\n')
+			}
+			for _, doc := range imp.doc {
+				b.WriteString(importIndent)
+				b.WriteString(doc)
+				b.WriteByte('\n')
 			}
-			file.imports = append(file.imports, newImportInfo(fset, importSpec, internalPrefix))
+			b.WriteString(importIndent)
+			writeImportLine(&b, imp)
+			b.WriteByte('\n')
+		}
+	}
+	for i, group := range f.closing {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		for _, line := range group {
+			b.WriteString(importIndent)
+			b.WriteString(line)
+			b.WriteByte('\n')
 		}
 	}
+	b.WriteString(")")
+	if f.rparenComment != "" {
+		b.WriteString(" " + f.rparenComment)
+	}
 
-	return file, nil
+	return b.String()
 }
 
-func newImportInfo(fset *token.FileSet, spec *ast.ImportSpec, internalPrefix string) importInfo {
-	importPath := strings.Trim(spec.Path.Value, `"`)
-
-	info := importInfo{
-		path:      importPath,
-		group:     determineImportGroup(importPath, internalPrefix),
-		startLine: fset.Position(spec.Pos()).Line,
-		endLine:   fset.Position(spec.End()).Line,
-	}
-	if spec.Name != nil {
-		info.name = spec.Name.Name
-	}
-	if spec.Doc != nil {
-		for _, comment := range spec.Doc.List {
-			info.doc = append(info.doc, comment.Text)
-		}
-		info.startLine = fset.Position(spec.Doc.Pos()).Line
+// single reports whether imports are written as a single-line declaration,
+// import "path", rather than a parenthesized block. Comments at the end of
+// the block need the parentheses to stay where they are, and -parenthesize
+// keeps a lone blank or dot import in them to make it stand out.
+func (f *sourceFile) single(imports []importInfo, cfg config) bool {
+	if len(imports) != 1 || len(f.closing) > 0 || f.rparenComment != "" || f.lparenComment != "" {
+		return false
 	}
-	if spec.Comment != nil && len(spec.Comment.List) > 0 {
-		info.comment = spec.Comment.List[0].Text
-		info.endLine = fset.Position(spec.Comment.End()).Line
+	switch imports[0].name {
+	case "_":
+		return !cfg.parenthesize[parenthesizeBlank]
+	case ".":
+		return !cfg.parenthesize[parenthesizeDot]
 	}
 
-	return info
+	return true
 }
 
-func determineImportGroup(importPath, internalPrefix string) importGroup {
-	if importPath == internalPrefix || strings.HasPrefix(importPath, internalPrefix+"/") {
-		return internalLibrary
+// importSections splits imports into the runs that are separated by blank
+// lines in the output: one per block of cfg.importBlocks, or one per
+// subsection of a group split by cfg.subsection. Each run is sorted with
+// compare, so the members of joined groups are sorted together.
+func importSections(imports []importInfo, cfg config, compare func(a, b importInfo) int) [][]importInfo {
+	grouped := make(map[importGroup][]importInfo)
+	for _, imp := range imports {
+		grouped[imp.group] = append(grouped[imp.group], imp)
 	}
 
-	firstSegment, _, _ := strings.Cut(importPath, "/")
-	if strings.Contains(firstSegment, ".") {
-		return externalLibrary
+	var sections [][]importInfo
+	for _, block := range cfg.importBlocks() {
+		var specs []importInfo
+		for _, group := range block {
+			specs = append(specs, grouped[group]...)
+		}
+		if len(specs) == 0 {
+			continue
+		}
+		section := cfg.subsection(block[0])
+		if section == nil {
+			slices.SortStableFunc(specs, compare)
+			sections = append(sections, specs)
+
+			continue
+		}
+
+		slices.SortStableFunc(specs, func(a, b importInfo) int {
+			return cmp.Or(cmp.Compare(section(a), section(b)), compare(a, b))
+		})
+		start := 0
+		for i := 1; i <= len(specs); i++ {
+			if i == len(specs) || section(specs[i]) != section(specs[start]) {
+				sections = append(sections, specs[start:i])
+				start = i
+			}
+		}
+	}
+	if cfg.blankImports != blankImportsSort {
+		sourceOrder := make(map[importKey]int, len(imports))
+		for i, imp := range imports {
+			sourceOrder[imp.key()] = i
+		}
+		for _, section := range sections {
+			keepBlankOrder(section, sourceOrder)
+		}
 	}
 
-	return standardLibrary
+	return sections
 }
 
-func (f *sourceFile) needsTidy(order []importGroup) bool {
-	if len(f.decls) > 1 {
-		return true
+// keepBlankOrder is the default -blank-imports=keep: the blank imports of
+// a sorted section stay in the places sorting gave them, but are put back
+// in source order among themselves, since the order of side-effect imports
+// can matter to their init functions. With blank imports already sorted,
+// as gofmt leaves them, nothing changes.
+func keepBlankOrder(section []importInfo, sourceOrder map[importKey]int) {
+	var places []int
+	var blanks []importInfo
+	for i, imp := range section {
+		if imp.name == "_" {
+			places = append(places, i)
+			blanks = append(blanks, imp)
+		}
 	}
-	if len(f.imports) <= 1 {
-		return false
+	slices.SortStableFunc(blanks, func(a, b importInfo) int {
+		return cmp.Compare(sourceOrder[a.key()], sourceOrder[b.key()])
+	})
+	for i, place := range places {
+		section[place] = blanks[i]
 	}
+}
 
-	position := make(map[importGroup]int, len(order))
-	for i, group := range order {
-		position[group] = i
+// subsection returns the key that splits the imports of group into blank
+// line separated subsections, or nil when the group stays in one block.
+// -std-subgroups takes precedence over -preserve-subgroups for the standard
+// group; neither splits groups joined in one block.
+func (cfg config) subsection(group importGroup) func(importInfo) int {
+	switch {
+	case cfg.sharesBlock(group):
+		return nil
+	case group == standardLibrary && len(cfg.stdSubgroups) > 0:
+		return cfg.stdSubgroup
+	case cfg.preserveSubgroups:
+		return func(imp importInfo) int { return imp.subgroup }
 	}
 
-	for i := 1; i < len(f.imports); i++ {
-		prev, curr := f.imports[i-1], f.imports[i]
-		sameGroup := prev.group == curr.group
-		blankBetween := curr.startLine-prev.endLine > 1
+	return nil
+}
 
-		switch {
-		case position[curr.group] < position[prev.group]:
-			return true // groups out of order
-		case !sameGroup && !blankBetween:
-			return true // missing blank line between groups
-		case sameGroup && blankBetween:
-			return true // stray blank line inside a group
-		case sameGroup && prev.path > curr.path:
-			return true // not sorted alphabetically
+// keepsBlankLines reports whether blank lines inside group are left alone.
+// Joined groups are always merged into one block.
+func (cfg config) keepsBlankLines(group importGroup) bool {
+	return cfg.preserveSubgroups && !cfg.sharesBlock(group) && !(group == standardLibrary && len(cfg.stdSubgroups) > 0)
+}
+
+// stdSubgroup is the subsection of a standard library import under
+// -std-subgroups: 0 for imports matching none of the prefixes, otherwise
+// one past the index of the longest matching prefix.
+func (cfg config) stdSubgroup(imp importInfo) int {
+	section, matched := 0, ""
+	for i, prefix := range cfg.stdSubgroups {
+		if hasPathPrefix(imp.path, prefix) && len(prefix) > len(matched) {
+			section, matched = i+1, prefix
 		}
 	}
 
-	return false
+	return section
 }
 
-func (f *sourceFile) tidy(order []importGroup) ([]byte, error) {
-	insertLine := f.fset.Position(f.decls[0].Pos()).Line
-
-	removed := make(map[int]bool)
-	for _, decl := range f.decls {
-		start := f.fset.Position(decl.Pos()).Line
-		end := f.fset.Position(decl.End()).Line
-		for line := start; line <= end; line++ {
-			removed[line] = true
+// internalByDepth puts shallower internal imports first (the module root
+// before its packages), ordered by compare at each depth. Other groups are
+// ordered by compare alone.
+func internalByDepth(compare func(a, b importInfo) int) func(a, b importInfo) int {
+	return func(a, b importInfo) int {
+		if a.group != internalLibrary || b.group != internalLibrary {
+			return compare(a, b)
 		}
+
+		return cmp.Or(cmp.Compare(strings.Count(a.path, "/"), strings.Count(b.path, "/")), compare(a, b))
 	}
+}
 
-	var b strings.Builder
-	for i, line := range strings.Split(string(f.content), "\n") {
-		lineNo := i + 1
-		if lineNo == insertLine {
-			b.WriteString(renderImportDecl(f.imports, order))
-			b.WriteByte('\n')
+// compareUpperFirst is -sort=upper-first: paths with a segment starting
+// with an uppercase letter, such as github.com/BurntSushi/toml, cluster
+// before all others, and each cluster is ordered like compareImports.
+func compareUpperFirst(a, b importInfo) int {
+	// false sorts before true, so compare the negations.
+	return cmp.Or(compareBool(!hasUpperSegment(a.path), !hasUpperSegment(b.path)), compareImports(a, b))
+}
+
+// compareCaseInsensitive is -sort=case-insensitive: paths are ordered as if
+// lowercased, so github.com/Azure/x and github.com/aws/y interleave by name.
+// Paths equal but for case fall back to compareImports.
+func compareCaseInsensitive(a, b importInfo) int {
+	return cmp.Or(strings.Compare(strings.ToLower(a.path), strings.ToLower(b.path)), compareImports(a, b))
+}
+
+// compareSegments is -sort=segments: paths are ordered element by element,
+// so a package comes right before the packages below it. Bytewise, '-' and
+// '.' sort before '/', which puts example.com/foo-bar between example.com/foo
+// and example.com/foo/baz.
+func compareSegments(a, b importInfo) int {
+	return cmp.Or(
+		slices.Compare(strings.Split(a.path, "/"), strings.Split(b.path, "/")),
+		strings.Compare(a.name, b.name))
+}
+
+// compareModules is -sort=module-aware: imports are ordered by the module
+// providing them, then like compareSegments, so the packages of a nested
+// module never split those of the module around it. Modules are those of
+// go.mod or go.work under -mode=gomod or -mode=gowork; without them every
+// path is taken as its own module, which leaves compareSegments.
+func compareModules(cfg config) func(a, b importInfo) int {
+	modulePath := func(importPath string) string {
+		if cfg.module == nil {
+			return importPath
 		}
-		if removed[lineNo] {
-			continue
+		module := importPath
+		longest := -1
+		for _, mod := range slices.Concat([]string{cfg.module.module}, cfg.module.workspace, cfg.module.require) {
+			if mod != "" && hasPathPrefix(importPath, mod) && len(mod) > longest {
+				module, longest = mod, len(mod)
+			}
 		}
-		b.WriteString(line)
-		b.WriteByte('\n')
-	}
 
-	formatted, err := format.Source([]byte(b.String()))
-	if err != nil {
-		return nil, fmt.Errorf("reorganized %s does not format cleanly (file left unchanged): %w", f.path, err)
+		return module
 	}
 
-	return formatted, nil
+	return func(a, b importInfo) int {
+		return cmp.Or(
+			compareSegments(importInfo{path: modulePath(a.path)}, importInfo{path: modulePath(b.path)}),
+			compareSegments(a, b))
+	}
 }
 
-func renderImportDecl(imports []importInfo, order []importGroup) string {
-	var b strings.Builder
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case !a:
+		return -1
+	}
 
-	if len(imports) == 1 {
-		for _, doc := range imports[0].doc {
-			b.WriteString(doc)
-			b.WriteByte('\n')
-		}
-		b.WriteString("import ")
-		writeImportLine(&b, imports[0])
+	return 1
+}
 
-		return b.String()
+func hasUpperSegment(importPath string) bool {
+	for segment := range strings.SplitSeq(importPath, "/") {
+		if segment != "" && unicode.IsUpper(rune(segment[0])) {
+			return true
+		}
 	}
 
-	grouped := make(map[importGroup][]importInfo)
+	return false
+}
+
+// keepSourceOrder is the comparator for blocks marked with nosortDirective,
+// and for every block with -sort=none or -disable=sort-order.
+func keepSourceOrder(_, _ importInfo) int {
+	return 0
+}
+
+// compareImports orders imports by path, falling back to the alias so that
+// one path imported under several names always comes out the same way.
+func compareImports(a, b importInfo) int {
+	return cmp.Or(strings.Compare(a.path, b.path), strings.Compare(a.name, b.name))
+}
+
+// importKey identifies an import by what it binds; two specs with the same
+// key are a duplicate that would not compile.
+type importKey struct {
+	name string
+	path string
+}
+
+func (imp importInfo) key() importKey {
+	return importKey{name: imp.name, path: imp.path}
+}
+
+// dedupeImports drops repeated specs, keeping the first one and borrowing
+// any comments it lacks from the duplicates so nothing is silently lost.
+func dedupeImports(imports []importInfo) []importInfo {
+	unique := make([]importInfo, 0, len(imports))
+	index := make(map[importKey]int, len(imports))
 	for _, imp := range imports {
-		grouped[imp.group] = append(grouped[imp.group], imp)
-	}
+		i, ok := index[imp.key()]
+		if !ok {
+			index[imp.key()] = len(unique)
+			unique = append(unique, imp)
 
-	b.WriteString("import (\n")
-	firstGroup := true
-	for _, group := range order {
-		specs := grouped[group]
-		if len(specs) == 0 {
 			continue
 		}
-		slices.SortFunc(specs, func(a, b importInfo) int {
-			return strings.Compare(a.path, b.path)
-		})
-
-		if !firstGroup {
-			b.WriteByte('\n')
+		if len(unique[i].doc) == 0 {
+			unique[i].doc = imp.doc
 		}
-		firstGroup = false
-
-		for _, imp := range specs {
-			for _, doc := range imp.doc {
-				b.WriteByte('\t')
-				b.WriteString(doc)
-				b.WriteByte('\n')
-			}
-			b.WriteByte('\t')
-			writeImportLine(&b, imp)
-			b.WriteByte('\n')
+		if unique[i].comment == "" {
+			unique[i].comment = imp.comment
 		}
+		unique[i].floating = slices.Concat(unique[i].floating, imp.floating)
 	}
-	b.WriteString(")")
 
-	return b.String()
+	return unique
+}
+
+// commentTooLong reports whether imp's trailing comment pushes its rendered
+// line past -max-line-length. Widths are in bytes, counting the indenting
+// tab as one, the way column numbers are reported.
+func commentTooLong(imp importInfo, single bool, cfg config) bool {
+	if cfg.maxLineLength == 0 || imp.comment == "" || cfg.disabled[violationLongLine] || isLintDirective(imp.comment) {
+		return false
+	}
+
+	var b strings.Builder
+	if single {
+		b.WriteString("import ")
+	} else {
+		b.WriteString(importIndent)
+	}
+	writeImportLine(&b, imp)
+
+	return b.Len() > cfg.maxLineLength
+}
+
+// isLintDirective reports whether comment silences a linter for the line it
+// is on, as //nolint and staticcheck's //lint:ignore do. Moved to a line of
+// its own, such a comment would silence the wrong line or nothing at all.
+func isLintDirective(comment string) bool {
+	comment = strings.TrimSpace(strings.TrimPrefix(comment, "//"))
+
+	return strings.HasPrefix(comment, "nolint") || strings.HasPrefix(comment, "lint:ignore")
 }
 
 func writeImportLine(b *strings.Builder, imp importInfo) {
@@ -476,7 +3289,7 @@ func writeImportLine(b *strings.Builder, imp importInfo) {
 		b.WriteString(imp.name)
 		b.WriteByte(' ')
 	}
-	b.WriteString(strconv.Quote(imp.path))
+	b.WriteString(imp.literal)
 	if imp.comment != "" {
 		b.WriteByte(' ')
 		b.WriteString(imp.comment)
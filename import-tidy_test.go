@@ -1,12 +1,28 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
+var defaultGroups = []importGroup{standardLibrary, externalLibrary, internalLibrary}
+
 const misformattedSrc = `package sample
 
 import (
@@ -17,15 +33,25 @@ import (
 
 func testConfig(fix bool) config {
 	return config{
-		internalPrefix: "git.example.com/team",
-		groupOrder:     []importGroup{standardLibrary, externalLibrary, internalLibrary},
-		fix:            fix,
+		internalPrefixes: []string{"git.example.com/team"},
+		groupOrder:       defaultGroups,
+		fix:              fix,
+		log:              &logger{out: io.Discard},
 	}
 }
 
-func TestDetermineImportGroup(t *testing.T) {
-	const internalPrefix = "git.example.com/team"
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	configPath := filepath.Join(t.TempDir(), "import-tidy.json")
+	err := os.WriteFile(configPath, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return configPath
+}
 
+func TestDetermineImportGroup(t *testing.T) {
 	tests := []struct {
 		path string
 		want importGroup
@@ -38,18 +64,406 @@ func TestDetermineImportGroup(t *testing.T) {
 		{"git.example.com/team", internalLibrary},
 		{"git.example.com/team/pkg", internalLibrary},
 		{"git.example.com/teammate/pkg", externalLibrary},
+		{"github.com/acme/tools", internalLibrary},
+	}
+
+	cfg := testConfig(false)
+	cfg.internalPrefixes = append(cfg.internalPrefixes, "github.com/acme")
+	for _, tt := range tests {
+		if got := determineImportGroup(tt.path, cfg); got != tt.want {
+			t.Errorf("determineImportGroup(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestStdList(t *testing.T) {
+	tests := []struct {
+		goVersion string
+		path      string
+		want      importGroup
+	}{
+		{"1.22", "fmt", standardLibrary},
+		{"1.22", "C", standardLibrary},
+		{"1.22", "net/http/httptest", standardLibrary},
+		{"1.22", "mycompany/pkg", externalLibrary},
+		{"1.22", "iter", externalLibrary},
+		{"1.23", "iter", standardLibrary},
+		{"go1.23.4", "iter", standardLibrary},
+		{"1.22", "git.example.com/team/pkg", internalLibrary},
+	}
+	for _, tt := range tests {
+		packages, err := stdPackages(tt.goVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := testConfig(false)
+		cfg.stdPackages = packages
+		if got := determineImportGroup(tt.path, cfg); got != tt.want {
+			t.Errorf("go%s: determineImportGroup(%q) = %v, want %v", strings.TrimPrefix(tt.goVersion, "go"), tt.path, got, tt.want)
+		}
+	}
+
+	_, err := stdPackages("1.x")
+	if err == nil {
+		t.Error("expected an error for an invalid Go version")
+	}
+}
+
+func TestCompileMatcher(t *testing.T) {
+	tests := []struct {
+		expr string
+		path string
+		want bool
+	}{
+		{`hasPrefix("golang.org/x/")`, "golang.org/x/sync/errgroup", true},
+		{`hasPrefix("golang.org/x/")`, "golang.org/y", false},
+		{`hasPrefix("golang.org/x/") || hasPrefix("gopkg.in/")`, "gopkg.in/yaml.v3", true},
+		{`contains("/proto/") && !contains("/legacy/")`, "acme.dev/api/proto/v1", true},
+		{`contains("/proto/") && !contains("/legacy/")`, "acme.dev/legacy/proto/v1", false},
+		{`matches("^k8s\\.io/(api|client-go)")`, "k8s.io/client-go/rest", true},
+		{"matches(`v[0-9]+$`)", "example.com/mod/v2", true},
+		{`!(hasPrefix("a") || hasPrefix("b"))`, "c/d", true},
+	}
+
+	for _, tt := range tests {
+		match, err := compileMatcher(tt.expr)
+		if err != nil {
+			t.Fatalf("compileMatcher(%s): %v", tt.expr, err)
+		}
+		if got := match(tt.path); got != tt.want {
+			t.Errorf("%s on %q = %v, want %v", tt.expr, tt.path, got, tt.want)
+		}
+	}
+
+	for _, expr := range []string{
+		`hasPrefix`,
+		`hasSuffix("x")`,
+		`hasPrefix("a", "b")`,
+		`hasPrefix(path)`,
+		`hasPrefix("a") + hasPrefix("b")`,
+		`matches("(")`,
+		`hasPrefix("a") ||`,
+	} {
+		if _, err := compileMatcher(expr); err == nil {
+			t.Errorf("compileMatcher(%s) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestClassifyRulesFromConfig(t *testing.T) {
+	configPath := writeConfig(t, `{
+  "classify": [
+    {"group": "shared", "match": "hasPrefix(\"golang.org/x/\") || hasPrefix(\"gopkg.in/\")"},
+    {"group": "internal", "match": "matches(\"^acme\\\\.(dev|io)/\")"}
+  ]
+}`)
+
+	cfg, _, err := parseArgs([]string{"-internal-prefix=git.example.com/team", "-config", configPath, "."}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOrder(t, cfg.groupOrder, []importGroup{standardLibrary, externalLibrary, sharedLibrary, internalLibrary})
+
+	tests := []struct {
+		path string
+		want importGroup
+	}{
+		{"golang.org/x/sync/errgroup", sharedLibrary},
+		{"gopkg.in/yaml.v3", sharedLibrary},
+		{"acme.io/billing", internalLibrary},
+		{"git.example.com/team/pkg", internalLibrary},
+		{"github.com/pkg/errors", externalLibrary},
+		{"fmt", standardLibrary},
+	}
+	for _, tt := range tests {
+		if got := determineImportGroup(tt.path, cfg); got != tt.want {
+			t.Errorf("determineImportGroup(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+
+	configPath = writeConfig(t, `{"classify": [{"group": "internal", "match": "startsWith(\"x\")"}]}`)
+	_, _, err = parseArgs([]string{"-internal-prefix=git.example.com/team", "-config", configPath, "."}, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "classify[0]") {
+		t.Errorf("parseArgs with an unknown function = %v, want a classify[0] error", err)
+	}
+}
+
+func TestGroupOverridesFromConfig(t *testing.T) {
+	configPath := writeConfig(t, `{
+  "groups": {
+    "golang.org/x/sync": "internal",
+    "git.example.com/team/vendored": "external",
+    "acme.io/billing": "standard"
+  },
+  "classify": [
+    {"group": "shared", "match": "hasPrefix(\"acme.io/\")"}
+  ]
+}`)
+
+	cfg, _, err := parseArgs([]string{"-internal-prefix=git.example.com/team", "-config", configPath, "."}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
 	}
 
+	tests := []struct {
+		path string
+		want importGroup
+	}{
+		// An override beats the prefix rules...
+		{"golang.org/x/sync", internalLibrary},
+		{"git.example.com/team/vendored", externalLibrary},
+		// ...and the classify rules.
+		{"acme.io/billing", standardLibrary},
+		// It covers the exact path only, not the packages below it.
+		{"golang.org/x/sync/errgroup", externalLibrary},
+		{"git.example.com/team/vendored/sub", internalLibrary},
+		{"acme.io/billing/v2", sharedLibrary},
+	}
 	for _, tt := range tests {
-		if got := determineImportGroup(tt.path, internalPrefix); got != tt.want {
+		if got := determineImportGroup(tt.path, cfg); got != tt.want {
 			t.Errorf("determineImportGroup(%q) = %v, want %v", tt.path, got, tt.want)
 		}
 	}
+
+	configPath = writeConfig(t, `{"groups": {"golang.org/x/sync": "shared"}}`)
+	cfg, _, err = parseArgs([]string{"-internal-prefix=git.example.com/team", "-config", configPath, "."}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOrder(t, cfg.groupOrder, []importGroup{standardLibrary, externalLibrary, sharedLibrary, internalLibrary})
+
+	configPath = writeConfig(t, `{"groups": {"golang.org/x/sync": "vendor"}}`)
+	_, _, err = parseArgs([]string{"-internal-prefix=git.example.com/team", "-config", configPath, "."}, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "groups") {
+		t.Errorf("parseArgs with an unknown group = %v, want a groups error", err)
+	}
+}
+
+func TestCustomImportGroups(t *testing.T) {
+	configPath := writeConfig(t, `{
+  "importGroups": [
+    {"name": "std", "std": true},
+    {"name": "company", "prefixes": ["acme.io"], "paths": ["github.com/acme/special"]},
+    {"name": "kube", "patterns": ["^k8s\\.io/"]},
+    {"name": "generated", "prefixes": ["acme.io/gen"]},
+    {"name": "other", "catchAll": true},
+    {"name": "empty", "paths": ["example.com/unused"]}
+  ],
+  "groups": {"github.com/acme/forked": "company"}
+}`)
+	cfg, _, err := parseArgs([]string{"-config", configPath, "."}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	company, _ := lookupGroup("company")
+	kube, _ := lookupGroup("kube")
+	generated, _ := lookupGroup("generated")
+	other, _ := lookupGroup("other")
+	empty, _ := lookupGroup("empty")
+	// A group named like a built-in one is that group.
+	assertOrder(t, cfg.groupOrder, []importGroup{standardLibrary, company, kube, generated, other, empty})
+
+	for path, want := range map[string]importGroup{
+		"fmt":                     standardLibrary,
+		"acme.io/svc":             company,
+		"github.com/acme/special": company,
+		"github.com/acme/forked":  company, // groups still wins
+		"k8s.io/client-go":        kube,
+		// company comes first, so generated never gets these.
+		"acme.io/gen/api": company,
+		// The catch-all takes only what no group matches, including
+		// the groups defined after it.
+		"github.com/pkg/errors": other,
+		"example.com/unused":    empty,
+	} {
+		if got := determineImportGroup(path, cfg); got != want {
+			t.Errorf("determineImportGroup(%q) = %v, want %v", path, got, want)
+		}
+	}
+
+	src := `package sample
+
+import (
+	"github.com/pkg/errors"
+	"acme.io/gen/api"
+	"k8s.io/client-go"
+	"fmt"
+	"github.com/acme/special"
+)
+`
+	// Groups without imports, such as generated, leave no trace.
+	want := `package sample
+
+import (
+	"fmt"
+
+	"acme.io/gen/api"
+	"github.com/acme/special"
+
+	"k8s.io/client-go"
+
+	"github.com/pkg/errors"
+)
+`
+	cfg.fix = true
+	_, got := runOnFile(t, cfg, src)
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	cfg, _, err = parseArgs([]string{"-config", configPath, "-import-order=other,kube,std,company,generated,empty", "."}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOrder(t, cfg.groupOrder, []importGroup{other, kube, standardLibrary, company, generated, empty})
+}
+
+func TestCustomImportGroupsErrors(t *testing.T) {
+	for name, test := range map[string]struct {
+		config string
+		args   []string
+		want   string
+	}{
+		"no catch-all": {
+			config: `{"importGroups": [{"name": "std", "std": true}]}`,
+			want:   "one group must be the catchAll",
+		},
+		"two catch-alls": {
+			config: `{"importGroups": [{"name": "a", "catchAll": true}, {"name": "b", "catchAll": true}]}`,
+			want:   `importGroups[1]: "a" and "b" cannot both be the catchAll group`,
+		},
+		"duplicate name": {
+			config: `{"importGroups": [{"name": "std", "std": true}, {"name": "standard", "prefixes": ["x.io"]}, {"name": "rest", "catchAll": true}]}`,
+			want:   `importGroups[1]: group "standard" is defined more than once`,
+		},
+		"no matchers": {
+			config: `{"importGroups": [{"name": "lonely"}, {"name": "rest", "catchAll": true}]}`,
+			want:   `importGroups[0]: group "lonely" matches nothing`,
+		},
+		"invalid name": {
+			config: `{"importGroups": [{"name": "a+b", "std": true}, {"name": "rest", "catchAll": true}]}`,
+			want:   `importGroups[0]: invalid group name "a+b"`,
+		},
+		"invalid pattern": {
+			config: `{"importGroups": [{"name": "bad", "patterns": ["("]}, {"name": "rest", "catchAll": true}]}`,
+			want:   `importGroups[0]: invalid pattern "("`,
+		},
+		"classify into a group not defined": {
+			config: `{"importGroups": [{"name": "rest", "catchAll": true}], "classify": [{"group": "internal", "match": "hasPrefix(\"x\")"}]}`,
+			want:   `classify[0]: import group "internal" is not in use (valid: rest)`,
+		},
+		"with -internal-prefix": {
+			config: `{"importGroups": [{"name": "rest", "catchAll": true}]}`,
+			args:   []string{"-internal-prefix=git.example.com/team"},
+			want:   "importGroups cannot be combined with -internal-prefix",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			args := append([]string{"-config", writeConfig(t, test.config)}, test.args...)
+			_, _, err := parseArgs(append(args, "."), io.Discard)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("parseArgs = %v, want an error containing %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestBannedImports(t *testing.T) {
+	configPath := writeConfig(t, `{"banned": ["io/ioutil", "git.example.com/team/legacy/..."]}`)
+	dir := t.TempDir()
+	tidy := "package sample\n\nimport (\n\t\"io/ioutil\"\n\t\"os\"\n\n\t\"git.example.com/team/legacy/db\"\n\t\"git.example.com/team/legacyx\"\n)\n"
+	untidy := "package sample\n\nimport (\n\t\"os\"\n\t\"io/ioutil\"\n)\n"
+	allowed := "package sample\n\nimport \"io\"\n"
+	for name, src := range map[string]string{"tidy.go": tidy, "untidy.go": untidy, "allowed.go": allowed} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-internal-prefix=git.example.com/team", "-config", configPath, dir}, &stdout, &stderr)
+	if code != exitIssuesFound {
+		t.Errorf("exit code = %d, want %d", code, exitIssuesFound)
+	}
+	want := []string{
+		filepath.Join(dir, "tidy.go") + `:4:2: "io/ioutil" is banned by the configuration`,
+		filepath.Join(dir, "tidy.go") + `:7:2: "git.example.com/team/legacy/db" is banned by the configuration`,
+		"needs formatting: " + filepath.Join(dir, "untidy.go"),
+		filepath.Join(dir, "untidy.go") + `:5:2: "io/ioutil" is banned by the configuration`,
+	}
+	if got := strings.Split(strings.TrimSpace(stdout.String()), "\n"); !slices.Equal(got, want) {
+		t.Errorf("output:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Fixing tidies the file, but no fix removes a banned import.
+	stdout.Reset()
+	code = run([]string{"-internal-prefix=git.example.com/team", "-config", configPath, "-fix", dir}, &stdout, &stderr)
+	if code != exitIssuesFound {
+		t.Errorf("-fix exit code = %d, want %d", code, exitIssuesFound)
+	}
+	if !strings.Contains(stdout.String(), "fixed: "+filepath.Join(dir, "untidy.go")) {
+		t.Errorf("-fix output %q does not report the fixed file", stdout.String())
+	}
+
+	configPath = writeConfig(t, `{"banned": ["/..."]}`)
+	_, _, err := parseArgs([]string{"-internal-prefix=git.example.com/team", "-config", configPath, "."}, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "banned[0]") {
+		t.Errorf("parseArgs with an empty banned path = %v, want a banned[0] error", err)
+	}
+}
+
+func TestParseGoMod(t *testing.T) {
+	mod, err := parseGoMod(`// A comment.
+module "git.example.com/team/app" // quoted
+
+go 1.26
+
+require github.com/pkg/errors v0.9.1
+
+require (
+	golang.org/x/sync v0.10.0
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace github.com/pkg/errors => ../errors
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mod.module != "git.example.com/team/app" {
+		t.Errorf("module = %q, want git.example.com/team/app", mod.module)
+	}
+	want := []string{"github.com/pkg/errors", "golang.org/x/sync", "gopkg.in/yaml.v3"}
+	if !slices.Equal(mod.require, want) {
+		t.Errorf("require = %v, want %v", mod.require, want)
+	}
+	for path, want := range map[string]bool{
+		"git.example.com/team/app/db":      true,
+		"golang.org/x/sync/errgroup":       true,
+		"github.com/pkg/errors":            true,
+		"github.com/pkg/errorsx":           false,
+		"git.example.com/team/application": false,
+	} {
+		if got := mod.requires(path); got != want {
+			t.Errorf("requires(%q) = %v, want %v", path, got, want)
+		}
+	}
+
+	if want := []string{"github.com/pkg/errors"}; !slices.Equal(mod.localReplaces, want) {
+		t.Errorf("localReplaces = %v, want %v", mod.localReplaces, want)
+	}
+
+	for _, bad := range []string{"go 1.26\n", "module\n", "module \"unterminated\n", "module m\nreplace a =>\n"} {
+		if _, err := parseGoMod(bad); err == nil {
+			t.Errorf("parseGoMod(%q) succeeded, want an error", bad)
+		}
+	}
 }
 
 func TestParseImportOrder(t *testing.T) {
 	t.Run("default", func(t *testing.T) {
-		order, err := parseImportOrder("standard,external,internal")
+		order, err := parseImportOrder("standard,external,internal", defaultGroups, false)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -57,8 +471,15 @@ func TestParseImportOrder(t *testing.T) {
 		assertOrder(t, order, want)
 	})
 
-	t.Run("missing groups are appended", func(t *testing.T) {
-		order, err := parseImportOrder("internal")
+	t.Run("missing groups are an error", func(t *testing.T) {
+		_, err := parseImportOrder("internal", defaultGroups, false)
+		if err == nil {
+			t.Fatal("expected error for omitted groups")
+		}
+	})
+
+	t.Run("missing groups are appended when partial", func(t *testing.T) {
+		order, err := parseImportOrder("internal", defaultGroups, true)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -66,21 +487,118 @@ func TestParseImportOrder(t *testing.T) {
 		assertOrder(t, order, want)
 	})
 
-	t.Run("duplicates are ignored", func(t *testing.T) {
-		order, err := parseImportOrder("standard,standard,external")
-		if err != nil {
-			t.Fatal(err)
+	t.Run("duplicates are an error", func(t *testing.T) {
+		_, err := parseImportOrder("standard,standard,external", defaultGroups, true)
+		if err == nil {
+			t.Fatal("expected error for duplicate group name")
 		}
-		want := []importGroup{standardLibrary, externalLibrary, internalLibrary}
-		assertOrder(t, order, want)
 	})
 
 	t.Run("unknown group is an error", func(t *testing.T) {
-		_, err := parseImportOrder("standart,external")
+		_, err := parseImportOrder("standart,external,internal", defaultGroups, true)
 		if err == nil {
 			t.Fatal("expected error for unknown group name")
 		}
 	})
+
+	t.Run("case and synonyms", func(t *testing.T) {
+		for _, spec := range []string{
+			"Standard,External,Internal",
+			"STANDARD, EXTERNAL, INTERNAL",
+			"std,third-party,local",
+			"STD, Third-Party, Local",
+			"stdlib,thirdparty,internal",
+		} {
+			order, err := parseImportOrder(spec, defaultGroups, false)
+			if err != nil {
+				t.Errorf("%q: %v", spec, err)
+
+				continue
+			}
+			assertOrder(t, order, []importGroup{standardLibrary, externalLibrary, internalLibrary})
+		}
+	})
+
+	t.Run("a synonym and its group are duplicates", func(t *testing.T) {
+		_, err := parseImportOrder("std,standard,external,internal", defaultGroups, false)
+		if err == nil {
+			t.Fatal("expected error for a group listed under two names")
+		}
+	})
+
+	t.Run("unknown group among synonyms is an error", func(t *testing.T) {
+		_, err := parseImportOrder("STD, Local, vendor", defaultGroups, true)
+		if err == nil || !strings.Contains(err.Error(), `"vendor"`) {
+			t.Fatalf("err = %v, want an error naming \"vendor\"", err)
+		}
+	})
+
+	t.Run("joined groups accept synonyms", func(t *testing.T) {
+		cfg, _, err := parseArgs([]string{"-internal-prefix=git.example.com/team", "-import-order=STD+Third-Party,local", "."}, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cfg.sharesBlock(externalLibrary) {
+			t.Error("external does not share the standard block")
+		}
+	})
+}
+
+func TestSharedPrefix(t *testing.T) {
+	cfg := testConfig(true)
+	cfg.internalPrefixes = []string{"github.com/acme/billing"}
+	cfg.sharedPrefix = "github.com/acme"
+	groups := []importGroup{standardLibrary, externalLibrary, sharedLibrary, internalLibrary}
+	cfg.groupOrder = groups
+
+	tests := []struct {
+		path string
+		want importGroup
+	}{
+		{"github.com/acme/platform/log", sharedLibrary},
+		{"github.com/acme", sharedLibrary},
+		{"github.com/acme/billing", internalLibrary},
+		{"github.com/acme/billing/db", internalLibrary},
+		{"github.com/acmecorp/x", externalLibrary},
+	}
+	for _, tt := range tests {
+		if got := determineImportGroup(tt.path, cfg); got != tt.want {
+			t.Errorf("determineImportGroup(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+
+	src := `package sample
+
+import (
+	"github.com/acme/billing/db"
+	"github.com/acme/platform/log"
+	"github.com/pkg/errors"
+	"fmt"
+)
+`
+	want := `package sample
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/acme/platform/log"
+
+	"github.com/acme/billing/db"
+)
+`
+	_, got := runOnFile(t, cfg, src)
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	if _, err := parseImportOrder("standard,external,internal", groups, false); err == nil {
+		t.Error("expected error when -import-order omits the shared group")
+	}
+	if _, err := parseImportOrder("standard,shared,external,internal", defaultGroups, false); err == nil {
+		t.Error("expected error for the shared group without -shared-prefix")
+	}
 }
 
 func assertOrder(t *testing.T, got, want []importGroup) {
@@ -102,7 +620,7 @@ func runOnFile(t *testing.T, cfg config, src string) (bool, string) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	changed, err := checkImports(filePath, cfg)
+	verr, err := collectViolations(checkImports(filePath, cfg))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -111,7 +629,7 @@ func runOnFile(t *testing.T, cfg config, src string) (bool, string) {
 		t.Fatal(err)
 	}
 
-	return changed, string(content)
+	return verr != nil, string(content)
 }
 
 func TestFixReordersAndGroups(t *testing.T) {
@@ -166,15 +684,19 @@ import (
 	}
 }
 
-func TestFixMergesMultipleImportDecls(t *testing.T) {
+func TestFixMovesFloatingCommentsWithTheirImport(t *testing.T) {
 	src := `package sample
 
-import "os"
-
 import (
-	"fmt"
+	"os"
+
+	// Tracing, see go/tracing.
+
+	"go.opentelemetry.io/otel"
+	// Errors.
 
 	"github.com/pkg/errors"
+	"fmt"
 )
 `
 	want := `package sample
@@ -183,7 +705,12 @@ import (
 	"fmt"
 	"os"
 
+	// Errors.
+
 	"github.com/pkg/errors"
+	// Tracing, see go/tracing.
+
+	"go.opentelemetry.io/otel"
 )
 `
 	changed, got := runOnFile(t, testConfig(true), src)
@@ -193,133 +720,4701 @@ import (
 	if got != want {
 		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
 	}
-}
 
-func TestFixCustomOrderKeepsAllImports(t *testing.T) {
-	order, err := parseImportOrder("standard,internal")
-	if err != nil {
-		t.Fatal(err)
+	changed, _ = runOnFile(t, testConfig(false), want)
+	if changed {
+		t.Error("fixed output must be stable")
 	}
-	cfg := testConfig(true)
-	cfg.groupOrder = order
+}
 
+func TestFixMergesMultipleImportDecls(t *testing.T) {
 	src := `package sample
 
+import "os"
+
 import (
 	"fmt"
 
 	"github.com/pkg/errors"
+)
+`
+	want := `package sample
 
-	"git.example.com/team/pkg"
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
 )
 `
-	_, got := runOnFile(t, cfg, src)
-	if !strings.Contains(got, `"github.com/pkg/errors"`) {
-		t.Fatalf("external import was dropped:\n%s", got)
+	changed, got := runOnFile(t, testConfig(true), src)
+	if !changed {
+		t.Fatal("expected file to be reported as changed")
+	}
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
 	}
 }
 
-func TestCheckReportsWithoutRewriting(t *testing.T) {
-	changed, got := runOnFile(t, testConfig(false), misformattedSrc)
+func TestFixMergesDocCommentsOfLaterDecls(t *testing.T) {
+	src := `package sample
+
+// Package imports.
+import "os"
+
+// Needed for errors.
+import "github.com/pkg/errors"
+
+// Printing.
+import (
+	"fmt"
+)
+
+func main() {}
+`
+	want := `package sample
+
+// Package imports.
+import (
+	// Printing.
+
+	"fmt"
+	"os"
+
+	// Needed for errors.
+	"github.com/pkg/errors"
+)
+
+func main() {}
+`
+	changed, got := runOnFile(t, testConfig(true), src)
 	if !changed {
-		t.Fatal("expected misformatted file to be reported")
+		t.Fatal("expected file to be reported as changed")
 	}
-	if got != misformattedSrc {
-		t.Error("check mode must not modify the file")
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+	changed, _ = runOnFile(t, testConfig(false), got)
+	if changed {
+		t.Errorf("fixed file still reports violations:\n%s", got)
 	}
 }
 
-func TestCleanFileIsUntouched(t *testing.T) {
+func TestFixRemovesUnusedImports(t *testing.T) {
 	src := `package sample
 
 import (
+	_ "embed"
 	"fmt"
+	. "math"
 	"os"
+	str "strings"
 
 	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
 
-	"git.example.com/team/pkg"
+	"git.example.com/team/log"
 )
+
+func main() {
+	os := "shadows the package"
+	fmt.Println(os, errors.New, Pi)
+}
 `
-	changed, got := runOnFile(t, testConfig(true), src)
+	want := `package sample
+
+import (
+	_ "embed"
+	"fmt"
+	. "math"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+func main() {
+	os := "shadows the package"
+	fmt.Println(os, errors.New, Pi)
+}
+`
+	changed, got := runOnFile(t, testConfig(false), src)
 	if changed {
-		t.Error("clean file must not be reported as changed")
+		t.Error("unused imports must not be flagged without -remove-unused")
 	}
-	if got != src {
-		t.Error("clean file must not be modified")
+
+	filePath := filepath.Join(t.TempDir(), "sample.go")
+	err := os.WriteFile(filePath, []byte(src), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(false)
+	cfg.removeUnused = true
+	verr, err := collectViolations(checkImports(filePath, cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unused []string
+	for _, v := range verr.violations {
+		if v.kind == violationUnused {
+			unused = append(unused, v.path)
+		}
+	}
+	if !slices.Equal(unused, []string{"os", "strings", "git.example.com/team/log"}) {
+		t.Errorf("unused = %q, want os, strings, and git.example.com/team/log", unused)
+	}
+
+	cfg.fix = true
+	changed, got = runOnFile(t, cfg, src)
+	if !changed {
+		t.Fatal("expected file to be reported as changed")
+	}
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
 	}
 }
 
-func TestSingleImportIsUntouched(t *testing.T) {
-	src := `package sample
+func TestFixRemovesDeclarationsWithOnlyUnusedImports(t *testing.T) {
+	src := "package sample\n\n// Doc.\nimport \"os\"\n\nimport \"fmt\"\n\nvar x = 1\n"
+	want := "package sample\n\nvar x = 1\n"
 
-import "fmt"
-`
-	changed, got := runOnFile(t, testConfig(true), src)
-	if changed {
-		t.Error("single import must not be reported as changed")
+	cfg := testConfig(true)
+	cfg.removeUnused = true
+	changed, got := runOnFile(t, cfg, src)
+	if !changed {
+		t.Fatal("expected file to be reported as changed")
 	}
-	if got != src {
-		t.Error("single import file must not be modified")
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	_, _, err := parseArgs([]string{"-internal-prefix=git.example.com/team", "-remove-unused", "-lenient-parse", "."}, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "-remove-unused cannot be combined with -lenient-parse") {
+		t.Errorf("parseArgs() error = %v, want -remove-unused rejected with -lenient-parse", err)
 	}
 }
 
-func TestFileWithoutImports(t *testing.T) {
+func TestRunAddsMissingImports(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"main.go": "package sample\n\nfunc main() {\n\tfmt.Println(strings.ToUpper(helper.Name), rand.Int())\n}\n",
+		"grouped.go": "package sample\n\nimport (\n\t\"os\"\n\n\t\"git.example.com/team/log\"\n)\n\n" +
+			"var _ = filepath.Join(os.Args[0], log.Dir)\n",
+		"helper.go": "package sample\n\nvar helper struct{ Name string }\n",
+	}
+	for name, src := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-internal-prefix=git.example.com/team", "-add-missing", "-verbose", dir}, &stdout, &stderr)
+	if code != exitIssuesFound {
+		t.Errorf("exit code = %d, want %d (stderr %q)", code, exitIssuesFound, stderr.String())
+	}
+	for _, want := range []string{
+		"main.go:4:2: \"fmt\" is used but not imported\n",
+		"main.go:4:14: \"strings\" is used but not imported\n",
+		"grouped.go:9:9: \"path/filepath\" is used but not imported\n",
+	} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("stdout = %q, want it to contain %q", stdout.String(), want)
+		}
+	}
+	if !strings.Contains(stderr.String(), "rand could be any of crypto/rand, math/rand, math/rand/v2") {
+		t.Errorf("stderr = %q, want a warning about the ambiguous rand", stderr.String())
+	}
+
+	code = run([]string{"-internal-prefix=git.example.com/team", "-add-missing", "-fix", dir}, &stdout, &stderr)
+	if code != exitOK {
+		t.Errorf("-fix exit code = %d, want %d (stderr %q)", code, exitOK, stderr.String())
+	}
+	want := map[string]string{
+		"main.go": "package sample\n\nimport (\n\t\"fmt\"\n\t\"strings\"\n)\n\n" +
+			"func main() {\n\tfmt.Println(strings.ToUpper(helper.Name), rand.Int())\n}\n",
+		"grouped.go": "package sample\n\nimport (\n\t\"os\"\n\t\"path/filepath\"\n\n\t\"git.example.com/team/log\"\n)\n\n" +
+			"var _ = filepath.Join(os.Args[0], log.Dir)\n",
+		"helper.go": files["helper.go"],
+	}
+	for name, want := range want {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s:\ngot:\n%s\nwant:\n%s", name, got, want)
+		}
+	}
+}
+
+func TestRunAddsMissingModuleImports(t *testing.T) {
+	mainSrc := "package main\n\nfunc main() {\n\tstore.Open(client.New(), kit.Version, secret.Key, errors.New(\"x\"))\n}\n"
+	want := "package main\n\nimport (\n\t\"errors\"\n\n\t\"example.com/dep/client\"\n\t\"github.com/Acme/kit\"\n\n" +
+		"\t\"example.com/app/store\"\n)\n\n" + mainSrc[len("package main\n\n"):]
+	goMod := "module example.com/app\n\nrequire (\n\texample.com/dep v1.2.0\n\tgithub.com/Acme/kit v0.1.0\n)\n"
+	// Files under $cache/ go to the module cache, the others to the module.
+	for name, files := range map[string]map[string]string{
+		"module cache": {
+			"go.mod":            goMod,
+			"nested/go.mod":     "module example.com/nested\n",
+			"nested/kit/kit.go": "package kit\n",
+			"$cache/example.com/dep@v1.2.0/client/client.go":          "package client\n",
+			"$cache/example.com/dep@v1.2.0/errors/errors.go":          "package errors\n",
+			"$cache/example.com/dep@v1.2.0/internal/secret/secret.go": "package secret\n",
+			"$cache/github.com/!acme/kit@v0.1.0/kit.go":               "package kit\n",
+		},
+		"vendor directory": {
+			"go.mod":             goMod,
+			"vendor/modules.txt": "# example.com/dep v1.2.0\n## explicit\n# github.com/Acme/kit v0.1.0\n## explicit\n",
+			"vendor/example.com/dep/client/client.go":          "package client\n",
+			"vendor/example.com/dep/internal/secret/secret.go": "package secret\n",
+			"vendor/github.com/Acme/kit/kit.go":                "package kit\n",
+			"$cache/example.com/dep@v1.2.0/other/client.go":    "package client\n",
+		},
+		"replace directory": {
+			"go.mod":                        goMod + "\nreplace example.com/dep => ./dep\n",
+			"dep/go.mod":                    "module example.com/dep\n",
+			"dep/client/client.go":          "package client\n",
+			"dep/internal/secret/secret.go": "package secret\n",
+			"$cache/example.com/dep@v1.2.0/other/client.go": "package client\n",
+			"$cache/github.com/!acme/kit@v0.1.0/kit.go":     "package kit\n",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			cache := t.TempDir()
+			t.Setenv("GOMODCACHE", cache)
+			files["main.go"] = mainSrc
+			files["store/store.go"] = "package store\n"
+			for name, src := range files {
+				path := filepath.Join(dir, filepath.FromSlash(name))
+				if rest, ok := strings.CutPrefix(name, "$cache/"); ok {
+					path = filepath.Join(cache, filepath.FromSlash(rest))
+				}
+				if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var stdout, stderr bytes.Buffer
+			code := run([]string{"-internal-prefix=example.com/app", "-add-missing", "-fix", filepath.Join(dir, "main.go")}, &stdout, &stderr)
+			if code != exitOK {
+				t.Errorf("exit code = %d, want %d (stderr %q)", code, exitOK, stderr.String())
+			}
+			got, err := os.ReadFile(filepath.Join(dir, "main.go"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestFixSplitsSpecsSharingALine(t *testing.T) {
 	src := `package sample
 
-func f() {}
+import ("os"; "github.com/pkg/errors"; "fmt")
+`
+	want := `package sample
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+)
 `
 	changed, got := runOnFile(t, testConfig(true), src)
-	if changed {
-		t.Error("file without imports must not be reported as changed")
+	if !changed {
+		t.Fatal("expected file to be reported as changed")
 	}
-	if got != src {
-		t.Error("file without imports must not be modified")
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
 	}
 }
 
-func TestValidateFlagsUnsortedGroup(t *testing.T) {
-	changed, _ := runOnFile(t, testConfig(false), misformattedSrc)
+func TestValidateFlagsSortedSpecsSharingALine(t *testing.T) {
+	src := `package sample
+
+import ("fmt"; "os")
+`
+	changed, _ := runOnFile(t, testConfig(false), src)
 	if !changed {
-		t.Error("alphabetically unsorted group must be flagged")
+		t.Error("imports sharing a line must be flagged")
 	}
 }
 
-func TestValidateAllowsCommentBetweenImports(t *testing.T) {
+func TestBlankLinesInsideParens(t *testing.T) {
 	src := `package sample
 
 import (
+
 	"fmt"
-	// os gives access to process arguments
 	"os"
+
 )
 `
-	changed, _ := runOnFile(t, testConfig(false), src)
-	if changed {
-		t.Error("comment between imports of the same group must not be flagged")
-	}
-}
+	want := `package sample
 
-func TestProcessDirectorySkipsVendor(t *testing.T) {
+import (
+	"fmt"
+	"os"
+)
+`
 	dir := t.TempDir()
-	err := os.MkdirAll(filepath.Join(dir, "vendor"), 0o750)
+	filePath := filepath.Join(dir, "sample.go")
+	err := os.WriteFile(filePath, []byte(src), 0o600)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = os.WriteFile(filepath.Join(dir, "vendor", "v.go"), []byte(misformattedSrc), 0o600)
+	verr, err := collectViolations(checkImports(filePath, testConfig(false)))
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = os.WriteFile(filepath.Join(dir, "main.go"), []byte(misformattedSrc), 0o600)
-	if err != nil {
-		t.Fatal(err)
+	if verr == nil {
+		t.Fatal("blank lines inside the parens must be flagged")
+	}
+	var kinds []violationKind
+	for _, v := range verr.violations {
+		kinds = append(kinds, v.kind)
+	}
+	if !slices.Equal(kinds, []violationKind{violationBlankAfterParen, violationBlankBeforeParen}) {
+		t.Errorf("violation kinds = %v, want [blank-after-paren blank-before-paren]", kinds)
+	}
+	if verr.violations[0].line != 4 || verr.violations[1].line != 7 {
+		t.Errorf("violation lines = %d, %d, want 4, 7", verr.violations[0].line, verr.violations[1].line)
 	}
 
-	flagged, err := processDirectory(dir, testConfig(false))
-	if err != nil {
-		t.Fatal(err)
+	changed, got := runOnFile(t, testConfig(true), src)
+	if !changed {
+		t.Fatal("expected file to be reported as changed")
 	}
-	if len(flagged) != 1 || filepath.Base(flagged[0]) != "main.go" {
-		t.Errorf("flagged = %v, want only main.go", flagged)
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+	if changed, _ := runOnFile(t, testConfig(false), got); changed {
+		t.Error("fixed output must validate cleanly")
+	}
+}
+
+func TestFixOrdersSamePathByAlias(t *testing.T) {
+	src := `package sample
+
+import (
+	zeta "git.example.com/team/pkg"
+	alpha "git.example.com/team/pkg"
+)
+`
+	want := `package sample
+
+import (
+	alpha "git.example.com/team/pkg"
+	zeta "git.example.com/team/pkg"
+)
+`
+	changed, got := runOnFile(t, testConfig(true), src)
+	if !changed {
+		t.Fatal("aliases of one path out of order must be flagged")
+	}
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestFixRemovesDuplicateImports(t *testing.T) {
+	src := `package sample
+
+import (
+	"fmt"
+	"os"
+	"fmt" // printing
+)
+`
+	want := `package sample
+
+import (
+	"fmt" // printing
+	"os"
+)
+`
+	changed, got := runOnFile(t, testConfig(true), src)
+	if !changed {
+		t.Fatal("duplicate import must be flagged")
+	}
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestPreserveSubgroups(t *testing.T) {
+	src := `package sample
+
+import (
+	"os"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/sftp"
+)
+`
+	want := `package sample
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/sftp"
+)
+`
+	cfg := testConfig(true)
+	cfg.preserveSubgroups = true
+	changed, got := runOnFile(t, cfg, src)
+	if !changed {
+		t.Fatal("expected file to be reported as changed")
+	}
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	cfg.fix = false
+	changed, _ = runOnFile(t, cfg, want)
+	if changed {
+		t.Error("sorted subgroups separated by blank lines must not be flagged")
+	}
+
+	changed, _ = runOnFile(t, testConfig(false), want)
+	if !changed {
+		t.Error("blank lines inside a group must still be flagged by default")
+	}
+}
+
+func TestStdSubgroups(t *testing.T) {
+	src := `package sample
+
+import (
+	"os/exec"
+	"net/http"
+	"fmt"
+	"net"
+	"os"
+	"context"
+
+	"github.com/pkg/errors"
+)
+`
+	want := `package sample
+
+import (
+	"context"
+	"fmt"
+
+	"net"
+	"net/http"
+
+	"os"
+	"os/exec"
+
+	"github.com/pkg/errors"
+)
+`
+	cfg := testConfig(true)
+	cfg.stdSubgroups = []string{"net", "os"}
+	changed, got := runOnFile(t, cfg, src)
+	if !changed {
+		t.Fatal("expected file to be reported as changed")
+	}
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	cfg.fix = false
+	changed, _ = runOnFile(t, cfg, want)
+	if changed {
+		t.Error("standard subgroups separated by blank lines must not be flagged")
+	}
+
+	changed, _ = runOnFile(t, testConfig(false), want)
+	if !changed {
+		t.Error("blank lines inside the standard group must be flagged without -std-subgroups")
+	}
+
+	for name, bad := range map[string]string{
+		"subgroups out of order":  "package sample\n\nimport (\n\t\"fmt\"\n\n\t\"os\"\n\n\t\"net\"\n)\n",
+		"subgroups not separated": "package sample\n\nimport (\n\t\"fmt\"\n\t\"net\"\n)\n",
+		"blank inside a subgroup": "package sample\n\nimport (\n\t\"net\"\n\n\t\"net/http\"\n)\n",
+		"blank in another group":  "package sample\n\nimport (\n\t\"fmt\"\n\n\t\"github.com/a/b\"\n\n\t\"github.com/c/d\"\n)\n",
+	} {
+		if changed, _ := runOnFile(t, cfg, bad); !changed {
+			t.Errorf("%s: expected a violation", name)
+		}
+	}
+}
+
+func TestJoinedGroups(t *testing.T) {
+	src := `package sample
+
+import (
+	"github.com/pkg/errors"
+	"os"
+
+	"git.example.com/team/lib"
+
+	"fmt"
+	"github.com/google/uuid"
+)
+`
+	want := `package sample
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"os"
+
+	"git.example.com/team/lib"
+)
+`
+	cfg := testConfig(true)
+	cfg.joined = map[importGroup]bool{externalLibrary: true}
+	changed, got := runOnFile(t, cfg, src)
+	if !changed {
+		t.Fatal("expected file to be reported as changed")
+	}
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	cfg.fix = false
+	changed, _ = runOnFile(t, cfg, want)
+	if changed {
+		t.Error("joined groups without a blank line between them must not be flagged")
+	}
+
+	for name, bad := range map[string]string{
+		"blank inside the joined block":  "package sample\n\nimport (\n\t\"fmt\"\n\n\t\"github.com/a/b\"\n)\n",
+		"joined block not sorted":        "package sample\n\nimport (\n\t\"github.com/a/b\"\n\t\"fmt\"\n)\n",
+		"no blank before the next block": "package sample\n\nimport (\n\t\"fmt\"\n\t\"git.example.com/team/lib\"\n)\n",
+	} {
+		if changed, _ := runOnFile(t, cfg, bad); !changed {
+			t.Errorf("%s: expected a violation", name)
+		}
+	}
+}
+
+func TestDisable(t *testing.T) {
+	src := `package sample
+
+import (
+	"os"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/uuid"
+	"git.example.com/team/pkg"
+)
+`
+	for name, test := range map[string]struct {
+		disable     string
+		wantChanged bool
+		want        string
+	}{
+		"sort-order and extra-blank": {
+			disable:     "sort-order,extra-blank",
+			wantChanged: true,
+			want: `package sample
+
+import (
+	"os"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/uuid"
+
+	"git.example.com/team/pkg"
+)
+`,
+		},
+		"sort-order": {
+			disable:     "sort-order",
+			wantChanged: true,
+			want: `package sample
+
+import (
+	"os"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/google/uuid"
+
+	"git.example.com/team/pkg"
+)
+`,
+		},
+		"extra-blank": {
+			disable:     "extra-blank",
+			wantChanged: true,
+			want: `package sample
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/uuid"
+
+	"git.example.com/team/pkg"
+)
+`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg, _, err := parseArgs([]string{"-internal-prefix=git.example.com/team", "-disable", test.disable, "-fix", "x.go"}, io.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.log = &logger{out: io.Discard}
+			changed, got := runOnFile(t, cfg, src)
+			if changed != test.wantChanged {
+				t.Errorf("changed = %t, want %t", changed, test.wantChanged)
+			}
+			if got != test.want {
+				t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, test.want)
+			}
+			cfg.fix = false
+			if changed, _ := runOnFile(t, cfg, got); changed {
+				t.Error("fixed output must be stable")
+			}
+		})
+	}
+
+	for _, disable := range []string{"sort", "multiple-decls", "wrong-order", "missing-blank", "layout"} {
+		_, _, err := parseArgs([]string{"-internal-prefix=git.example.com/team", "-disable", disable, "x.go"}, io.Discard)
+		if err == nil {
+			t.Errorf("-disable=%s: expected an error", disable)
+		}
+	}
+}
+
+// TestDisabledKindsAreSkippedByFix fixes a file for its misplaced internal
+// group while each disabled kind would change it further.
+func TestDisabledKindsAreSkippedByFix(t *testing.T) {
+	for kind, test := range map[violationKind]struct {
+		args      []string
+		configure func(*config)
+		imports   string
+		want      string
+		body      string
+	}{
+		violationLongLine: {
+			args:    []string{"-max-line-length=40"},
+			imports: "\t\"git.example.com/team/pkg\"\n\n\t\"os\" // a comment long enough to go past the limit\n",
+			want:    "\t\"os\" // a comment long enough to go past the limit\n\n\t\"git.example.com/team/pkg\"\n",
+		},
+		violationAlias: {
+			configure: func(cfg *config) { cfg.aliases = map[string]string{"os": "stdos"} },
+			imports:   "\t\"git.example.com/team/pkg\"\n\n\t\"os\"\n",
+			want:      "\t\"os\"\n\n\t\"git.example.com/team/pkg\"\n",
+			body:      "\nvar _ = os.Args\n",
+		},
+		violationBanned: {
+			configure: func(cfg *config) { cfg.bannedPaths = []string{"os"} },
+			imports:   "\t\"git.example.com/team/pkg\"\n\n\t\"os\"\n",
+			want:      "\t\"os\"\n\n\t\"git.example.com/team/pkg\"\n",
+		},
+		violationUnused: {
+			args:    []string{"-remove-unused"},
+			imports: "\t\"git.example.com/team/pkg\"\n\n\t\"os\"\n",
+			want:    "\t\"os\"\n\n\t\"git.example.com/team/pkg\"\n",
+			body:    "\nvar _ = pkg.Name\n",
+		},
+		violationMissing: {
+			args:    []string{"-add-missing"},
+			imports: "\t\"git.example.com/team/pkg\"\n\n\t\"os\"\n",
+			want:    "\t\"os\"\n\n\t\"git.example.com/team/pkg\"\n",
+			body:    "\nvar _ = fmt.Sprint(os.Args, pkg.Name)\n",
+		},
+	} {
+		t.Run(string(kind), func(t *testing.T) {
+			args := append([]string{"-internal-prefix=git.example.com/team", "-disable", string(kind), "-fix"}, test.args...)
+			cfg, _, err := parseArgs(append(args, "x.go"), io.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.log = &logger{out: io.Discard}
+			if test.configure != nil {
+				test.configure(&cfg)
+			}
+			src := "package sample\n\nimport (\n" + test.imports + ")\n" + test.body
+			want := "package sample\n\nimport (\n" + test.want + ")\n" + test.body
+			changed, got := runOnFile(t, cfg, src)
+			if !changed {
+				t.Error("expected the misplaced group to be fixed")
+			}
+			if got != want {
+				t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+			}
+			cfg.fix = false
+			if changed, _ := runOnFile(t, cfg, got); changed {
+				t.Error("fixed output must be stable")
+			}
+		})
+	}
+}
+
+func TestRulesSelectsViolationKinds(t *testing.T) {
+	src := `package sample
+
+import (
+	"git.example.com/team/pkg"
+
+	"os"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/uuid"
+)
+`
+	want := `package sample
+
+import (
+	"os"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/uuid"
+
+	"git.example.com/team/pkg"
+)
+`
+	cfg, _, err := parseArgs([]string{"-internal-prefix=git.example.com/team", "-rules=wrong-order", "x.go"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.log = &logger{out: io.Discard}
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "sample.go")
+	err = os.WriteFile(filePath, []byte(src), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verr, err := collectViolations(checkImports(filePath, cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verr == nil {
+		t.Fatal("expected the internal import to be flagged")
+	}
+	for _, v := range verr.violations {
+		if v.kind != violationWrongOrder {
+			t.Errorf("violation %q of kind %s, want only %s", v, v.kind, violationWrongOrder)
+		}
+	}
+
+	cfg.fix = true
+	changed, got := runOnFile(t, cfg, src)
+	if !changed {
+		t.Fatal("expected file to be reported as changed")
+	}
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	_, _, err = parseArgs([]string{"-internal-prefix=git.example.com/team", "-rules=sort", "x.go"}, io.Discard)
+	if err == nil {
+		t.Error("-rules=sort: expected an error")
+	}
+}
+
+func TestFixKeepsCommentAboveImportBlock(t *testing.T) {
+	want := `package sample
+
+// Imports used by the sample.
+import (
+	"fmt"
+	"os"
+)
+`
+	for name, src := range map[string]string{
+		"attached comment": "package sample\n\n// Imports used by the sample.\nimport (\n\t\"os\"\n\t\"fmt\"\n)\n",
+		"merged decls":     "package sample\n\n// Imports used by the sample.\nimport \"os\"\nimport \"fmt\"\n",
+	} {
+		changed, got := runOnFile(t, testConfig(true), src)
+		if !changed {
+			t.Errorf("%s: expected file to be reported as changed", name)
+		}
+		if got != want {
+			t.Errorf("%s: fixed content mismatch\ngot:\n%s\nwant:\n%s", name, got, want)
+		}
+	}
+
+	// A comment separated from the block by a blank line is not its doc
+	// comment and keeps its distance.
+	src := "package sample\n\n// Code generated by hand.\n\nimport (\n\t\"os\"\n\t\"fmt\"\n)\n"
+	_, got := runOnFile(t, testConfig(true), src)
+	if want := "package sample\n\n// Code generated by hand.\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n"; got != want {
+		t.Errorf("detached comment: fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestBuildTaggedVariantsAreFixedIndependently(t *testing.T) {
+	dir := t.TempDir()
+	variants := map[string]struct{ src, want string }{
+		"foo_linux.go": {
+			src:  "//go:build linux\n\npackage sample\n\nimport (\n\t\"syscall\"\n\t\"golang.org/x/sys/unix\"\n\t\"os\"\n)\n",
+			want: "//go:build linux\n\npackage sample\n\nimport (\n\t\"os\"\n\t\"syscall\"\n\n\t\"golang.org/x/sys/unix\"\n)\n",
+		},
+		"foo_windows.go": {
+			src:  "//go:build windows\n\npackage sample\n\nimport (\n\t\"golang.org/x/sys/windows\"\n\t\"os\"\n)\n",
+			want: "//go:build windows\n\npackage sample\n\nimport (\n\t\"os\"\n\n\t\"golang.org/x/sys/windows\"\n)\n",
+		},
+	}
+	for name, v := range variants {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(v.src), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	flagged, err := processDirectory(dir, testConfig(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flagged) != len(variants) {
+		t.Errorf("fixed %d files, want %d", len(flagged), len(variants))
+	}
+	for name, v := range variants {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != v.want {
+			t.Errorf("%s mismatch\ngot:\n%s\nwant:\n%s", name, got, v.want)
+		}
+	}
+}
+
+func TestBuildLineAboveImportBlock(t *testing.T) {
+	// Generated code sometimes carries a //go:build line between the package
+	// clause and the imports. It must not shift the reported positions of
+	// the imports below it. On fix the line stays where it is: moving it to
+	// the top of the file is gofmt's business, not this tool's.
+	src := `package sample
+
+//go:build ignore
+import (
+	"os"
+	"fmt"
+)
+
+var _ = fmt.Sprint(os.Args)
+`
+	want := `package sample
+
+//go:build ignore
+import (
+	"fmt"
+	"os"
+)
+
+var _ = fmt.Sprint(os.Args)
+`
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "gen.go")
+	err := os.WriteFile(filePath, []byte(src), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var verr *violationError
+	if err := checkImports(filePath, testConfig(false)); !errors.As(err, &verr) {
+		t.Fatalf("checkImports = %v, want *violationError", err)
+	}
+	if len(verr.violations) != 1 || verr.violations[0].kind != violationSortOrder || verr.violations[0].line != 6 {
+		t.Errorf("violations = %v, want one sort-order violation on line 6", verr.violations)
+	}
+
+	changed, got := runOnFile(t, testConfig(true), src)
+	if !changed {
+		t.Fatal("expected file to be reported as changed")
+	}
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	src := `package sample
+
+import (
+	"fmt"
+
+	pkgerrors "github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	v1 "k8s.io/api/core/v1"
+)
+
+func f() error {
+	var p v1.Pod
+	fmt.Println(p, yaml.Marshal)
+
+	return pkgerrors.New("x")
+}
+
+func g() {
+	v1 := struct{ Pod int }{}
+	_ = v1.Pod
+}
+`
+	want := `package sample
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func f() error {
+	var p corev1.Pod
+	fmt.Println(p, yaml.Marshal)
+
+	return errors.New("x")
+}
+
+func g() {
+	v1 := struct{ Pod int }{}
+	_ = v1.Pod
+}
+`
+	cfg := testConfig(false)
+	cfg.aliases = map[string]string{
+		"k8s.io/api/core/v1":    "corev1",
+		"github.com/pkg/errors": "",
+		"gopkg.in/yaml.v3":      "yaml",
+	}
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "sample.go")
+	err := os.WriteFile(filePath, []byte(src), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verr, err := collectViolations(checkImports(filePath, cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verr == nil || len(verr.violations) != 3 {
+		t.Fatalf("violations = %v, want three alias violations", verr)
+	}
+	if got := verr.violations[2].String(); got != `"k8s.io/api/core/v1" should be imported as corev1` {
+		t.Errorf("message = %q", got)
+	}
+
+	cfg.fix = true
+	changed, got := runOnFile(t, cfg, src)
+	if !changed {
+		t.Fatal("expected file to be reported as changed")
+	}
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestAliasConflictIsOnlyWarned(t *testing.T) {
+	src := `package sample
+
+import (
+	"log"
+
+	zlog "github.com/rs/zerolog/log"
+)
+`
+	var stderr bytes.Buffer
+	cfg := testConfig(false)
+	cfg.log = &logger{out: &stderr}
+	cfg.aliases = map[string]string{"github.com/rs/zerolog/log": "log"}
+	changed, _ := runOnFile(t, cfg, src)
+	if changed {
+		t.Error("an alias that cannot be applied must not be flagged")
+	}
+	if !strings.Contains(stderr.String(), `cannot import "github.com/rs/zerolog/log" as log`) {
+		t.Errorf("stderr = %q, want a conflict warning", stderr.String())
+	}
+}
+
+func TestAliasShadowedByDeclarationIsOnlyWarned(t *testing.T) {
+	src := `package sample
+
+import "strings"
+
+func f(str string) string { return strings.ToUpper(str) }
+`
+	var stderr bytes.Buffer
+	cfg := testConfig(true)
+	cfg.log = &logger{out: &stderr}
+	cfg.aliases = map[string]string{"strings": "str"}
+	changed, got := runOnFile(t, cfg, src)
+	if changed || got != src {
+		t.Errorf("an alias the file declares must not be applied, got:\n%s", got)
+	}
+	if !strings.Contains(stderr.String(), `cannot import "strings" as str: the name is declared in the file`) {
+		t.Errorf("stderr = %q, want a shadowing warning", stderr.String())
+	}
+}
+
+func TestAliasRules(t *testing.T) {
+	src := `package sample
+
+import (
+	v1 "k8s.io/api/apps/v1"
+	v1beta1 "k8s.io/api/batch/v1beta1"
+	core "k8s.io/api/core/v1"
+)
+
+var (
+	_ v1.Deployment
+	_ v1beta1.CronJob
+	_ core.Pod
+)
+`
+	want := `package sample
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	v1 "k8s.io/api/core/v1"
+)
+
+var (
+	_ appsv1.Deployment
+	_ batchv1beta1.CronJob
+	_ v1.Pod
+)
+`
+	fc := fileConfig{AliasRules: []aliasRule{{Pattern: `^k8s\.io/api/([a-z]+)/(v[0-9a-z]+)$`, Alias: "$1$2"}}}
+	patterns, err := fc.aliasPatterns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(false)
+	cfg.internalPrefixes = []string{"k8s.io"}
+	cfg.aliasPatterns = patterns
+	// An exact alias wins over the rules, even after apps/v1 gave up v1.
+	cfg.aliases = map[string]string{"k8s.io/api/core/v1": "v1"}
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "sample.go")
+	err = os.WriteFile(filePath, []byte(src), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verr, err := collectViolations(checkImports(filePath, cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verr == nil || len(verr.violations) != 3 {
+		t.Fatalf("violations = %v, want three alias violations", verr)
+	}
+	if got := verr.violations[1].String(); got != `"k8s.io/api/batch/v1beta1" should be imported as batchv1beta1` {
+		t.Errorf("message = %q", got)
+	}
+
+	cfg.fix = true
+	changed, got := runOnFile(t, cfg, src)
+	if !changed {
+		t.Fatal("expected file to be reported as changed")
+	}
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestAliasRuleConflictsAreWarned(t *testing.T) {
+	src := `package sample
+
+import (
+	"example.com/billing/api/v1"
+	"example.com/users/api/v1"
+)
+`
+	for _, tt := range []struct {
+		name    string
+		rule    aliasRule
+		warning string
+	}{
+		{
+			name:    "same alias",
+			rule:    aliasRule{Pattern: `/api/(v[0-9]+)$`, Alias: "api$1"},
+			warning: `cannot import "example.com/users/api/v1" as apiv1: the name is already used by another import`,
+		},
+		{
+			name:    "invalid alias",
+			rule:    aliasRule{Pattern: `^example\.com/([a-z]+)/api/v1$`, Alias: "1$1"},
+			warning: `the alias rule for "example.com/billing/api/v1" gives "1billing", which is not a valid alias`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			patterns, err := fileConfig{AliasRules: []aliasRule{tt.rule}}.aliasPatterns()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var stderr bytes.Buffer
+			cfg := testConfig(false)
+			cfg.log = &logger{out: &stderr}
+			cfg.aliasPatterns = patterns
+			runOnFile(t, cfg, src)
+			if !strings.Contains(stderr.String(), tt.warning) {
+				t.Errorf("stderr = %q, want %q", stderr.String(), tt.warning)
+			}
+		})
+	}
+}
+
+func TestWarnsAboutInternalPathSpellings(t *testing.T) {
+	src := `package sample
+
+import (
+	"github.com/Acme/api/client"
+
+	"acme.dev/api/store"
+	"acme.dev/api/x/store"
+	"github.com/acme/api/store"
+	"github.com/acme/app/tools/lint"
+	"github.com/acme/tools/lint"
+)
+`
+	mod, err := parseGoMod(`module github.com/acme/app
+
+require (
+	acme.dev/api v1.2.0
+	github.com/Acme/api v1.0.0
+	github.com/acme/api v1.2.0
+	github.com/acme/tools v0.0.0
+)
+
+replace acme.dev/api => github.com/acme/api v1.2.0
+
+replace github.com/acme/tools => ./tools
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mod.path = "go.mod"
+	var stderr bytes.Buffer
+	cfg := testConfig(false)
+	cfg.internalPrefixes = []string{"github.com/acme/api", "acme.dev/api", "acme.dev/api/x", "github.com/acme/app"}
+	cfg.module = mod
+	cfg.log = &logger{out: &stderr}
+	runOnFile(t, cfg, src)
+	want := []string{
+		`:4: "github.com/Acme/api/client" is spelled differently from -internal-prefix github.com/acme/api; did you mean "github.com/acme/api/client"?`,
+		`:6: "acme.dev/api/store" and "github.com/acme/api/store" (line 8) spell the same package, as go.mod replaces acme.dev/api with github.com/acme/api`,
+		`:10: "github.com/acme/tools/lint" and "github.com/acme/app/tools/lint" (line 9) spell the same package, as go.mod replaces github.com/acme/tools with github.com/acme/app/tools`,
+	}
+	got := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+	if len(got) != len(want) {
+		t.Fatalf("stderr = %q, want %d warnings", stderr.String(), len(want))
+	}
+	for i := range want {
+		if !strings.HasSuffix(got[i], want[i]) {
+			t.Errorf("warning %d = %q, want it to end in %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestNoSpellingWarningForPrefixesSharingASubpath(t *testing.T) {
+	src := `package sample
+
+import (
+	"git.example.com/api/config"
+	"git.example.com/web/config"
+)
+`
+	mod, err := parseGoMod("module git.example.com/web\n\nrequire git.example.com/api v0.0.0\n\nreplace git.example.com/api => ../api\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	cfg := testConfig(false)
+	cfg.internalPrefixes = []string{"git.example.com/api", "git.example.com/web"}
+	cfg.module = mod
+	cfg.log = &logger{out: &stderr}
+	runOnFile(t, cfg, src)
+	if stderr.Len() > 0 {
+		t.Errorf("stderr = %q, want no warnings", stderr.String())
+	}
+}
+
+func TestSuggestWarnsAboutPossiblyInternalImports(t *testing.T) {
+	src := `package sample
+
+import (
+	"fmt"
+
+	"github.com/acme/tools"
+	"github.com/pkg/errors"
+
+	"github.com/acme/api/client"
+)
+`
+	var stderr bytes.Buffer
+	cfg := testConfig(false)
+	cfg.internalPrefixes = []string{"github.com/acme/api"}
+	cfg.log = &logger{out: &stderr}
+	runOnFile(t, cfg, src)
+	if stderr.Len() != 0 {
+		t.Errorf("stderr = %q, want no warnings without -suggest", stderr.String())
+	}
+
+	cfg.suggest = true
+	changed, _ := runOnFile(t, cfg, src)
+	if changed {
+		t.Error("a suggestion must not be flagged as a violation")
+	}
+	want := `"github.com/acme/tools" is grouped as external but shares github.com/acme/ with -internal-prefix github.com/acme/api`
+	if !strings.Contains(stderr.String(), want) {
+		t.Errorf("stderr = %q, want it to contain %q", stderr.String(), want)
+	}
+	if strings.Contains(stderr.String(), "github.com/pkg/errors") {
+		t.Errorf("stderr = %q, want no warning for an unrelated import", stderr.String())
+	}
+}
+
+func TestFixNormalizesBlankLinesAroundImports(t *testing.T) {
+	want := `package sample
+
+import (
+	"fmt"
+	"os"
+)
+
+var _ = fmt.Sprint(os.Args)
+`
+	for name, src := range map[string]string{
+		"double blank after package": "package sample\n\n\nimport (\n\t\"os\"\n\t\"fmt\"\n)\n\nvar _ = fmt.Sprint(os.Args)\n",
+		"triple blank after package": "package sample\n\n\n\nimport (\n\t\"os\"\n\t\"fmt\"\n)\n\nvar _ = fmt.Sprint(os.Args)\n",
+		"no blank after package":     "package sample\nimport (\n\t\"os\"\n\t\"fmt\"\n)\n\nvar _ = fmt.Sprint(os.Args)\n",
+		"blank line at the top":      "\n\npackage sample\n\nimport (\n\t\"os\"\n\t\"fmt\"\n)\n\nvar _ = fmt.Sprint(os.Args)\n",
+		"no blank after imports":     "package sample\n\nimport (\n\t\"os\"\n\t\"fmt\"\n)\nvar _ = fmt.Sprint(os.Args)\n",
+		"double blank after imports": "package sample\n\nimport (\n\t\"os\"\n\t\"fmt\"\n)\n\n\nvar _ = fmt.Sprint(os.Args)\n",
+		"triple blank after imports": "package sample\n\nimport (\n\t\"os\"\n\t\"fmt\"\n)\n\n\n\nvar _ = fmt.Sprint(os.Args)\n",
+		"merged decls without gaps":  "package sample\nimport \"os\"\nimport \"fmt\"\nvar _ = fmt.Sprint(os.Args)\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, got := runOnFile(t, testConfig(true), src)
+			if got != want {
+				t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestMaxLineLengthMovesLongComments(t *testing.T) {
+	src := `package sample
+
+import (
+	"fmt" // short
+	errs "github.com/pkg/errors" // wraps errors with stack traces for the HTTP layer
+)
+`
+	want := `package sample
+
+import (
+	"fmt" // short
+
+	// wraps errors with stack traces for the HTTP layer
+	errs "github.com/pkg/errors"
+)
+`
+	cfg := testConfig(false)
+	cfg.maxLineLength = 60
+	changed, _ := runOnFile(t, cfg, src)
+	if !changed {
+		t.Fatal("overly long import line must be flagged")
+	}
+
+	cfg.fix = true
+	_, got := runOnFile(t, cfg, src)
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	changed, _ = runOnFile(t, cfg, want)
+	if changed {
+		t.Error("fixed output must be stable")
+	}
+}
+
+func TestNosortDirectiveKeepsSourceOrder(t *testing.T) {
+	src := `package sample
+
+import (
+	//import-tidy:nosort
+
+	_ "github.com/lib/zdriver"
+	"os"
+	_ "github.com/lib/adriver"
+	"fmt"
+)
+`
+	want := `package sample
+
+import (
+	//import-tidy:nosort
+	"os"
+	"fmt"
+
+	_ "github.com/lib/zdriver"
+	_ "github.com/lib/adriver"
+)
+`
+	_, got := runOnFile(t, testConfig(true), src)
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	changed, _ := runOnFile(t, testConfig(false), want)
+	if changed {
+		t.Error("unsorted imports in a nosort block must not be flagged")
+	}
+}
+
+func TestBlankImportsKeepSourceOrder(t *testing.T) {
+	src := `package sample
+
+import (
+	_ "github.com/lib/zdriver"
+	"github.com/pkg/errors"
+	_ "github.com/lib/adriver"
+	"github.com/google/uuid"
+)
+`
+	want := `package sample
+
+import (
+	"github.com/google/uuid"
+	_ "github.com/lib/zdriver"
+	_ "github.com/lib/adriver"
+	"github.com/pkg/errors"
+)
+`
+	_, got := runOnFile(t, testConfig(true), src)
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	changed, _ := runOnFile(t, testConfig(false), want)
+	if changed {
+		t.Error("blank imports in source order must not be flagged")
+	}
+
+	// As gofmt and goimports leave them: sorted among the others.
+	gofmted := "package sample\n\nimport (\n\t_ \"embed\"\n\t\"fmt\"\n)\n"
+	changed, _ = runOnFile(t, testConfig(false), gofmted)
+	if changed {
+		t.Error("a gofmt-sorted blank import must not be flagged")
+	}
+	changed, got = runOnFile(t, testConfig(true), "package sample\n\nimport (\n\t\"fmt\"\n\t_ \"embed\"\n)\n")
+	if !changed || got != gofmted {
+		t.Errorf("changed = %t, got:\n%s\nwant the blank import sorted:\n%s", changed, got, gofmted)
+	}
+
+	cfg := testConfig(true)
+	cfg.blankImports = blankImportsSort
+	_, got = runOnFile(t, cfg, src)
+	want = `package sample
+
+import (
+	"github.com/google/uuid"
+	_ "github.com/lib/adriver"
+	_ "github.com/lib/zdriver"
+	"github.com/pkg/errors"
+)
+`
+	if got != want {
+		t.Errorf("-blank-imports=sort: fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestInternalSortByDepth(t *testing.T) {
+	src := `package sample
+
+import (
+	"git.example.com/team/app/internal/db"
+	"git.example.com/team/api"
+	"git.example.com/team"
+	"git.example.com/team/app"
+	"os"
+	"fmt"
+)
+`
+	want := `package sample
+
+import (
+	"fmt"
+	"os"
+
+	"git.example.com/team"
+	"git.example.com/team/api"
+	"git.example.com/team/app"
+	"git.example.com/team/app/internal/db"
+)
+`
+	cfg := testConfig(true)
+	cfg.internalSort = internalSortDepth
+	_, got := runOnFile(t, cfg, src)
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	cfg.fix = false
+	changed, _ := runOnFile(t, cfg, `package sample
+
+import (
+	"git.example.com/team/zeta"
+	"git.example.com/team/alpha/beta"
+)
+`)
+	if changed {
+		t.Error("shallower internal import before a deeper one must not be flagged")
+	}
+}
+
+func TestSortUpperFirst(t *testing.T) {
+	src := `package sample
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"bitbucket.org/acme/util"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"github.com/Masterminds/semver"
+)
+`
+	want := `package sample
+
+import (
+	"github.com/BurntSushi/toml"
+	"github.com/Masterminds/semver"
+	"bitbucket.org/acme/util"
+	"github.com/aws/aws-sdk-go/aws"
+	"gopkg.in/yaml.v3"
+)
+`
+	cfg := testConfig(true)
+	cfg.sort = sortUpperFirst
+	_, got := runOnFile(t, cfg, src)
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	cfg.fix = false
+	if changed, _ := runOnFile(t, cfg, want); changed {
+		t.Error("upper-first order must not be flagged under -sort=upper-first")
+	}
+	if changed, _ := runOnFile(t, testConfig(false), want); !changed {
+		t.Error("upper-first order must be flagged under the default sort")
+	}
+}
+
+func TestFixSpellsPathLiteralsCanonically(t *testing.T) {
+	// A raw string and an escaped path keep naming the same package, spelled
+	// canonically, as gofmt does.
+	src := "package sample\n\nimport (\n\t\"\\x6fs\"\n\t`fmt`\n\t\"github.com/pkg/errors\"\n)\n"
+	want := `package sample
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+)
+`
+
+	changed, got := runOnFile(t, testConfig(true), src)
+	if !changed {
+		t.Fatal("expected file to be reported as changed")
+	}
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestFixCustomOrderKeepsAllImports(t *testing.T) {
+	order, err := parseImportOrder("standard,internal", defaultGroups, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(true)
+	cfg.groupOrder = order
+
+	src := `package sample
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"git.example.com/team/pkg"
+)
+`
+	_, got := runOnFile(t, cfg, src)
+	if !strings.Contains(got, `"github.com/pkg/errors"`) {
+		t.Fatalf("external import was dropped:\n%s", got)
+	}
+}
+
+func TestImportAfterDeclarationIsAnError(t *testing.T) {
+	src := `package sample
+
+var answer = 42
+
+import (
+	"os"
+	"fmt"
+)
+`
+	filePath := filepath.Join(t.TempDir(), "sample.go")
+	err := os.WriteFile(filePath, []byte(src), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var perr *parseError
+	err = checkImports(filePath, testConfig(true))
+	if !errors.As(err, &perr) || !strings.Contains(err.Error(), "imports must appear before other declarations") {
+		t.Fatalf("checkImports() = %v, want a parse error about import placement", err)
+	}
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != src {
+		t.Error("file with misplaced imports must not be modified")
+	}
+}
+
+func TestBlankLineAfterImportDecl(t *testing.T) {
+	want := "package sample\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\nfunc main() { fmt.Println(os.Args) }\n"
+	for name, src := range map[string]string{
+		"none":  "package sample\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\nfunc main() { fmt.Println(os.Args) }\n",
+		"three": "package sample\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\n\n\nfunc main() { fmt.Println(os.Args) }\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), "sample.go")
+			err := os.WriteFile(filePath, []byte(src), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verr, err := collectViolations(checkImports(filePath, testConfig(false)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if verr == nil || len(verr.violations) != 1 || verr.violations[0].kind != violationBlankAfterDecl || verr.violations[0].line != 7 {
+				t.Fatalf("violations = %v, want blank-after-decl on line 7", verr)
+			}
+
+			changed, got := runOnFile(t, testConfig(true), src)
+			if !changed || got != want {
+				t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestFixToolsFile(t *testing.T) {
+	const header = "//go:build tools\n\n// Package tools pins the versions of build tools.\npackage tools\n\n"
+	for name, test := range map[string]struct {
+		src, want string
+	}{
+		"tidy": {
+			src: header + "import (\n\t_ \"github.com/golangci/golangci-lint/cmd/golangci-lint\"\n\t_ \"golang.org/x/tools/cmd/stringer\"\n)\n",
+		},
+		"single import in parentheses": {
+			src:  header + "import (\n\t_ \"golang.org/x/tools/cmd/stringer\"\n)\n",
+			want: header + "import _ \"golang.org/x/tools/cmd/stringer\"\n",
+		},
+		"single import": {
+			src: header + "import _ \"golang.org/x/tools/cmd/stringer\"\n",
+		},
+		"no trailing newline": {
+			src: header + "import _ \"golang.org/x/tools/cmd/stringer\"",
+		},
+		"trailing blank lines": {
+			src:  header + "import _ \"golang.org/x/tools/cmd/stringer\"\n\n\n",
+			want: header + "import _ \"golang.org/x/tools/cmd/stringer\"\n",
+		},
+		"separate declarations": {
+			src:  header + "import _ \"golang.org/x/tools/cmd/stringer\"\nimport _ \"github.com/golangci/golangci-lint/cmd/golangci-lint\"\n",
+			want: header + "import (\n\t_ \"golang.org/x/tools/cmd/stringer\"\n\t_ \"github.com/golangci/golangci-lint/cmd/golangci-lint\"\n)\n",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			want := cmp.Or(test.want, test.src)
+			changed, got := runOnFile(t, testConfig(true), test.src)
+			if changed != (want != test.src) {
+				t.Errorf("changed = %t, want %t", changed, want != test.src)
+			}
+			if got != want {
+				t.Errorf("fixed content mismatch\ngot:\n%q\nwant:\n%q", got, want)
+			}
+			if changed, _ := runOnFile(t, testConfig(false), got); changed {
+				t.Error("fixed output must pass check")
+			}
+		})
+	}
+}
+
+// TestCheckAgreesWithFix holds check and fix to one standard: a file check
+// passes is one fix leaves alone, a file check flags is one fix changes,
+// and a fixed file passes check and is left alone by a second fix. The
+// shortcut of the layout check must agree with splicing, too.
+func TestCheckAgreesWithFix(t *testing.T) {
+	corpus := map[string]string{
+		"tidy":                  "package p\n\nimport (\n\t\"fmt\"\n\t\"os\"\n\n\t\"github.com/x/y\"\n\n\t\"git.example.com/team/z\"\n)\n",
+		"unsorted":              misformattedSrc,
+		"single in parens":      "package p\n\nimport (\n\t\"fmt\"\n)\n\nvar _ = fmt.Println\n",
+		"single doc in parens":  "package p\n\nimport (\n\t// doc\n\t\"fmt\"\n)\n",
+		"no blank before":       "package p\nimport \"fmt\"\n",
+		"no blank after":        "package p\n\nimport \"fmt\"\nvar _ = fmt.Println\n",
+		"two blanks before":     "package p\n\n\nimport \"fmt\"\n",
+		"two blanks after":      "package p\n\nimport \"fmt\"\n\n\nvar x = 1\n",
+		"blank lines at top":    "\n\npackage p\n\nimport \"fmt\"\n",
+		"two blanks between":    "package p\n\nimport (\n\t\"fmt\"\n\n\n\t\"github.com/x/y\"\n)\n",
+		"space indent":          "package p\n\nimport (\n    \"fmt\"\n    \"os\"\n)\n",
+		"alias spacing":         "package p\n\nimport (\n\tf   \"fmt\"\n\t\"os\"\n)\n",
+		"misaligned comments":   "package p\n\nimport (\n\t\"fmt\" // a\n\t\"os\"     // b\n)\n",
+		"comment after lparen":  "package p\n\nimport ( // c\n\t\"fmt\"\n\t\"os\"\n)\n",
+		"comment before rparen": "package p\n\nimport (\n\t\"fmt\"\n\t// end\n)\n",
+		"comment after rparen":  "package p\n\nimport (\n\t\"fmt\"\n) // c\n",
+		"floating comment":      "package p\n\nimport (\n\t\"fmt\"\n\n\t// floating\n\n\t\"os\"\n)\n",
+		"duplicate":             "package p\n\nimport (\n\t\"fmt\"\n\t\"fmt\"\n)\n",
+		"blank import":          "package p\n\nimport (\n\t_ \"embed\"\n\t\"fmt\"\n)\n",
+		"lone blank import":     "package p\n\nimport _ \"embed\"\n",
+		"nosort":                "package p\n\nimport (\n\t//import-tidy:nosort\n\t\"os\"\n\t\"fmt\"\n)\n",
+		"split subgroup":        "package p\n\nimport (\n\t\"fmt\"\n\n\t\"os\"\n)\n",
+		"crlf":                  "package p\r\n\r\nimport (\r\n\t\"fmt\"\r\n\t\"os\"\r\n)\r\n",
+		"crlf unsorted":         "package p\r\n\r\nimport (\r\n\t\"os\"\r\n\t\"fmt\"\r\n)\r\n",
+		"no newline at end":     "package p\n\nimport \"fmt\"",
+		"long comment":          "package p\n\nimport (\n\t\"fmt\" // a comment long enough to go past the limit\n\t\"os\"\n)\n",
+		"multiple decls":        "package p\n\nimport \"os\"\n\nimport \"fmt\"\n",
+		"tidy with code":        "package p\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\nvar _ = fmt.Println\n",
+		"decl doc":              "package p\n\n// doc\nimport \"fmt\"\n\nvar _ = fmt.Println\n",
+		"mixed line endings":    "package p\r\n\nimport \"fmt\"\n\nvar _ = fmt.Println\r\n",
+		"code after decl":       "package p\n\nimport \"fmt\"; var x = 1\n\nvar y = 2\n",
+		"multiple decls doc":    "package p\n\nimport \"os\"\n\n// doc\nimport \"fmt\"\n",
+		"tab before comment":    "package p\n\nimport (\n\t\"fmt\"\t// a\n\t\"os\"\n)\n",
+		"trailing space":        "package p\n\nimport (\n\t\"fmt\" \n\t\"os\"\n)\n",
+		"long lint directive":   "package p\n\nimport (\n\t\"fmt\" //nolint:depguard // long enough to go past the limit\n\t\"os\"\n)\n",
+		"mixed case":            "package p\n\nimport (\n\t\"github.com/acme/x\"\n\t\"github.com/Azure/y\"\n\t\"github.com/acme-corp/z\"\n)\n",
+		"code after rparen":     "package p\n\nimport (\n\t\"fmt\"\n); var x = 1\n",
+		"crlf shared line":      "package p; import \"fmt\"\r\n\r\nvar x = 1\r\n",
+	}
+	configs := map[string]func(*config){
+		"default":            func(*config) {},
+		"joined":             func(cfg *config) { cfg.joined = map[importGroup]bool{externalLibrary: true} },
+		"preserve-subgroups": func(cfg *config) { cfg.preserveSubgroups = true },
+		"std-subgroups":      func(cfg *config) { cfg.stdSubgroups = []string{"os"} },
+		"upper-first":        func(cfg *config) { cfg.sort = sortUpperFirst },
+		"case-insensitive":   func(cfg *config) { cfg.sort = sortCaseInsensitive },
+		"segments":           func(cfg *config) { cfg.sort = sortSegments },
+		"sort none":          func(cfg *config) { cfg.sort = sortNone },
+		"blank-imports=sort": func(cfg *config) { cfg.blankImports = blankImportsSort },
+		"max-line-length":    func(cfg *config) { cfg.maxLineLength = 40 },
+		"parenthesize":       func(cfg *config) { cfg.parenthesize = map[string]bool{parenthesizeBlank: true} },
+		"assume-gofmt":       func(cfg *config) { cfg.assumeGofmt = true },
+	}
+	check := func(cfg config, src []byte) (flagged bool, fixed []byte) {
+		t.Helper()
+		fsys := &stdinFS{name: "p.go", data: src}
+		verr, err := collectViolations(checkFile(fsys, fsys.name, cfg))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return verr != nil, fsys.written
+	}
+
+	for configName, configure := range configs {
+		for name, src := range corpus {
+			t.Run(configName+"/"+name, func(t *testing.T) {
+				cfg := testConfig(true)
+				configure(&cfg)
+				file, err := loadSourceFile(&stdinFS{name: "p.go", data: []byte(src)}, "p.go", cfg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(file.imports) > 0 && file.laidOut(cfg) {
+					spliced, err := file.splice(cfg)
+					if err != nil || string(spliced) != src {
+						t.Fatalf("laidOut passes %q, but splicing gives %q (%v)", src, spliced, err)
+					}
+				}
+				flagged, fixed := check(cfg, []byte(src))
+				switch {
+				case flagged && (fixed == nil || string(fixed) == src):
+					t.Fatalf("check flags %q, but fix leaves it alone", src)
+				case !flagged && fixed != nil:
+					t.Fatalf("check passes %q, but fix rewrites it to %q", src, fixed)
+				case !flagged:
+					return
+				}
+
+				flagged, again := check(cfg, fixed)
+				if flagged {
+					t.Errorf("fix output %q does not pass check (second fix: %q)", fixed, again)
+				}
+			})
+		}
+	}
+}
+
+func TestFixKeepsCommentsAtTheEndOfTheBlock(t *testing.T) {
+	src := `package sample
+
+import (
+	"os"
+	"fmt"
+	// More imports go here.
+) // End of imports.
+`
+	want := `package sample
+
+import (
+	"fmt"
+	"os"
+	// More imports go here.
+) // End of imports.
+`
+	_, got := runOnFile(t, testConfig(true), src)
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestFixKeepsCommentAfterClosingParen(t *testing.T) {
+	tests := []struct {
+		name, src, want string
+	}{
+		{
+			name: "sorted block",
+			src:  "package sample\n\nimport (\n\t\"os\"\n\t\"fmt\"\n) // end imports\n\nvar _ = fmt.Println\n",
+			want: "package sample\n\nimport (\n\t\"fmt\"\n\t\"os\"\n) // end imports\n\nvar _ = fmt.Println\n",
+		},
+		{
+			name: "lone import keeps its parentheses",
+			src:  "package sample\n\nimport (\n\t\"fmt\"\n) // end imports\n",
+			want: "package sample\n\nimport (\n\t\"fmt\"\n) // end imports\n",
+		},
+		{
+			name: "merged into the first block",
+			src:  "package sample\n\nimport (\n\t\"os\"\n) // end imports\n\nimport \"fmt\"\n",
+			want: "package sample\n\nimport (\n\t\"fmt\"\n\t\"os\"\n) // end imports\n",
+		},
+		{
+			name: "moved from a later block",
+			src:  "package sample\n\nimport \"os\"\n\nimport (\n\t\"fmt\"\n) // end imports\n",
+			want: "package sample\n\nimport (\n\t\"fmt\"\n\t\"os\"\n) // end imports\n",
+		},
+		{
+			name: "two blocks with comments",
+			src:  "package sample\n\nimport (\n\t\"os\"\n) // system\n\nimport (\n\t\"fmt\"\n) // formatting\n",
+			want: "package sample\n\nimport (\n\t\"fmt\"\n\t\"os\"\n\t// formatting\n) // system\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed, got := runOnFile(t, testConfig(true), tt.src)
+			if got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+			if changed != (tt.src != tt.want) {
+				t.Errorf("changed = %t, want %t", changed, tt.src != tt.want)
+			}
+		})
+	}
+}
+
+func TestFixKeepsLintDirectivesWithTheirImport(t *testing.T) {
+	src := `package sample
+
+import ( //nolint:depguard // the whole block
+	"os"
+	//lint:ignore SA1019 still needed
+	"io/ioutil"
+	"fmt" //nolint:gosec
+	"github.com/pkg/errors" //nolint:depguard // a reason long enough to go past the limit
+	"github.com/google/uuid" // an ordinary comment long enough to go past the limit
+)
+`
+	want := `package sample
+
+import ( //nolint:depguard // the whole block
+	"fmt" //nolint:gosec
+	//lint:ignore SA1019 still needed
+	"io/ioutil"
+	"os"
+
+	// an ordinary comment long enough to go past the limit
+	"github.com/google/uuid"
+	"github.com/pkg/errors" //nolint:depguard // a reason long enough to go past the limit
+)
+`
+	cfg := testConfig(true)
+	cfg.maxLineLength = 60
+	_, got := runOnFile(t, cfg, src)
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	cfg.fix = false
+	if changed, _ := runOnFile(t, cfg, want); changed {
+		t.Error("fixed output is still flagged")
+	}
+}
+
+func TestAssumeGofmtParsesOnlyTheImports(t *testing.T) {
+	// The body is not valid Go, which -assume-gofmt takes on trust.
+	src := "package sample\n\nimport (\n\t\"os\"\n\t\"fmt\"\n)\n\nfunc main() {\n"
+	want := "package sample\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\nfunc main() {\n"
+
+	filePath := filepath.Join(t.TempDir(), "sample.go")
+	err := os.WriteFile(filePath, []byte(src), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var perr *parseError
+	err = checkImports(filePath, testConfig(true))
+	if !errors.As(err, &perr) {
+		t.Fatalf("without -assume-gofmt: err = %v, want a parse error", err)
+	}
+
+	cfg := testConfig(true)
+	cfg.assumeGofmt = true
+	_, got := runOnFile(t, cfg, src)
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestFixKeepsCRLFLineEndings(t *testing.T) {
+	src := "package sample\r\n\r\nimport (\r\n\t\"os\"\r\n\t\"fmt\"\r\n)\r\n\r\nvar _ = fmt.Println\r\n"
+	want := "package sample\r\n\r\nimport (\r\n\t\"fmt\"\r\n\t\"os\"\r\n)\r\n\r\nvar _ = fmt.Println\r\n"
+	_, got := runOnFile(t, testConfig(true), src)
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestOwnSourceIsTidy runs the tool over its own package.
+func TestOwnSourceIsTidy(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-internal-prefix=github.com/towiron/import-tidy", "."}, &stdout, &stderr)
+	if code != exitOK {
+		t.Errorf("exit code = %d, want %d\n%s%s", code, exitOK, stdout.String(), stderr.String())
+	}
+}
+
+func TestFixLeavesCodeOutsideImportsAlone(t *testing.T) {
+	src := `package sample
+
+import (
+	"os"
+	"fmt"  // printing
+	"strings" // joining
+)
+
+import "io"
+
+// Run is not gofmt-clean, which is for gofmt to fix.
+func Run( ) {
+    fmt.Println(strings.Join(os.Args,","))
+	var _ io.Reader
+}
+`
+	want := `package sample
+
+import (
+	"fmt" // printing
+	"io"
+	"os"
+	"strings" // joining
+)
+
+// Run is not gofmt-clean, which is for gofmt to fix.
+func Run( ) {
+    fmt.Println(strings.Join(os.Args,","))
+	var _ io.Reader
+}
+`
+	_, got := runOnFile(t, testConfig(true), src)
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestFixKeepsUnusualPathLiteralVerbatim(t *testing.T) {
+	// Not a valid module path, but a valid string literal: the parser
+	// accepts it, so it is sorted like any other import and left as is.
+	src := "package sample\n\nimport (\n\t\"os\"\n\t\"github.com/acme/my pkg\"\n\t\"fmt\"\n)\n"
+	want := "package sample\n\nimport (\n\t\"fmt\"\n\t\"os\"\n\n\t\"github.com/acme/my pkg\"\n)\n"
+	_, got := runOnFile(t, testConfig(true), src)
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestMalformedImportPathIsAParseError(t *testing.T) {
+	for name, literal := range map[string]string{
+		"unknown escape": `"github.com/acme/\q"`,
+		"unterminated":   `"github.com/acme/pkg`,
+		"not a string":   `github.com/acme/pkg`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			src := "package sample\n\nimport (\n\t\"os\"\n\t" + literal + "\n\t\"fmt\"\n)\n"
+			filePath := filepath.Join(t.TempDir(), "sample.go")
+			err := os.WriteFile(filePath, []byte(src), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = checkImports(filePath, testConfig(true))
+			var perr *parseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("checkImports() = %v, want *parseError", err)
+			}
+			if !strings.Contains(err.Error(), filePath+":5:") {
+				t.Errorf("error %q does not point at line 5", err)
+			}
+			content, err := os.ReadFile(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != src {
+				t.Errorf("file was modified:\n%s", content)
+			}
+		})
+	}
+}
+
+func TestFixKeepsCodeSharingLinesWithImports(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "package clause before the declaration",
+			src:  "package sample; import (\"os\"; \"fmt\")\n\nvar _ = fmt.Sprint(os.Args)\n",
+			want: "package sample\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\nvar _ = fmt.Sprint(os.Args)\n",
+		},
+		{
+			name: "declaration after the closing paren",
+			src:  "package sample\n\nimport (\n\t\"os\"\n\t\"fmt\"\n); var x = (\n\t1)\n",
+			want: "package sample\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\nvar x = (\n\t1)\n",
+		},
+		{
+			name: "string literal and comment after the closing paren",
+			src:  "package sample\n\nimport (\n\t\"os\"\n\t\"fmt\"\n);var s = \"a    b\" // keep  this\n",
+			want: "package sample\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\nvar s = \"a    b\" // keep  this\n",
+		},
+		{
+			name: "comment before the import keyword",
+			src:  "package sample\n\n/* c */ import \"os\"\nimport \"fmt\"\n",
+			want: "package sample\n\n/* c */\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n",
+		},
+		{
+			name: "trailing comment of a lone spec",
+			src:  "package sample\n\nimport \"os\" // files; var x = 1\nimport \"fmt\"\n",
+			want: "package sample\n\nimport (\n\t\"fmt\"\n\t\"os\" // files; var x = 1\n)\n",
+		},
+		{
+			name: "block comment after the closing paren spanning lines",
+			src:  "package sample\n\nimport (\n\t\"os\"\n\t\"fmt\"\n) /* one\ntwo */ var x = 1\n",
+			want: "package sample\n\nimport (\n\t\"fmt\"\n\t\"os\"\n) /* one\ntwo */\n\nvar x = 1\n",
+		},
+		{
+			name: "comment of a lone spec followed by code",
+			src:  "package sample\n\nimport \"os\"\nimport \"strings\" /* c */ ; var y = os.Args\n\nvar _ = strings.ToUpper\n",
+			want: "package sample\n\nimport (\n\t\"os\"\n\t\"strings\" /* c */\n)\n\nvar y = os.Args\n\nvar _ = strings.ToUpper\n",
+		},
+		{
+			name: "two declarations on one line",
+			src:  "package sample\n\nimport \"os\"; import \"fmt\"; var x = 1\n",
+			want: "package sample\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\nvar x = 1\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed, got := runOnFile(t, testConfig(true), tt.src)
+			if !changed {
+				t.Error("violations not reported")
+			}
+			if got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+			changed, _ = runOnFile(t, testConfig(false), got)
+			if changed {
+				t.Errorf("fixed file still reports violations:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestFixLeavesFileUnchangedWhenTheResultDoesNotParse(t *testing.T) {
+	// Only the first comment after ")" goes with the block; the second
+	// stays with the ";" and the code after it, which no longer parse once
+	// the ")" is gone.
+	src := "package sample\n\nimport (\n\t\"os\"\n\t\"fmt\"\n) /* a */ /* b */ ; var x = fmt.Sprint(os.Args)\n"
+	filePath := filepath.Join(t.TempDir(), "sample.go")
+	err := os.WriteFile(filePath, []byte(src), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = checkImports(filePath, testConfig(true))
+	if err == nil || !strings.Contains(err.Error(), "is not valid Go") || !strings.Contains(err.Error(), "(file left unchanged)") {
+		t.Fatalf("checkImports() = %v, want the rewrite to be refused", err)
+	}
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != src {
+		t.Errorf("file was modified:\n%s", content)
+	}
+}
+
+func TestLenientFixKeepsLinesAboveTheBlock(t *testing.T) {
+	// A partial template that opens with a blank line, which is not Go and
+	// stays.
+	src := "\nimport (\n\t\"os\"\n\t\"fmt\"\n)\n{{template \"body\" .}}\n"
+	want := "\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\n{{template \"body\" .}}\n"
+	cfg := testConfig(true)
+	cfg.lenientParse = true
+	changed, got := runOnFile(t, cfg, src)
+	if !changed {
+		t.Error("expected the template to be reported as changed")
+	}
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+	cfg.fix = false
+	if changed, _ := runOnFile(t, cfg, got); changed {
+		t.Error("fixed output must be stable")
+	}
+}
+
+func TestLenientFixVerifiesTheRewrite(t *testing.T) {
+	src := "{{/* header */}}\nimport (\n\t\"os\"\n)\n{{template \"body\" .}}\n"
+	cfg := testConfig(true)
+	cfg.lenientParse = true
+	file, err := loadSourceFile(&stdinFS{name: "imports.go.tmpl", data: []byte(src)}, "imports.go.tmpl", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for rewrite, want := range map[string]string{
+		"{{/* header */}}\nimport \"os\"\n{{template \"body\" .}}\n":                 "has no recognizable import block",
+		"{{/* header */}}\nimport (\n\t\"os\n)\n{{template \"body\" .}}\n":           "has an invalid import block",
+		"{{/* header */}}\nimport (\n\t\"os\" \"fmt\"\n)\n{{template \"body\" .}}\n": "has an invalid import block",
+	} {
+		err := file.checkParses([]byte(rewrite))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("checkParses(%q) = %v, want an error saying it %s", rewrite, err, want)
+		}
+	}
+	if err := file.checkParses([]byte(src)); err != nil {
+		t.Errorf("checkParses(original) = %v, want nil", err)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{
+			name: "equal",
+			a:    "a\nb\n",
+			b:    "a\nb\n",
+			want: "",
+		},
+		{
+			name: "swap",
+			a:    "1\n2\n3\n4\nb\na\n5\n6\n7\n8\n",
+			b:    "1\n2\n3\n4\na\nb\n5\n6\n7\n8\n",
+			want: "--- x.orig\n+++ x\n@@ -2,8 +2,8 @@\n 2\n 3\n 4\n-b\n a\n+b\n 5\n 6\n 7\n",
+		},
+		{
+			name: "insert at the start",
+			a:    "b\n",
+			b:    "a\nb\n",
+			want: "--- x.orig\n+++ x\n@@ -1,1 +1,2 @@\n+a\n b\n",
+		},
+		{
+			name: "distant changes get separate hunks",
+			a:    "a\n1\n2\n3\n4\n5\n6\n7\nb\n",
+			b:    "A\n1\n2\n3\n4\n5\n6\n7\nB\n",
+			want: "--- x.orig\n+++ x\n@@ -1,4 +1,4 @@\n-a\n+A\n 1\n 2\n 3\n@@ -6,4 +6,4 @@\n 5\n 6\n 7\n-b\n+B\n",
+		},
+		{
+			name: "missing final newline",
+			a:    "a",
+			b:    "b\n",
+			want: "--- x.orig\n+++ x\n@@ -1,1 +1,1 @@\n-a\n\\ No newline at end of file\n+b\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(unifiedDiff("x.orig", "x", []byte(tt.a), []byte(tt.b)))
+			if got != tt.want {
+				t.Errorf("diff mismatch\ngot:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInteractiveAsksBeforeWriting(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		wantFixed bool
+	}{
+		{name: "yes", input: "y\n", wantFixed: true},
+		{name: "no", input: "n\n", wantFixed: false},
+		{name: "unknown answer asks again", input: "maybe\nall\n", wantFixed: true},
+		{name: "quit", input: "q\n", wantFixed: false},
+		{name: "end of input", input: "", wantFixed: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			cfg := testConfig(true)
+			cfg.interactive = true
+			cfg.prompt = newPrompter(strings.NewReader(tt.input), &out)
+			_, got := runOnFile(t, cfg, misformattedSrc)
+			if fixed := got != misformattedSrc; fixed != tt.wantFixed {
+				t.Errorf("file rewritten = %t, want %t", fixed, tt.wantFixed)
+			}
+			for _, want := range []string{"-\t\"os\"\n", "+\t\"os\"\n", "[y]es/[n]o/[a]ll/[q]uit"} {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("output = %q, want it to contain %q", out.String(), want)
+				}
+			}
+		})
+	}
+
+	t.Run("all and quit stick", func(t *testing.T) {
+		for input, wantFixed := range map[string]bool{"a\n": true, "q\n": false} {
+			p := newPrompter(strings.NewReader(input), io.Discard)
+			p.confirm("first.go", nil, []byte("x"))
+			if got := p.confirm("second.go", nil, []byte("x")); got != wantFixed {
+				t.Errorf("after %q: second answer = %t, want %t", input, got, wantFixed)
+			}
+		}
+	})
+}
+
+func TestCheckReportsWithoutRewriting(t *testing.T) {
+	changed, got := runOnFile(t, testConfig(false), misformattedSrc)
+	if !changed {
+		t.Fatal("expected misformatted file to be reported")
+	}
+	if got != misformattedSrc {
+		t.Error("check mode must not modify the file")
+	}
+}
+
+func TestCleanFileIsUntouched(t *testing.T) {
+	src := `package sample
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"git.example.com/team/pkg"
+)
+`
+	changed, got := runOnFile(t, testConfig(true), src)
+	if changed {
+		t.Error("clean file must not be reported as changed")
+	}
+	if got != src {
+		t.Error("clean file must not be modified")
+	}
+}
+
+func TestFixDoesNotWriteCleanFile(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "clean.go")
+	err := os.WriteFile(filePath, []byte(benchmarkCleanSrc), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	err = os.Chtimes(filePath, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = checkImports(filePath, testConfig(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(old) {
+		t.Errorf("clean file was written: mtime %v, want %v", info.ModTime(), old)
+	}
+}
+
+func TestSingleImportIsUntouched(t *testing.T) {
+	src := `package sample
+
+import "fmt"
+`
+	changed, got := runOnFile(t, testConfig(true), src)
+	if changed {
+		t.Error("single import must not be reported as changed")
+	}
+	if got != src {
+		t.Error("single import file must not be modified")
+	}
+}
+
+func TestParenthesizeLoneBlankAndDotImports(t *testing.T) {
+	const (
+		blankLine  = "package sample\n\nimport _ \"embed\"\n"
+		blankBlock = "package sample\n\nimport (\n\t_ \"embed\"\n)\n"
+		dotLine    = "package sample\n\nimport . \"math\"\n"
+		dotBlock   = "package sample\n\nimport (\n\t. \"math\"\n)\n"
+		plainBlock = "package sample\n\nimport (\n\t\"fmt\"\n)\n"
+		plainLine  = "package sample\n\nimport \"fmt\"\n"
+	)
+	tests := []struct {
+		name         string
+		parenthesize string
+		src, want    string
+	}{
+		{"blank collapses by default", "", blankBlock, blankLine},
+		{"dot collapses by default", "", dotBlock, dotLine},
+		{"blank kept in block", "blank", blankBlock, blankBlock},
+		{"blank put in block", "blank", blankLine, blankBlock},
+		{"dot put in block", "dot", dotLine, dotBlock},
+		{"dot collapses without dot", "blank", dotBlock, dotLine},
+		{"plain import always collapses", "blank,dot", plainBlock, plainLine},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _, err := parseArgs([]string{"-internal-prefix=git.example.com/team", "-fix", "-parenthesize", tt.parenthesize, "."}, io.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			changed, got := runOnFile(t, cfg, tt.src)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if changed != (tt.src != tt.want) {
+				t.Errorf("changed = %t, want %t", changed, tt.src != tt.want)
+			}
+		})
+	}
+
+	_, _, err := parseArgs([]string{"-internal-prefix=git.example.com/team", "-parenthesize=alias", "."}, io.Discard)
+	if err == nil {
+		t.Error("-parenthesize=alias: expected an error")
+	}
+}
+
+func TestFileWithoutImports(t *testing.T) {
+	src := `package sample
+
+func f() {}
+`
+	changed, got := runOnFile(t, testConfig(true), src)
+	if changed {
+		t.Error("file without imports must not be reported as changed")
+	}
+	if got != src {
+		t.Error("file without imports must not be modified")
+	}
+}
+
+func TestEmptyImportBlocksAreUntouched(t *testing.T) {
+	for name, src := range map[string]string{
+		"single empty block": "package sample\n\nimport ()\n\nconst answer = 42\n",
+		"two empty blocks":   "package sample\n\nimport ()\n\nimport ()\n\nconst answer = 42\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			changed, got := runOnFile(t, testConfig(true), src)
+			if changed {
+				t.Error("file with only empty import blocks must not be reported as changed")
+			}
+			if got != src {
+				t.Error("file with only empty import blocks must not be modified")
+			}
+		})
+	}
+}
+
+func TestFixDropsEmptyBlockWhenMerging(t *testing.T) {
+	src := `package sample
+
+import ()
+
+import "fmt"
+`
+	want := `package sample
+
+import "fmt"
+`
+	changed, got := runOnFile(t, testConfig(true), src)
+	if !changed {
+		t.Fatal("expected file to be reported as changed")
+	}
+	if got != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestValidateFlagsUnsortedGroup(t *testing.T) {
+	changed, _ := runOnFile(t, testConfig(false), misformattedSrc)
+	if !changed {
+		t.Error("alphabetically unsorted group must be flagged")
+	}
+}
+
+func TestValidateFlagsReverseSortedGroup(t *testing.T) {
+	// Groups and blank lines are right; only the order inside the
+	// external group is reversed.
+	src := `package sample
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/google/uuid"
+	"github.com/BurntSushi/toml"
+
+	"git.example.com/team/pkg"
+)
+`
+	for _, sortOrder := range []string{sortASCII, sortCaseInsensitive, sortSegments, sortModuleAware, sortUpperFirst} {
+		t.Run(sortOrder, func(t *testing.T) {
+			cfg := testConfig(false)
+			cfg.sort = sortOrder
+			filePath := filepath.Join(t.TempDir(), "sample.go")
+			err := os.WriteFile(filePath, []byte(src), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var verr *violationError
+			if err := checkImports(filePath, cfg); !errors.As(err, &verr) {
+				t.Fatalf("checkImports = %v, want *violationError", err)
+			}
+			for _, v := range verr.violations {
+				if v.kind != violationSortOrder {
+					t.Errorf("violation %v, want only sort-order violations", v)
+				}
+			}
+			if len(verr.violations) != 2 {
+				t.Errorf("violations = %v, want two, on lines 7 and 8", verr.violations)
+			}
+
+			cfg.fix = true
+			_, fixed := runOnFile(t, cfg, src)
+			cfg.fix = false
+			if changed, _ := runOnFile(t, cfg, fixed); changed {
+				t.Errorf("fixed output is still flagged:\n%s", fixed)
+			}
+		})
+	}
+}
+
+func TestSortComparators(t *testing.T) {
+	src := `package sample
+
+import (
+	"github.com/acme/lib/v2"
+	"github.com/acme/lib/extra/x"
+	"github.com/acme/lib-tools"
+	"github.com/Azure/sdk"
+	"github.com/acme/lib/extra"
+	"github.com/acme/lib/zeta"
+)
+`
+	extra := &modFile{module: "git.example.com/team", require: []string{"github.com/acme/lib", "github.com/acme/lib/extra"}}
+	for _, test := range []struct {
+		sort   string
+		module *modFile
+		want   []string
+	}{
+		{sort: sortASCII, want: []string{"Azure/sdk", "acme/lib-tools", "acme/lib/extra", "acme/lib/extra/x", "acme/lib/v2", "acme/lib/zeta"}},
+		{sort: sortCaseInsensitive, want: []string{"acme/lib-tools", "acme/lib/extra", "acme/lib/extra/x", "acme/lib/v2", "acme/lib/zeta", "Azure/sdk"}},
+		{sort: sortSegments, want: []string{"Azure/sdk", "acme/lib/extra", "acme/lib/extra/x", "acme/lib/v2", "acme/lib/zeta", "acme/lib-tools"}},
+		{sort: sortModuleAware, module: extra, want: []string{"Azure/sdk", "acme/lib/v2", "acme/lib/zeta", "acme/lib/extra", "acme/lib/extra/x", "acme/lib-tools"}},
+		{sort: sortUpperFirst, want: []string{"Azure/sdk", "acme/lib-tools", "acme/lib/extra", "acme/lib/extra/x", "acme/lib/v2", "acme/lib/zeta"}},
+		{sort: sortNone, want: []string{"acme/lib/v2", "acme/lib/extra/x", "acme/lib-tools", "Azure/sdk", "acme/lib/extra", "acme/lib/zeta"}},
+	} {
+		t.Run(test.sort, func(t *testing.T) {
+			cfg := testConfig(true)
+			cfg.sort = test.sort
+			cfg.module = test.module
+			_, fixed := runOnFile(t, cfg, src)
+			var got []string
+			for line := range strings.Lines(fixed) {
+				if path, ok := strings.CutPrefix(strings.TrimSpace(line), `"github.com/`); ok {
+					got = append(got, strings.TrimSuffix(path, `"`))
+				}
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("order = %q, want %q", got, test.want)
+			}
+
+			cfg.fix = false
+			if changed, _ := runOnFile(t, cfg, fixed); changed {
+				t.Errorf("fixed output is still flagged:\n%s", fixed)
+			}
+		})
+	}
+}
+
+func TestValidateAllowsCommentBetweenImports(t *testing.T) {
+	src := `package sample
+
+import (
+	"fmt"
+	// os gives access to process arguments
+	"os"
+)
+`
+	changed, _ := runOnFile(t, testConfig(false), src)
+	if changed {
+		t.Error("comment between imports of the same group must not be flagged")
+	}
+}
+
+func TestLenientParseTidiesTemplates(t *testing.T) {
+	src := `{{/* Code generated by gen. */}}
+package {{.Package}}
+
+import (
+	"os"
+	"fmt"
+	"github.com/pkg/errors"
+)
+
+func {{.Name}}() error {
+	return errors.New(fmt.Sprint(os.Args))
+}
+`
+	want := `{{/* Code generated by gen. */}}
+package {{.Package}}
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+func {{.Name}}() error {
+	return errors.New(fmt.Sprint(os.Args))
+}
+`
+	dir := t.TempDir()
+	tmplPath := filepath.Join(dir, "handler.go.tmpl")
+	err := os.WriteFile(tmplPath, []byte(src), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "clean.go"), []byte("package sample\n\nimport \"fmt\"\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig(true)
+	cfg.extensions = []string{".go", ".go.tmpl"}
+	_, err = processDirectory(dir, cfg)
+	if !errors.Is(err, errUnchecked) {
+		t.Fatalf("without -lenient-parse: err = %v, want the template left unchecked", err)
+	}
+
+	cfg.lenientParse = true
+	flagged, err := processDirectory(dir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flagged) != 1 || flagged[0].path != tmplPath {
+		t.Fatalf("flagged = %v, want only the template", flagged)
+	}
+	got, err := os.ReadFile(tmplPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("fixed content mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Templating inside the block itself is beyond the fallback.
+	err = os.WriteFile(tmplPath, []byte("package {{.Package}}\n\nimport (\n\t{{range .Imports}}{{.}}{{end}}\n)\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = processDirectory(dir, cfg)
+	if !errors.Is(err, errUnchecked) {
+		t.Errorf("templated block: err = %v, want the template left unchecked", err)
+	}
+}
+
+func TestProcessDirectorySkipsVendor(t *testing.T) {
+	dir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(dir, "vendor"), 0o750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "vendor", "v.go"), []byte(misformattedSrc), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "main.go"), []byte(misformattedSrc), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flagged, err := processDirectory(dir, testConfig(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flagged) != 1 || filepath.Base(flagged[0].path) != "main.go" {
+		t.Errorf("flagged = %v, want only main.go", flagged)
+	}
+}
+
+func TestRunLogFormatJSON(t *testing.T) {
+	dir := t.TempDir()
+	clean := "package sample\n\nimport \"fmt\"\n"
+	for name, src := range map[string]string{"a.go": clean, "b.go": misformattedSrc, "c.go": "package sample\n\nimport (\n", "d.go": clean + strings.Repeat("\n", 100)} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-internal-prefix=git.example.com/team", "-fix", "-max-file-size=80", "-log-format=json", dir}, &stdout, &stderr)
+	if code != exitError {
+		t.Errorf("exit code = %d, want %d", code, exitError)
+	}
+
+	var events []logEvent
+	for line := range strings.Lines(stderr.String()) {
+		var event logEvent
+		err := json.Unmarshal([]byte(line), &event)
+		if err != nil {
+			t.Fatalf("stderr line %q is not JSON: %v", line, err)
+		}
+		if event.File != "" && (event.Event == "skipped") != (event.DurationMS == nil) {
+			t.Errorf("%s event for %s: duration_ms = %v", event.Event, event.File, event.DurationMS)
+		}
+		event.DurationMS = nil
+		events = append(events, event)
+	}
+	if len(events) < 4 {
+		t.Fatalf("events = %+v, want at least 4", events)
+	}
+	parseErr := events[3].Error
+	if !strings.Contains(parseErr, "c.go:3:10") {
+		t.Errorf("error = %q, want the parse error of c.go", parseErr)
+	}
+	want := []logEvent{
+		{Event: "skipped", File: filepath.Join(dir, "d.go"), Message: "129 bytes exceeds -max-file-size=80"},
+		{Event: "visited", File: filepath.Join(dir, "a.go")},
+		{Event: "changed", File: filepath.Join(dir, "b.go")},
+		{Event: "error", File: filepath.Join(dir, "c.go"), Error: parseErr},
+		// The error fails the run too.
+		{Event: "error", Error: parseErr},
+		{Event: "summary", Message: "1 file(s) fixed (sort-order: 1)"},
+	}
+	if !slices.Equal(events, want) {
+		t.Errorf("events:\n%+v\nwant:\n%+v", events, want)
+	}
+
+	_, _, err := parseArgs([]string{"-internal-prefix=git.example.com/team", "-log-format=xml", "."}, io.Discard)
+	if err == nil {
+		t.Error("-log-format=xml: expected an error")
+	}
+}
+
+func TestMaxFileSizeSkipsLargeFiles(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "big.go"), []byte(misformattedSrc), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	cfg := testConfig(false)
+	cfg.maxFileSize = int64(len(misformattedSrc) - 1)
+	cfg.log = &logger{out: &logs}
+
+	flagged, err := processDirectory(dir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flagged) != 0 {
+		t.Errorf("flagged = %v, want oversized file skipped", flagged)
+	}
+	if !strings.Contains(logs.String(), "big.go") {
+		t.Errorf("expected a notice about the skipped file, got %q", logs.String())
+	}
+
+	cfg.maxFileSize = int64(len(misformattedSrc))
+	flagged, err = processDirectory(dir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flagged) != 1 {
+		t.Errorf("flagged = %v, want file at the limit to be checked", flagged)
+	}
+}
+
+func TestRecentSyntax(t *testing.T) {
+	src := `package sample
+
+import (
+	"maps"
+	"iter"
+	"fmt"
+)
+
+type Set[T comparable] = map[T]struct{}
+
+func Keys[T comparable](s Set[T]) iter.Seq[T] {
+	return maps.Keys(s)
+}
+
+func Print() {
+	for i := range 3 {
+		fmt.Println(min(i, 1))
+	}
+	for k := range Keys(Set[string]{"a": {}}) {
+		fmt.Println(k)
+	}
+}
+`
+	changed, got := runOnFile(t, testConfig(true), src)
+	if !changed || !strings.HasPrefix(got, "package sample\n\nimport (\n\t\"fmt\"\n\t\"iter\"\n\t\"maps\"\n)\n") {
+		t.Errorf("fixed content:\n%s", got)
+	}
+}
+
+func TestRunSkipsUnparsableFiles(t *testing.T) {
+	dir := t.TempDir()
+	for name, src := range map[string]string{
+		"a.go":      misformattedSrc,
+		"future.go": "//go:build go1.999\n\npackage sample\n\nimport \"fmt\"\n\nfunc f() { fmt.Println(<>) }\n",
+		"broken.go": "//go:build go1.21\n\npackage sample\n\nimport (\n",
+		"z.go":      misformattedSrc,
+	} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-internal-prefix=git.example.com/team", dir}, &stdout, &stderr)
+	if code != exitError {
+		t.Errorf("exit code = %d, want %d", code, exitError)
+	}
+	want := "needs formatting: " + filepath.Join(dir, "a.go") + "\nneeds formatting: " + filepath.Join(dir, "z.go") + "\n"
+	if stdout.String() != want {
+		t.Errorf("stdout = %q, want %q", stdout.String(), want)
+	}
+	errs := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+	if len(errs) != 3 {
+		t.Fatalf("stderr = %q, want one error for each unparsable file and the summary", stderr.String())
+	}
+	if !strings.HasPrefix(errs[0], "Error: cannot parse "+filepath.Join(dir, "broken.go")) || strings.Contains(errs[0], "//go:build") {
+		t.Errorf("error = %q, want the parse error without a Go version hint", errs[0])
+	}
+	if !strings.HasPrefix(errs[1], "Error: cannot parse "+filepath.Join(dir, "future.go")) ||
+		!strings.HasSuffix(errs[1], "(its //go:build line requires go1.999, newer than the "+runtime.Version()+" import-tidy was built with)") {
+		t.Errorf("error = %q, want the parse error with a Go version hint", errs[1])
+	}
+}
+
+func TestRunRejectsInvalidImportPaths(t *testing.T) {
+	for name, test := range map[string]struct {
+		spec string
+		want string
+	}{
+		"empty":         {spec: `""`, want: `sample.go:5:2: invalid import path "": empty path`},
+		"control":       {spec: `"fmt\x00"`, want: `sample.go:5:2: invalid import path "fmt\x00": character '\x00' not allowed`},
+		"named, tab":    {spec: "x `a\tb`", want: "sample.go:5:4: invalid import path `a\tb`: character '\\t' not allowed"},
+		"invalid UTF-8": {spec: `"fmt\xff"`, want: `sample.go:5:2: invalid import path "fmt\xff": invalid UTF-8`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			src := "package sample\n\nimport (\n\t\"os\"\n\t" + test.spec + "\n\t\"fmt\"\n)\n"
+			path := filepath.Join(t.TempDir(), "sample.go")
+			err := os.WriteFile(path, []byte(src), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, fix := range []string{"-fix=false", "-fix"} {
+				var stdout, stderr bytes.Buffer
+				code := run([]string{"-internal-prefix=git.example.com/team", fix, path}, &stdout, &stderr)
+				if code != exitError {
+					t.Errorf("%s: exit code = %d, want %d", fix, code, exitError)
+				}
+				if !strings.Contains(stderr.String(), test.want) {
+					t.Errorf("%s: stderr = %q, want it to contain %q", fix, stderr.String(), test.want)
+				}
+			}
+			content, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != src {
+				t.Errorf("file was modified:\n%s", content)
+			}
+		})
+	}
+}
+
+func TestCheckImportsReturnsTypedErrors(t *testing.T) {
+	dir := t.TempDir()
+	badPath := filepath.Join(dir, "bad.go")
+	err := os.WriteFile(badPath, []byte("package sample\n\nimport (\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var perr *parseError
+	if err := checkImports(badPath, testConfig(false)); !errors.As(err, &perr) {
+		t.Errorf("checkImports(bad.go) = %v, want *parseError", err)
+	}
+
+	messyPath := filepath.Join(dir, "messy.go")
+	err = os.WriteFile(messyPath, []byte(misformattedSrc), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var verr *violationError
+	if err := checkImports(messyPath, testConfig(false)); !errors.As(err, &verr) {
+		t.Fatalf("checkImports(messy.go) = %v, want *violationError", err)
+	}
+	if len(verr.violations) != 1 || verr.violations[0].kind != violationSortOrder || verr.violations[0].line != 5 {
+		t.Errorf("violations = %v, want one sort-order violation on line 5", verr.violations)
+	}
+	if verr.fixed {
+		t.Error("check mode must not report the file as fixed")
+	}
+
+	if err := checkImports(filepath.Join(dir, "missing.go"), testConfig(false)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("checkImports(missing.go) = %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestRunWFixesEveryPath(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for _, name := range []string{"a.go", "sub/b.go", "c.go"} {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0o700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte(misformattedSrc), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	// -w is gofmt's name for -fix; files and directories can be mixed.
+	var stdout, stderr bytes.Buffer
+	args := []string{"-internal-prefix=git.example.com/team", "-w", paths[0], filepath.Join(dir, "sub"), paths[2]}
+	code := run(args, &stdout, &stderr)
+	if code != exitOK {
+		t.Errorf("exit code = %d, want %d (stderr %q)", code, exitOK, stderr.String())
+	}
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) == misformattedSrc {
+			t.Errorf("%s was not fixed", path)
+		}
+	}
+}
+
+func TestRunDPrintsDiffs(t *testing.T) {
+	dir := t.TempDir()
+	messy := filepath.Join(dir, "messy.go")
+	err := os.WriteFile(messy, []byte(misformattedSrc), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "clean.go"), []byte("package sample\n\nimport \"fmt\"\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-internal-prefix=git.example.com/team", "-d", dir}, &stdout, &stderr)
+	if code != exitIssuesFound {
+		t.Errorf("exit code = %d, want %d", code, exitIssuesFound)
+	}
+	want := "--- " + messy + ".orig\n+++ " + messy + "\n" +
+		"@@ -1,6 +1,6 @@\n package sample\n \n import (\n-\t\"os\"\n \t\"fmt\"\n+\t\"os\"\n )\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("stdout = %q, want %q", got, want)
+	}
+	content, err := os.ReadFile(messy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != misformattedSrc {
+		t.Errorf("-d modified the file:\n%s", content)
+	}
+
+	code = run([]string{"-internal-prefix=git.example.com/team", "-d", "-fix", dir}, &stdout, &stderr)
+	if code != exitError {
+		t.Errorf("-d with -fix exit code = %d, want %d", code, exitError)
+	}
+}
+
+func TestRunListPrintsOnlyPaths(t *testing.T) {
+	dir := t.TempDir()
+	messy := filepath.Join(dir, "messy.go")
+	err := os.WriteFile(messy, []byte(misformattedSrc), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "clean.go"), []byte("package sample\n\nimport \"fmt\"\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-internal-prefix=git.example.com/team", "-list", dir}, &stdout, &stderr)
+	if code != exitIssuesFound {
+		t.Errorf("exit code = %d, want %d", code, exitIssuesFound)
+	}
+	if got := stdout.String(); got != messy+"\n" {
+		t.Errorf("stdout = %q, want only %q", got, messy)
+	}
+
+	// -l is gofmt's name for it.
+	stdout.Reset()
+	code = run([]string{"-internal-prefix=git.example.com/team", "-l", dir}, &stdout, &stderr)
+	if code != exitIssuesFound || stdout.String() != messy+"\n" {
+		t.Errorf("-l: exit code = %d, stdout %q, want %d and only %q", code, stdout.String(), exitIssuesFound, messy)
+	}
+
+	code = run([]string{"-internal-prefix=git.example.com/team", "-list", "-fix", dir}, &stdout, &stderr)
+	if code != exitError {
+		t.Errorf("-list with -fix exit code = %d, want %d", code, exitError)
+	}
+}
+
+func TestRunCountPrintsOnlyTheNumber(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.go", "b.go"} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(misformattedSrc), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.WriteFile(filepath.Join(dir, "clean.go"), []byte("package sample\n\nimport \"fmt\"\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-internal-prefix=git.example.com/team", "-count", dir}, &stdout, &stderr)
+	if code != exitOK {
+		t.Errorf("exit code = %d, want %d", code, exitOK)
+	}
+	if got := stdout.String(); got != "2\n" {
+		t.Errorf("stdout = %q, want %q", got, "2\n")
+	}
+	if stderr.Len() != 0 {
+		t.Errorf("stderr = %q, want nothing", stderr.String())
+	}
+
+	code = run([]string{"-internal-prefix=git.example.com/team", "-count", "-fix", dir}, &stdout, &stderr)
+	if code != exitError {
+		t.Errorf("-count with -fix exit code = %d, want %d", code, exitError)
+	}
+}
+
+func TestConfigExcludeIsRelativeToConfigFile(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"gen/api/api.pb.go", "pkg/a.go", "pkg/a_gen.go"} {
+		err := os.MkdirAll(filepath.Join(root, filepath.Dir(name)), 0o700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(root, name), []byte(misformattedSrc), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	configPath := filepath.Join(root, "import-tidy.json")
+	err := os.WriteFile(configPath, []byte(`{"exclude": ["gen", "pkg/*_gen.go"]}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same patterns apply from the root, from below it, and from an
+	// unrelated directory.
+	for _, wd := range []string{root, filepath.Join(root, "pkg"), t.TempDir()} {
+		t.Chdir(wd)
+		var stdout, stderr bytes.Buffer
+		code := run([]string{"-internal-prefix=git.example.com/team", "-config", configPath, "-list", root}, &stdout, &stderr)
+		if code != exitIssuesFound {
+			t.Errorf("from %s: exit code = %d, want %d (stderr %q)", wd, code, exitIssuesFound, stderr.String())
+		}
+		if want := filepath.Join(root, "pkg", "a.go") + "\n"; stdout.String() != want {
+			t.Errorf("from %s: stdout = %q, want %q", wd, stdout.String(), want)
+		}
+	}
+
+	_, _, err = parseArgs([]string{"-internal-prefix=git.example.com/team", "-config", writeConfig(t, `{"exclude": ["["]}`), "."}, io.Discard)
+	if err == nil {
+		t.Error("expected an error for a malformed pattern")
+	}
+}
+
+func TestConfigIncludeWithoutPathArguments(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"cmd/tool/main.go", "pkg/a.go", "pkg/a_gen.go", "scripts/gen.go"} {
+		err := os.MkdirAll(filepath.Join(root, filepath.Dir(name)), 0o700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(root, name), []byte(misformattedSrc), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	configPath := filepath.Join(root, "import-tidy.json")
+	err := os.WriteFile(configPath, []byte(`{"include": ["cmd", "pkg/*.go"], "exclude": ["pkg/*_gen.go"]}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(t.TempDir())
+
+	list := func(args ...string) string {
+		t.Helper()
+		var stdout, stderr bytes.Buffer
+		args = append([]string{"-internal-prefix=git.example.com/team", "-list"}, args...)
+		code := run(args, &stdout, &stderr)
+		if code != exitIssuesFound {
+			t.Errorf("%v: exit code = %d, want %d (stderr %q)", args, code, exitIssuesFound, stderr.String())
+		}
+
+		return stdout.String()
+	}
+
+	want := filepath.Join(root, "cmd", "tool", "main.go") + "\n" + filepath.Join(root, "pkg", "a.go") + "\n"
+	if got := list("-config", configPath); got != want {
+		t.Errorf("without paths: stdout = %q, want %q", got, want)
+	}
+	// Path arguments take precedence over include.
+	want = filepath.Join(root, "scripts", "gen.go") + "\n"
+	if got := list("-config", configPath, filepath.Join(root, "scripts")); got != want {
+		t.Errorf("with a path: stdout = %q, want %q", got, want)
+	}
+	// Without include, the directory of the config file is checked.
+	err = os.WriteFile(configPath, []byte(`{"exclude": ["pkg", "scripts"]}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = filepath.Join(root, "cmd", "tool", "main.go") + "\n"
+	if got := list("-config", configPath); got != want {
+		t.Errorf("without include: stdout = %q, want %q", got, want)
+	}
+
+	_, _, err = parseArgs([]string{"-internal-prefix=git.example.com/team", "-config", writeConfig(t, `{"include": ["nothing"]}`)}, io.Discard)
+	if err == nil {
+		t.Error("expected an error for include patterns that match nothing")
+	}
+}
+
+func TestRunValidateConfig(t *testing.T) {
+	configPath := writeConfig(t, `{"classify": [{"group": "shared", "match": "hasPrefix(\"golang.org/x/\")"}]}`)
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{
+		"-internal-prefix=git.example.com/team", "-config", configPath,
+		"-import-order=standard,shared+external,internal", "-validate-config",
+	}, &stdout, &stderr)
+	if code != exitOK {
+		t.Fatalf("exit code = %d, want %d (stderr %q)", code, exitOK, stderr.String())
+	}
+	for _, want := range []string{
+		"internal-prefix     git.example.com/team\n",
+		"import-order        standard, shared+external, internal\n",
+		`classify shared     hasPrefix("golang.org/x/")` + "\n",
+	} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("stdout = %q, want it to contain %q", stdout.String(), want)
+		}
+	}
+
+	for name, args := range map[string][]string{
+		"unknown group":    {"-internal-prefix=git.example.com/team", "-import-order=standard,vendor,external,internal"},
+		"duplicate group":  {"-internal-prefix=git.example.com/team", "-import-order=standard,external,internal,standard"},
+		"dangling join":    {"-internal-prefix=git.example.com/team", "-import-order=standard+,external,internal"},
+		"prefix with mode": {"-internal-prefix=git.example.com/team", "-mode=gomod"},
+		"bad regexp":       {"-internal-prefix=git.example.com/team", "-config", writeConfig(t, `{"classify": [{"group": "internal", "match": "matches(\"(\")"}]}`)},
+	} {
+		stdout.Reset()
+		code := run(append(args, "-validate-config"), &stdout, &stderr)
+		if code != exitError {
+			t.Errorf("%s: exit code = %d, want %d", name, code, exitError)
+		}
+		if stdout.Len() != 0 {
+			t.Errorf("%s: stdout = %q, want nothing", name, stdout.String())
+		}
+	}
+}
+
+func TestRunLocalMergesWithInternalPrefix(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-local=github.com/acme,git.example.com/team", "-internal-prefix=git.example.com/team", "-validate-config"}, &stdout, &stderr)
+	if code != exitOK {
+		t.Fatalf("exit code = %d, want %d (stderr %q)", code, exitOK, stderr.String())
+	}
+	want := "internal-prefix     git.example.com/team, github.com/acme\n"
+	if !strings.Contains(stdout.String(), want) {
+		t.Errorf("stdout = %q, want it to contain %q", stdout.String(), want)
+	}
+}
+
+func TestRunGoModMode(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module git.example.com/app\n\nrequire github.com/pkg/errors v0.9.1\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(filepath.Join(dir, "cmd"), 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := `package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/typo/errors"
+
+	"git.example.com/app/db"
+)
+`
+	err = os.WriteFile(filepath.Join(dir, "cmd", "main.go"), []byte(src), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// go.mod is looked up from the working directory, like the go command.
+	t.Chdir(filepath.Join(dir, "cmd"))
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-mode=gomod", "main.go"}, &stdout, &stderr)
+	if code != exitOK {
+		t.Errorf("exit code = %d, want %d (stdout %q)", code, exitOK, stdout.String())
+	}
+	want := "Warning: main.go:7: \"github.com/typo/errors\" is not provided by module git.example.com/app or any module it requires\n"
+	if stderr.String() != want {
+		t.Errorf("stderr = %q, want %q", stderr.String(), want)
+	}
+
+	code = run([]string{"-mode=gomod", "-internal-prefix=git.example.com/app", "main.go"}, &stdout, &stderr)
+	if code != exitError {
+		t.Errorf("-mode=gomod with -internal-prefix exit code = %d, want %d", code, exitError)
+	}
+}
+
+func TestGoModLocalReplacesAreInternal(t *testing.T) {
+	dir := t.TempDir()
+	goMod := `module git.example.com/app
+
+require (
+	github.com/acme/foo v1.0.0
+	github.com/acme/bar v1.0.0
+	github.com/acme/baz v1.0.0
+)
+
+replace github.com/acme/foo => ./foo
+
+replace (
+	github.com/acme/bar v1.0.0 => ../bar
+	github.com/acme/baz => github.com/fork/baz v1.0.1
+)
+`
+	err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte(goMod), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+
+	cfg, _, err := parseArgs([]string{"-mode=gomod", "."}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]importGroup{
+		"git.example.com/app/db":     internalLibrary,
+		"github.com/acme/foo":        internalLibrary,
+		"github.com/acme/foo/client": internalLibrary,
+		"github.com/acme/bar":        internalLibrary,
+		// A module replaced by another module is still someone else's.
+		"github.com/acme/baz":   externalLibrary,
+		"github.com/acme/other": externalLibrary,
+	} {
+		if got := determineImportGroup(path, cfg); got != want {
+			t.Errorf("determineImportGroup(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestInternalPrefixDefaultsToEachFilesModule(t *testing.T) {
+	dir := t.TempDir()
+	src := "package p\n\nimport (\n\t\"git.example.com/a/x\"\n\t\"fmt\"\n\t\"git.example.com/b/y\"\n)\n"
+	for path, content := range map[string]string{
+		"a/go.mod":      "module git.example.com/a\n",
+		"a/x/x.go":      src,
+		"b/go.mod":      "module git.example.com/b\n",
+		"b/y/y.go":      src,
+		"loose/gone.go": src,
+	} {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(dir, path), []byte(content), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-fix", filepath.Join(dir, "a"), filepath.Join(dir, "b")}, &stdout, &stderr)
+	if code != exitOK {
+		t.Errorf("exit code = %d, want %d (stderr %q)", code, exitOK, stderr.String())
+	}
+	for path, want := range map[string]string{
+		"a/x/x.go": "package p\n\nimport (\n\t\"fmt\"\n\n\t\"git.example.com/b/y\"\n\n\t\"git.example.com/a/x\"\n)\n",
+		"b/y/y.go": "package p\n\nimport (\n\t\"fmt\"\n\n\t\"git.example.com/a/x\"\n\n\t\"git.example.com/b/y\"\n)\n",
+	} {
+		got, err := os.ReadFile(filepath.Join(dir, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s:\ngot:\n%s\nwant:\n%s", path, got, want)
+		}
+	}
+
+	stderr.Reset()
+	code = run([]string{filepath.Join(dir, "loose")}, &stdout, &stderr)
+	if code != exitError || !strings.Contains(stderr.String(), "no -internal-prefix given, and no go.mod found") {
+		t.Errorf("exit code = %d, stderr = %q, want an error for the file outside any module", code, stderr.String())
+	}
+}
+
+func TestGoWorkModulesAreInternal(t *testing.T) {
+	dir := t.TempDir()
+	for path, content := range map[string]string{
+		"go.work": `go 1.22
+
+use ./api
+
+use (
+	"./worker" // comments and quoting as in go.mod
+)
+`,
+		"api/go.mod":    "module git.example.com/api\n\nrequire github.com/pkg/errors v0.9.1\n",
+		"worker/go.mod": "module git.example.com/worker\n\nrequire git.example.com/api v0.0.0\n",
+	} {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(dir, path), []byte(content), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	src := `package main
+
+import (
+	"fmt"
+	"git.example.com/api/client"
+	"github.com/pkg/errors"
+	"git.example.com/worker/queue"
+	"github.com/typo/errors"
+)
+`
+	err := os.WriteFile(filepath.Join(dir, "worker", "main.go"), []byte(src), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// go.work is looked up from the working directory, like go.mod.
+	t.Chdir(filepath.Join(dir, "worker"))
+
+	cfg, _, err := parseArgs([]string{"-mode=gowork", "."}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]importGroup{
+		"git.example.com/api/client":   internalLibrary,
+		"git.example.com/worker/queue": internalLibrary,
+		"git.example.com/other":        externalLibrary,
+		"github.com/pkg/errors":        externalLibrary,
+	} {
+		if got := determineImportGroup(path, cfg); got != want {
+			t.Errorf("determineImportGroup(%q) = %v, want %v", path, got, want)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-mode=gowork", "-fix", "main.go"}, &stdout, &stderr)
+	if code != exitOK {
+		t.Errorf("exit code = %d, want %d (stderr %q)", code, exitOK, stderr.String())
+	}
+	want := "Warning: main.go:8: \"github.com/typo/errors\" is not provided by the modules of " +
+		filepath.Join(dir, "go.work") + " or any module they require\n"
+	if !strings.HasPrefix(stderr.String(), want) {
+		t.Errorf("stderr = %q, want it to start with %q", stderr.String(), want)
+	}
+	content, err := os.ReadFile("main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSrc := `package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/typo/errors"
+
+	"git.example.com/api/client"
+	"git.example.com/worker/queue"
+)
+`
+	if string(content) != wantSrc {
+		t.Errorf("fixed content = %q, want %q", content, wantSrc)
+	}
+}
+
+func TestRunStdin(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module git.example.com/app\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := `package main
+
+import (
+	"git.example.com/app/db"
+	"fmt"
+)
+`
+	want := `package main
+
+import (
+	"fmt"
+
+	"git.example.com/app/db"
+)
+`
+	// The go.mod is found from -stdin-filename, not the working directory.
+	filename := filepath.Join(dir, "cmd", "main.go")
+	for name, test := range map[string]struct {
+		args       []string
+		src        string
+		wantCode   int
+		wantStdout string
+	}{
+		"fix":             {args: []string{"-fix"}, src: src, wantCode: exitOK, wantStdout: want},
+		"fix clean input": {args: []string{"-fix"}, src: want, wantCode: exitOK, wantStdout: want},
+		"check":           {args: []string{"-list"}, src: src, wantCode: exitIssuesFound, wantStdout: filename + "\n"},
+		"check clean":     {args: []string{"-list"}, src: want, wantCode: exitOK, wantStdout: ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			args := append([]string{"-mode=gomod", "-stdin-filename", filename}, test.args...)
+			cfg, paths, err := parseArgs(append(args, "-"), io.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(paths, []string{"-"}) {
+				t.Fatalf("paths = %q, want [-]", paths)
+			}
+
+			var stdout, stderr bytes.Buffer
+			code := runStdin(strings.NewReader(test.src), cfg, &stdout, &stderr)
+			if code != test.wantCode {
+				t.Errorf("exit code = %d, want %d (stderr %q)", code, test.wantCode, stderr.String())
+			}
+			if stdout.String() != test.wantStdout {
+				t.Errorf("stdout = %q, want %q", stdout.String(), test.wantStdout)
+			}
+		})
+	}
+
+	for name, args := range map[string][]string{
+		"other paths":          {"-internal-prefix=x.com/y", "-", "main.go"},
+		"filename without -":   {"-internal-prefix=x.com/y", "-stdin-filename=main.go", "main.go"},
+		"interactive on stdin": {"-internal-prefix=x.com/y", "-interactive", "-"},
+	} {
+		_, _, err := parseArgs(args, io.Discard)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// truncatingFS loses the second half of the first write, as a full disk
+// might.
+type truncatingFS struct {
+	*stdinFS
+	truncated bool
+}
+
+func (f *truncatingFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	if !f.truncated {
+		f.truncated = true
+		data = data[:len(data)/2]
+	}
+
+	return f.stdinFS.WriteFile(name, data, perm)
+}
+
+func TestVerifyRestoresUnparsableWrite(t *testing.T) {
+	cfg := testConfig(true)
+	cfg.verify = true
+	fsys := &truncatingFS{stdinFS: &stdinFS{name: "main.go", data: []byte(misformattedSrc)}}
+	_, err := collectViolations(checkFile(fsys, "main.go", cfg))
+	if err == nil || !strings.Contains(err.Error(), "original restored") {
+		t.Fatalf("error = %v, want the original to be restored", err)
+	}
+	if string(fsys.written) != misformattedSrc {
+		t.Errorf("file = %q, want the original %q", fsys.written, misformattedSrc)
+	}
+
+	// A write that goes through is kept.
+	fsys = &truncatingFS{stdinFS: &stdinFS{name: "main.go", data: []byte(misformattedSrc)}, truncated: true}
+	verr, err := collectViolations(checkFile(fsys, "main.go", cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verr == nil || !verr.fixed {
+		t.Fatalf("violations = %v, want a fixed file", verr)
+	}
+	want := "package sample\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n"
+	if string(fsys.written) != want {
+		t.Errorf("file = %q, want %q", fsys.written, want)
+	}
+}
+
+func TestNoPathReadsStdin(t *testing.T) {
+	_, paths, err := parseArgs([]string{"-internal-prefix=git.example.com/team", "-fix", "-stdin-filename=main.go"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(paths, []string{stdinPath}) {
+		t.Errorf("paths = %q, want [-]", paths)
+	}
+
+	// A config file, -since, and -staged say what to check; -watch and
+	// friends need files on disk.
+	configPath := writeConfig(t, `{}`)
+	_, paths, err = parseArgs([]string{"-internal-prefix=git.example.com/team", "-config", configPath}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(paths, []string{filepath.Dir(configPath)}) {
+		t.Errorf("with -config: paths = %q, want the config file's directory", paths)
+	}
+	_, _, err = parseArgs([]string{"-internal-prefix=git.example.com/team", "-watch"}, io.Discard)
+	if err == nil {
+		t.Error("parseArgs with -watch and no path succeeded, want an error")
+	}
+}
+
+func TestRunStdout(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.go")
+	err := os.WriteFile(path, []byte(misformattedSrc), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-internal-prefix=git.example.com/team", "-stdout", path}, &stdout, &stderr)
+	if code != exitOK {
+		t.Errorf("exit code = %d, want %d (stderr %q)", code, exitOK, stderr.String())
+	}
+	want := "package sample\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n"
+	if stdout.String() != want {
+		t.Errorf("stdout = %q, want %q", stdout.String(), want)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != misformattedSrc {
+		t.Errorf("file was modified:\n%s", content)
+	}
+
+	for _, args := range [][]string{
+		{"-stdout", dir},
+		{"-stdout", path, path},
+		{"-stdout", "-fix", path},
+	} {
+		stdout.Reset()
+		stderr.Reset()
+		code := run(append([]string{"-internal-prefix=git.example.com/team"}, args...), &stdout, &stderr)
+		if code != exitError || stdout.Len() > 0 {
+			t.Errorf("%q: exit code = %d, stdout %q, want %d and no output", args, code, stdout.String(), exitError)
+		}
+	}
+}
+
+func TestRunSkipsHiddenDirectories(t *testing.T) {
+	dir := t.TempDir()
+	hooks := filepath.Join(dir, ".git", "hooks")
+	err := os.MkdirAll(hooks, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(hooks, "hook.go"), []byte(misformattedSrc), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nimport \"fmt\"\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(hooks)
+
+	for name, test := range map[string]struct {
+		args []string
+		want int
+	}{
+		"hidden directory below the target": {args: []string{dir}, want: exitOK},
+		"-include-hidden":                   {args: []string{"-include-hidden", dir}, want: exitIssuesFound},
+		"hidden directory as the target":    {args: []string{filepath.Join(dir, ".git")}, want: exitIssuesFound},
+		"current directory":                 {args: []string{"./"}, want: exitIssuesFound},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := run(append([]string{"-internal-prefix=git.example.com/team"}, test.args...), &stdout, &stderr)
+			if code != test.want {
+				t.Errorf("exit code = %d, want %d (stdout %q, stderr %q)", code, test.want, stdout.String(), stderr.String())
+			}
+		})
+	}
+}
+
+func TestRunExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"clean.go":   "package sample\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n",
+		"untidy.go":  misformattedSrc,
+		"fixme.go":   misformattedSrc,
+		"invalid.go": "package sample\n\nimport (\n\t\"fmt\"\n\nfunc\n",
+	}
+	for name, src := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, test := range map[string]struct {
+		args []string
+		want int
+	}{
+		"clean":                        {args: []string{"clean.go"}, want: exitOK},
+		"violations":                   {args: []string{"untidy.go"}, want: exitIssuesFound},
+		"violations fixed":             {args: []string{"-fix", "fixme.go"}, want: exitOK},
+		"unknown flag":                 {args: []string{"-no-such-flag", "clean.go"}, want: exitError},
+		"no path with -watch":          {args: []string{"-watch"}, want: exitError},
+		"missing file":                 {args: []string{"missing.go"}, want: exitError},
+		"parse failure":                {args: []string{"invalid.go"}, want: exitError},
+		"violations and parse failure": {args: []string{"untidy.go", "invalid.go"}, want: exitError},
+	} {
+		t.Run(name, func(t *testing.T) {
+			args := []string{"-internal-prefix=git.example.com/team"}
+			for _, arg := range test.args {
+				if strings.HasSuffix(arg, ".go") {
+					arg = filepath.Join(dir, arg)
+				}
+				args = append(args, arg)
+			}
+			var stdout, stderr bytes.Buffer
+			code := run(args, &stdout, &stderr)
+			if code != test.want {
+				t.Errorf("exit code = %d, want %d (stderr %q)", code, test.want, stderr.String())
+			}
+		})
+	}
+}
+
+func TestRunVerboseListsViolations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sample.go")
+	src := "package sample\n\nimport (\n\t\"os\"\n\t\"fmt\"\n\t\"github.com/x/y\"\n)\n"
+	err := os.WriteFile(path, []byte(src), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-internal-prefix=git.example.com/team", "-verbose", path}, &stdout, &stderr)
+	if code != exitIssuesFound {
+		t.Errorf("exit code = %d, want %d (stderr %q)", code, exitIssuesFound, stderr.String())
+	}
+	want := "needs formatting: " + path + "\n" +
+		path + ":5:2: \"fmt\" is not sorted alphabetically\n" +
+		path + ":6:2: missing blank line before \"github.com/x/y\"\n"
+	if stdout.String() != want {
+		t.Errorf("stdout = %q, want %q", stdout.String(), want)
+	}
+}
+
+func TestRunWarnOnly(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "messy.go")
+	err := os.WriteFile(filePath, []byte(misformattedSrc), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-internal-prefix=git.example.com/team", "-warn-only", dir}, &stdout, &stderr)
+	if code != exitOK {
+		t.Errorf("exit code = %d, want %d", code, exitOK)
+	}
+	if stdout.String() != "needs formatting: "+filePath+"\n" || stderr.String() != "1 file(s) need formatting (sort-order: 1)\n" {
+		t.Errorf("stdout = %q, stderr = %q, want the file and the summary reported", stdout.String(), stderr.String())
+	}
+
+	stdout.Reset()
+	code = run([]string{"-internal-prefix=git.example.com/team", "-warn-only", "-format=sarif", dir}, &stdout, &stderr)
+	if code != exitOK {
+		t.Errorf("-format=sarif exit code = %d, want %d", code, exitOK)
+	}
+	if !strings.Contains(stdout.String(), `"level": "warning"`) || strings.Contains(stdout.String(), `"level": "error"`) {
+		t.Errorf("SARIF results are not warnings:\n%s", stdout.String())
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "broken.go"), []byte("package sample\n\nimport (\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code = run([]string{"-internal-prefix=git.example.com/team", "-warn-only", dir}, io.Discard, io.Discard)
+	if code != exitError {
+		t.Errorf("exit code with an unparsable file = %d, want %d", code, exitError)
+	}
+
+	_, _, err = parseArgs([]string{"-internal-prefix=x.com/y", "-warn-only", "-fix", "."}, io.Discard)
+	if err == nil {
+		t.Error("-warn-only with -fix: expected an error")
+	}
+}
+
+func TestRunFixSkipsReadOnlyFiles(t *testing.T) {
+	dir := t.TempDir()
+	readOnly := filepath.Join(dir, "generated.go")
+	writable := filepath.Join(dir, "main.go")
+	err := os.WriteFile(readOnly, []byte(misformattedSrc), 0o444)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(writable, []byte(misformattedSrc), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-internal-prefix=git.example.com/team", "-fix", dir}, &stdout, &stderr)
+	if code != exitIssuesFound {
+		t.Errorf("exit code = %d, want %d (stderr %q)", code, exitIssuesFound, stderr.String())
+	}
+	if want := "permission denied: " + readOnly + " is read-only"; !strings.Contains(stderr.String(), want) {
+		t.Errorf("stderr = %q, want it to contain %q", stderr.String(), want)
+	}
+	content, err := os.ReadFile(readOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != misformattedSrc {
+		t.Errorf("read-only file was rewritten:\n%s", content)
+	}
+	content, err = os.ReadFile(writable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) == misformattedSrc {
+		t.Error("writable file next to the read-only one was not fixed")
+	}
+	if want := "needs formatting: " + readOnly + "\nfixed: " + writable + "\n"; stdout.String() != want {
+		t.Errorf("stdout = %q, want %q", stdout.String(), want)
+	}
+}
+
+func TestRunReportsUnreadableFiles(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read any file")
+	}
+	dir := t.TempDir()
+	unreadable := filepath.Join(dir, "a.go")
+	err := os.WriteFile(unreadable, []byte(misformattedSrc), 0o200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "b.go"), []byte(misformattedSrc), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-internal-prefix=git.example.com/team", dir}, &stdout, &stderr)
+	if code != exitError {
+		t.Errorf("exit code = %d, want %d", code, exitError)
+	}
+	if want := "Error: permission denied: " + unreadable + "\n"; !strings.Contains(stderr.String(), want) {
+		t.Errorf("stderr = %q, want it to contain %q", stderr.String(), want)
+	}
+	if !strings.Contains(stdout.String(), "b.go") {
+		t.Errorf("stdout = %q, want the readable file checked after the unreadable one", stdout.String())
+	}
+}
+
+func TestRunBackupSavesOriginal(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "main.go")
+	err := os.WriteFile(filePath, []byte(misformattedSrc), 0o640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A suffix ending in .go shows that the backup is not walked as source.
+	args := []string{"-internal-prefix=git.example.com/team", "-fix", "-backup", "-backup-suffix=.orig.go", dir}
+	var stdout, stderr bytes.Buffer
+	code := run(args, &stdout, &stderr)
+	if code != exitOK {
+		t.Fatalf("exit code = %d, want %d (stderr %q)", code, exitOK, stderr.String())
+	}
+	backup, err := os.ReadFile(filePath + ".orig.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(backup) != misformattedSrc {
+		t.Errorf("backup = %q, want %q", backup, misformattedSrc)
+	}
+	info, err := os.Stat(filePath + ".orig.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o640 {
+		t.Errorf("backup mode = %v, want %v", info.Mode().Perm(), fs.FileMode(0o640))
+	}
+
+	stdout.Reset()
+	code = run(args, &stdout, &stderr)
+	if code != exitOK || stdout.Len() > 0 {
+		t.Errorf("second run: exit code = %d, output %q; the backup was processed", code, stdout.String())
+	}
+
+	for name, args := range map[string][]string{
+		"without -fix":  {"-internal-prefix=x.com/y", "-backup", "."},
+		"with -out-dir": {"-internal-prefix=x.com/y", "-backup", "-out-dir=out", "."},
+		"empty suffix":  {"-internal-prefix=x.com/y", "-fix", "-backup", "-backup-suffix=", "."},
+	} {
+		_, _, err := parseArgs(args, io.Discard)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestRunOutDirMirrorsFixedFiles(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	err := os.MkdirAll(filepath.Join("pkg", "sub"), 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clean := "package sample\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n"
+	for name, src := range map[string]string{"a.go": misformattedSrc, "b.go": clean, "sub/c.go": misformattedSrc} {
+		err := os.WriteFile(filepath.Join("pkg", name), []byte(src), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-internal-prefix=git.example.com/team", "-out-dir", "out", "pkg"}, &stdout, &stderr)
+	if code != exitOK {
+		t.Fatalf("exit code = %d, want %d (stderr %q)", code, exitOK, stderr.String())
+	}
+	for _, name := range []string{"a.go", "sub/c.go"} {
+		got, err := os.ReadFile(filepath.Join("out", "pkg", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != clean {
+			t.Errorf("out/pkg/%s = %q, want %q", name, got, clean)
+		}
+		original, err := os.ReadFile(filepath.Join("pkg", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(original) != misformattedSrc {
+			t.Errorf("pkg/%s was modified", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join("out", "pkg", "b.go")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("clean file was written to out-dir (stat error %v)", err)
+	}
+
+	outside := filepath.Join(t.TempDir(), "x.go")
+	err = os.WriteFile(outside, []byte(misformattedSrc), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code = run([]string{"-internal-prefix=git.example.com/team", "-out-dir", "out", outside}, &stdout, &stderr)
+	if code != exitError {
+		t.Errorf("file outside the working directory: exit code = %d, want %d", code, exitError)
+	}
+}
+
+func TestRunWritesProfiles(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "sample.go")
+	err := os.WriteFile(filePath, []byte(misformattedSrc), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpuProfile, memProfile := filepath.Join(dir, "cpu.pprof"), filepath.Join(dir, "mem.pprof")
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-internal-prefix=git.example.com/team", "-cpuprofile", cpuProfile, "-memprofile", memProfile, filePath}, &stdout, &stderr)
+	if code != exitIssuesFound {
+		t.Errorf("exit code = %d, want %d (stderr %q)", code, exitIssuesFound, stderr.String())
+	}
+	for _, profile := range []string{cpuProfile, memProfile} {
+		info, err := os.Stat(profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() == 0 {
+			t.Errorf("%s is empty", profile)
+		}
+	}
+}
+
+func TestRunKeepsGoingAfterAnError(t *testing.T) {
+	dir := t.TempDir()
+	messy := filepath.Join(dir, "messy.go")
+	err := os.WriteFile(messy, []byte(misformattedSrc), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-internal-prefix=git.example.com/team", "-list", filepath.Join(dir, "missing.go"), messy}, &stdout, &stderr)
+	if code != exitError {
+		t.Errorf("exit code = %d, want %d", code, exitError)
+	}
+	if got := stdout.String(); got != messy+"\n" {
+		t.Errorf("stdout = %q, want the file after the failing one listed", got)
+	}
+	if !strings.Contains(stderr.String(), "missing.go") {
+		t.Errorf("stderr = %q, want the error for missing.go", stderr.String())
+	}
+}
+
+func TestRunRewriteReport(t *testing.T) {
+	src := `package sample
+
+import (
+	"os"
+	"fmt"
+
+	"git.example.com/team/pkg"
+	"github.com/pkg/errors"
+	"github.com/pkg/errors"
+)
+`
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "sample.go")
+	for _, format := range []string{formatText, formatJSON} {
+		err := os.WriteFile(filePath, []byte(src), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stdout, stderr bytes.Buffer
+		code := run([]string{"-internal-prefix=git.example.com/team", "-fix", "-rewrite-report", "-format=" + format, filePath}, &stdout, &stderr)
+		if code != exitOK {
+			t.Fatalf("exit code = %d, want %d (stderr %q)", code, exitOK, stderr.String())
+		}
+
+		if format == formatText {
+			want := "fixed: " + filePath + `
+	"os": line 4 -> line 5
+	"fmt": line 5 -> line 4
+	"git.example.com/team/pkg": line 7 -> line 9, group external -> internal
+	"github.com/pkg/errors": line 8 -> line 7
+	"github.com/pkg/errors": line 9 removed as a duplicate
+`
+			if stdout.String() != want {
+				t.Errorf("output:\n%s\nwant:\n%s", stdout.String(), want)
+			}
+
+			continue
+		}
+		var report jsonReport
+		err = json.Unmarshal(stdout.Bytes(), &report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Files) != 1 || len(report.Files[0].Moves) != 5 {
+			t.Fatalf("report = %+v, want five moves", report)
+		}
+		want := jsonMove{Import: "git.example.com/team/pkg", FromLine: 7, ToLine: 9, FromGroup: "external", ToGroup: "internal"}
+		if got := report.Files[0].Moves[2]; got != want {
+			t.Errorf("move = %+v, want %+v", got, want)
+		}
+	}
+
+	_, _, err := parseArgs([]string{"-internal-prefix=x.com/y", "-rewrite-report", "."}, io.Discard)
+	if err == nil {
+		t.Error("-rewrite-report without -fix: expected an error")
+	}
+}
+
+func TestRunPatchOut(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	t.Chdir(dir)
+	for name, src := range map[string]string{
+		"messy.go":     misformattedSrc,
+		"cmd/messy.go": misformattedSrc,
+		"clean.go":     "package sample\n\nimport \"fmt\"\n",
+	} {
+		err := os.MkdirAll(filepath.Dir(name), 0o700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(name, []byte(src), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	args := []string{"-internal-prefix=git.example.com/team", "-patch-out=imports.patch", "."}
+	var stdout, stderr bytes.Buffer
+	code := run(args, &stdout, &stderr)
+	if code != exitIssuesFound {
+		t.Fatalf("exit code = %d, want %d (stderr %q)", code, exitIssuesFound, stderr.String())
+	}
+	patch, err := os.ReadFile("imports.patch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, header := range []string{"--- a/messy.go\n+++ b/messy.go\n", "--- a/cmd/messy.go\n+++ b/cmd/messy.go\n"} {
+		if !bytes.Contains(patch, []byte(header)) {
+			t.Errorf("patch has no %q:\n%s", header, patch)
+		}
+	}
+	if content, _ := os.ReadFile("messy.go"); string(content) != misformattedSrc {
+		t.Error("-patch-out must not fix the files")
+	}
+
+	out, err := exec.Command("git", "apply", "imports.patch").CombinedOutput()
+	if err != nil {
+		t.Fatalf("git apply: %v\n%s", err, out)
+	}
+	code = run(args, &stdout, &stderr)
+	if code != exitOK {
+		t.Errorf("exit code after git apply = %d, want %d", code, exitOK)
+	}
+	patch, err = os.ReadFile("imports.patch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) != 0 {
+		t.Errorf("patch for a tidy tree = %q, want it empty", patch)
+	}
+
+	_, _, err = parseArgs([]string{"-internal-prefix=x.com/y", "-patch-out=p", "-fix", "."}, io.Discard)
+	if err == nil {
+		t.Error("-patch-out with -fix: expected an error")
+	}
+}
+
+func TestRunSince(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	t.Chdir(dir)
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	write := func(name, content string) {
+		t.Helper()
+		err := os.MkdirAll(filepath.Dir(name), 0o700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(name, []byte(content), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	git("init", "-q")
+	write("untouched.go", misformattedSrc)
+	write("gone.go", misformattedSrc)
+	git("add", ".")
+	git("commit", "-q", "-m", "base")
+	git("tag", "base")
+
+	write("changed.go", misformattedSrc)
+	write("vendor/dep/dep.go", misformattedSrc)
+	write("notes.txt", "not Go")
+	git("rm", "-q", "gone.go")
+	git("add", ".")
+	git("commit", "-q", "-m", "change")
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-internal-prefix=git.example.com/team", "-list", "-since", "base"}, &stdout, &stderr)
+	if code != exitIssuesFound {
+		t.Errorf("exit code = %d, want %d (stderr %q)", code, exitIssuesFound, stderr.String())
+	}
+	if got := stdout.String(); got != "changed.go\n" {
+		t.Errorf("stdout = %q, want only changed.go", got)
+	}
+
+	stdout.Reset()
+	stderr.Reset()
+	code = run([]string{"-internal-prefix=git.example.com/team", "-since", "no-such-ref"}, &stdout, &stderr)
+	if code != exitError || !strings.Contains(stderr.String(), "no-such-ref") {
+		t.Errorf("unknown ref: exit code = %d, stderr %q", code, stderr.String())
+	}
+
+	stderr.Reset()
+	code = run([]string{"-internal-prefix=git.example.com/team", "-since=--output=written.txt"}, &stdout, &stderr)
+	if code != exitError || !strings.Contains(stderr.String(), "is not a git ref") {
+		t.Errorf("option as ref: exit code = %d, stderr %q", code, stderr.String())
+	}
+	if written, _ := filepath.Glob("written.txt*"); len(written) > 0 {
+		t.Errorf("git was passed -since as an option and wrote %q", written)
+	}
+}
+
+func TestRunStaged(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	t.Chdir(dir)
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+
+		return string(out)
+	}
+	write := func(name, content string) {
+		t.Helper()
+		err := os.WriteFile(name, []byte(content), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	git("init", "-q")
+	write("committed.go", misformattedSrc)
+	git("add", ".")
+	git("commit", "-q", "-m", "base")
+
+	write("staged.go", misformattedSrc)
+	write("partial.go", misformattedSrc)
+	write("unstaged.go", misformattedSrc)
+	git("add", "staged.go", "partial.go")
+	write("partial.go", misformattedSrc+"\nvar unstaged = 1\n")
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-internal-prefix=git.example.com/team", "-list", "-staged"}, &stdout, &stderr)
+	if code != exitIssuesFound {
+		t.Errorf("exit code = %d, want %d (stderr %q)", code, exitIssuesFound, stderr.String())
+	}
+	if got := stdout.String(); got != "partial.go\nstaged.go\n" {
+		t.Errorf("stdout = %q, want partial.go and staged.go", got)
+	}
+
+	stdout.Reset()
+	stderr.Reset()
+	code = run([]string{"-internal-prefix=git.example.com/team", "-fix", "-staged"}, &stdout, &stderr)
+	if code != exitIssuesFound {
+		t.Errorf("-fix exit code = %d, want %d for the partially staged file", code, exitIssuesFound)
+	}
+	if !strings.Contains(stderr.String(), "partial.go has unstaged changes") {
+		t.Errorf("stderr = %q, want a warning about partial.go", stderr.String())
+	}
+	// The fix of staged.go is staged, partial.go is left alone, and files
+	// not staged at all are not even looked at.
+	if got, want := git("status", "--porcelain"), "AM partial.go\nA  staged.go\n?? unstaged.go\n"; got != want {
+		t.Errorf("git status = %q, want %q", got, want)
+	}
+	content, err := os.ReadFile("partial.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != misformattedSrc+"\nvar unstaged = 1\n" {
+		t.Errorf("partial.go was modified:\n%s", content)
+	}
+}
+
+func TestRunParallelOutputIsSorted(t *testing.T) {
+	dir := t.TempDir()
+	var want []string
+	for i := range 40 {
+		name := filepath.Join(dir, fmt.Sprintf("f%02d.go", i))
+		src := "package sample\n\nimport \"fmt\"\n"
+		if i%3 != 0 {
+			src = misformattedSrc
+			want = append(want, name)
+		}
+		err := os.WriteFile(name, []byte(src), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, jobs := range []string{"1", "8"} {
+		var stdout, stderr bytes.Buffer
+		code := run([]string{"-internal-prefix=git.example.com/team", "-list", "-jobs", jobs, dir}, &stdout, &stderr)
+		if code != exitIssuesFound {
+			t.Errorf("-jobs %s: exit code = %d, want %d", jobs, code, exitIssuesFound)
+		}
+		got := strings.Fields(stdout.String())
+		if !slices.Equal(got, want) {
+			t.Errorf("-jobs %s: listed\n%s\nwant\n%s", jobs, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+// slowFS delays reading the file named slow, so that files after it in
+// walk order finish first.
+type slowFS struct {
+	fstest.MapFS
+	slow string
+}
+
+func (f slowFS) ReadFile(name string) ([]byte, error) {
+	if name == f.slow {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	return f.MapFS.ReadFile(name)
+}
+
+func TestProcessFSLogsInWalkOrder(t *testing.T) {
+	misspelled := &fstest.MapFile{Data: []byte("package sample\n\nimport \"git.example.com/Team/x\"\n")}
+	fsys := slowFS{MapFS: fstest.MapFS{"a.go": misspelled, "b.go": misspelled, "c.go": misspelled}, slow: "a.go"}
+
+	var stderr bytes.Buffer
+	cfg := testConfig(false)
+	cfg.jobs = 3
+	cfg.log = &logger{out: &stderr}
+	_, err := processFS(fsys, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for line := range strings.Lines(stderr.String()) {
+		file, _, _ := strings.Cut(strings.TrimPrefix(line, "Warning: "), ":")
+		files = append(files, file)
+	}
+	if !slices.Equal(files, []string{"a.go", "b.go", "c.go"}) {
+		t.Errorf("warnings came in the order %q, want walk order:\n%s", files, stderr.String())
+	}
+}
+
+func TestWatcherProcessesSettledChanges(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newWatcher([]string{dir}, testConfig(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messy := filepath.Join(dir, "messy.go")
+	err = os.WriteFile(messy, []byte(misformattedSrc), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := filepath.Join(dir, "broken.go")
+	err = os.WriteFile(broken, []byte("package sample\n\nimport (\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	w.poll(&stdout, &stderr)
+	if stdout.Len() != 0 {
+		t.Fatalf("file was processed before it settled: %q", stdout.String())
+	}
+
+	w.poll(&stdout, &stderr)
+	if got := stdout.String(); got != "fixed: "+messy+"\n" {
+		t.Errorf("stdout = %q, want only the fixed file", got)
+	}
+	if stderr.Len() != 0 {
+		t.Errorf("unparsable file must be skipped quietly, got %q", stderr.String())
+	}
+
+	stdout.Reset()
+	w.poll(&stdout, &stderr)
+	if stdout.Len() != 0 {
+		t.Errorf("our own rewrite was picked up as a change: %q", stdout.String())
+	}
+}
+
+func TestRunExpandsRecursivePattern(t *testing.T) {
+	dir := t.TempDir()
+	nested := filepath.Join(dir, "cmd", "tool")
+	err := os.MkdirAll(nested, 0o750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messy := filepath.Join(nested, "main.go")
+	err = os.WriteFile(messy, []byte(misformattedSrc), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-internal-prefix=git.example.com/team", "-list", filepath.Join(dir, "cmd") + "/..."}, &stdout, &stderr)
+	if code != exitIssuesFound {
+		t.Fatalf("exit code = %d, want %d (stderr: %s)", code, exitIssuesFound, stderr.String())
+	}
+	if got := stdout.String(); got != messy+"\n" {
+		t.Errorf("stdout = %q, want %q", got, messy)
+	}
+
+	code = run([]string{"-internal-prefix=git.example.com/team", messy + "/..."}, &stdout, &stderr)
+	if code != exitError {
+		t.Errorf("pattern rooted at a file: exit code = %d, want %d", code, exitError)
+	}
+}
+
+func TestRunWarnsAboutBarePrefix(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "clean.go")
+	err := os.WriteFile(filePath, []byte("package sample\n\nimport \"fmt\"\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-internal-prefix=acme", filePath}, &stdout, &stderr)
+	if code != exitOK {
+		t.Errorf("exit code = %d, want %d", code, exitOK)
+	}
+	if !strings.Contains(stderr.String(), "Warning:") || !strings.Contains(stderr.String(), "github.com/acme") {
+		t.Errorf("stderr = %q, want a warning suggesting a full module path", stderr.String())
+	}
+
+	stderr.Reset()
+	run([]string{"-internal-prefix=acme", "-quiet", filePath}, &stdout, &stderr)
+	if stderr.Len() != 0 {
+		t.Errorf("-quiet must suppress the warning, got %q", stderr.String())
+	}
+}
+
+func TestRunExplain(t *testing.T) {
+	src := `package sample
+
+import (
+	"git.example.com/team/pkg"
+	"os"
+	errs "github.com/pkg/errors"
+	"fmt"
+)
+`
+	filePath := filepath.Join(t.TempDir(), "sample.go")
+	err := os.WriteFile(filePath, []byte(src), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"explain", "-internal-prefix=git.example.com/team", filePath}, &stdout, &stderr)
+	if code != exitOK {
+		t.Fatalf("exit code = %d, want %d (stderr: %s)", code, exitOK, stderr.String())
+	}
+	want := `POSITION  GROUP     LINE  IMPORT
+1         standard  7     "fmt"
+2         standard  5     "os"
+3         external  6     errs "github.com/pkg/errors"
+4         internal  4     "git.example.com/team/pkg"
+`
+	if got := stdout.String(); got != want {
+		t.Errorf("explain output mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != src {
+		t.Error("explain must not modify the file")
+	}
+}
+
+func TestFixKeepsModeAndSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "script.go")
+	err := os.WriteFile(filePath, []byte(misformattedSrc), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Set the mode explicitly so the umask doesn't get a say.
+	err = os.Chmod(filePath, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linkPath := filepath.Join(dir, "link.go")
+	err = os.Symlink("script.go", linkPath)
+	if err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+
+	verr, err := collectViolations(checkImports(linkPath, testConfig(true)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verr == nil || !verr.fixed {
+		t.Fatal("expected the file to be fixed")
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o755 {
+		t.Errorf("mode after fix = %v, want 0755", info.Mode().Perm())
+	}
+	if info, err := os.Lstat(linkPath); err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("link.go is no longer a symlink (err %v)", err)
+	}
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed, _ := runOnFile(t, testConfig(false), string(content)); changed {
+		t.Error("the symlink target was not rewritten")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("directory holds %d entries after fix, want 2 (temporary file left behind?)", len(entries))
+	}
+}
+
+func TestProcessFSReportsWithoutWritingReadOnlyFiles(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, src := range map[string]string{
+		"example.com/mod@v1.0.0/messy.go":         misformattedSrc,
+		"example.com/mod@v1.0.0/clean.go":         "package sample\n\nimport \"fmt\"\n",
+		"example.com/mod@v1.0.0/vendor/vendor.go": misformattedSrc,
+	} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.WriteString(w, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flagged, err := processFS(zr, testConfig(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flagged) != 1 || flagged[0].path != "example.com/mod@v1.0.0/messy.go" {
+		t.Fatalf("flagged = %v, want only messy.go", flagged)
+	}
+	if flagged[0].fixed {
+		t.Error("files in a read-only filesystem must not be reported as fixed")
+	}
+}
+
+// memFS is a writable in-memory filesystem, for testing the write path of
+// -fix without touching the disk. It is safe for concurrent use.
+type memFS struct {
+	mu    sync.Mutex
+	files fstest.MapFS
+}
+
+func (f *memFS) Open(name string) (fs.File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.files.Open(name)
+}
+
+func (f *memFS) ReadFile(name string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.files.ReadFile(name)
+}
+
+func (f *memFS) Stat(name string) (fs.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.files.Stat(name)
+}
+
+func (f *memFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.files[name] = &fstest.MapFile{Data: slices.Clone(data), Mode: perm}
+
+	return nil
+}
+
+func TestProcessFSFixesInMemory(t *testing.T) {
+	fixed := "package sample\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n"
+	fsys := &memFS{files: fstest.MapFS{
+		"clean.go":             {Data: []byte(fixed), Mode: 0o644},
+		"ro/generated.go":      {Data: []byte(misformattedSrc), Mode: 0o444},
+		"vendor/vendor.go":     {Data: []byte(misformattedSrc), Mode: 0o644},
+		"cmd/tool/main.go":     {Data: []byte(misformattedSrc), Mode: 0o755},
+		"internal/a/a.go":      {Data: []byte(misformattedSrc), Mode: 0o644},
+		"internal/b/b.go":      {Data: []byte(misformattedSrc), Mode: 0o644},
+		"internal/c/c.go":      {Data: []byte(misformattedSrc), Mode: 0o644},
+		"internal/d/d.go":      {Data: []byte(misformattedSrc), Mode: 0o644},
+		"internal/d/d.go.orig": {Data: []byte("stale"), Mode: 0o644},
+	}}
+	var stderr bytes.Buffer
+	cfg := testConfig(true)
+	cfg.log = &logger{out: &stderr}
+	cfg.jobs = 4
+	cfg.backupSuffix = ".orig"
+	flagged, err := processFS(fsys, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, file := range flagged {
+		paths = append(paths, fmt.Sprintf("%s fixed=%t", file.path, file.fixed))
+	}
+	want := []string{
+		"cmd/tool/main.go fixed=true",
+		"internal/a/a.go fixed=true",
+		"internal/b/b.go fixed=true",
+		"internal/c/c.go fixed=true",
+		"internal/d/d.go fixed=true",
+		"ro/generated.go fixed=false",
+	}
+	if !slices.Equal(paths, want) {
+		t.Errorf("flagged = %q, want %q", paths, want)
+	}
+	for _, name := range []string{"cmd/tool/main.go", "internal/a/a.go", "internal/d/d.go"} {
+		if got := string(fsys.files[name].Data); got != fixed {
+			t.Errorf("%s = %q, want %q", name, got, fixed)
+		}
+		if backup := fsys.files[name+".orig"]; backup == nil || string(backup.Data) != misformattedSrc {
+			t.Errorf("%s has no backup of the original", name)
+		}
+	}
+	if mode := fsys.files["cmd/tool/main.go"].Mode; mode != 0o755 {
+		t.Errorf("fixed file mode = %v, want %v", mode, fs.FileMode(0o755))
+	}
+	if got := string(fsys.files["ro/generated.go"].Data); got != misformattedSrc {
+		t.Errorf("read-only file was rewritten to %q", got)
+	}
+	if !strings.Contains(stderr.String(), "ro/generated.go is read-only") {
+		t.Errorf("stderr = %q, want a warning about the read-only file", stderr.String())
+	}
+}
+
+func TestRunSummaryCountsViolationKinds(t *testing.T) {
+	src := `package sample
+
+import (
+	"github.com/pkg/errors"
+	"os"
+	"fmt"
+
+	"strings"
+)
+`
+	filePath := filepath.Join(t.TempDir(), "sample.go")
+	err := os.WriteFile(filePath, []byte(src), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-internal-prefix=git.example.com/team", filePath}, &stdout, &stderr)
+	if code != exitIssuesFound {
+		t.Fatalf("exit code = %d, want %d", code, exitIssuesFound)
+	}
+	want := "1 file(s) need formatting (wrong-order: 1, extra-blank: 1, sort-order: 1)\n"
+	if got := stderr.String(); got != want {
+		t.Errorf("summary = %q, want %q", got, want)
+	}
+
+	stdout.Reset()
+	code = run([]string{"-internal-prefix=git.example.com/team", "-format=json", filePath}, &stdout, &stderr)
+	if code != exitIssuesFound {
+		t.Fatalf("exit code = %d, want %d", code, exitIssuesFound)
+	}
+	var report jsonReport
+	err = json.Unmarshal(stdout.Bytes(), &report)
+	if err != nil {
+		t.Fatalf("invalid JSON report: %v\n%s", err, stdout.String())
+	}
+	if len(report.Files) != 1 || len(report.Files[0].Violations) != 3 {
+		t.Errorf("report files = %+v, want one file with three violations", report.Files)
+	}
+	if report.Counts["wrong-order"] != 1 || report.Counts["extra-blank"] != 1 || report.Counts["sort-order"] != 1 {
+		t.Errorf("report counts = %v", report.Counts)
+	}
+}
+
+func TestRunSARIFReport(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "messy.go"), []byte(misformattedSrc), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-internal-prefix=git.example.com/team", "-format=sarif", "."}, &stdout, &stderr)
+	if code != exitIssuesFound {
+		t.Fatalf("exit code = %d, want %d (stderr: %s)", code, exitIssuesFound, stderr.String())
+	}
+
+	var log struct {
+		Version string `json:"version"`
+		Runs    []struct {
+			Tool struct {
+				Driver struct {
+					Name  string `json:"name"`
+					Rules []struct {
+						ID string `json:"id"`
+					} `json:"rules"`
+				} `json:"driver"`
+			} `json:"tool"`
+			Results []struct {
+				RuleID  string `json:"ruleId"`
+				Message struct {
+					Text string `json:"text"`
+				} `json:"message"`
+				Locations []struct {
+					PhysicalLocation struct {
+						ArtifactLocation struct {
+							URI string `json:"uri"`
+						} `json:"artifactLocation"`
+						Region struct {
+							StartLine   int `json:"startLine"`
+							StartColumn int `json:"startColumn"`
+						} `json:"region"`
+					} `json:"physicalLocation"`
+				} `json:"locations"`
+			} `json:"results"`
+		} `json:"runs"`
+	}
+	err = json.Unmarshal(stdout.Bytes(), &log)
+	if err != nil {
+		t.Fatalf("invalid SARIF: %v\n%s", err, stdout.String())
+	}
+	if log.Version != "2.1.0" || len(log.Runs) != 1 || log.Runs[0].Tool.Driver.Name != "import-tidy" {
+		t.Fatalf("unexpected SARIF envelope:\n%s", stdout.String())
+	}
+	if len(log.Runs[0].Tool.Driver.Rules) != len(violationKinds) {
+		t.Errorf("rules = %d, want one per violation kind", len(log.Runs[0].Tool.Driver.Rules))
+	}
+
+	results := log.Runs[0].Results
+	if len(results) != 1 || results[0].RuleID != string(violationSortOrder) || results[0].Message.Text == "" {
+		t.Fatalf("results = %+v, want one sort-order result", results)
+	}
+	loc := results[0].Locations[0].PhysicalLocation
+	if loc.ArtifactLocation.URI != "messy.go" || loc.Region.StartLine != 5 || loc.Region.StartColumn != 2 {
+		t.Errorf("location = %+v, want messy.go:5:2", loc)
+	}
+}
+
+func TestRunWarnsOnDirectoryWithoutGoFiles(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "README.md"), []byte("# docs\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-internal-prefix=git.example.com/team", dir}, &stdout, &stderr)
+	if code != exitOK {
+		t.Errorf("exit code = %d, want %d", code, exitOK)
+	}
+	if !strings.Contains(stderr.String(), "Warning: "+dir+": no Go files found") {
+		t.Errorf("stderr = %q, want a warning about the empty directory", stderr.String())
+	}
+
+	stderr.Reset()
+	code = run([]string{"-internal-prefix=git.example.com/team", "-error-on-empty", dir}, &stdout, &stderr)
+	if code != exitError {
+		t.Errorf("-error-on-empty exit code = %d, want %d", code, exitError)
+	}
+}
+
+const benchmarkCleanSrc = `package sample
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"git.example.com/team/pkg"
+)
+
+func main() {
+	fmt.Println(os.Args, strings.ToUpper("x"), errors.New("x"), pkg.Name)
+}
+`
+
+func BenchmarkProcessDirectoryClean(b *testing.B) {
+	dir := b.TempDir()
+	for i := range 2000 {
+		err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("f%04d.go", i)), []byte(benchmarkCleanSrc), 0o600)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	cfg := testConfig(true)
+
+	for b.Loop() {
+		flagged, err := processDirectory(dir, cfg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(flagged) != 0 {
+			b.Fatalf("%d clean files flagged", len(flagged))
+		}
+	}
+}
+
+// BenchmarkCheckImportsClean measures the per-file editor on-save case:
+// -fix on a single file that is already tidy, which must not write.
+func BenchmarkCheckImportsClean(b *testing.B) {
+	filePath := filepath.Join(b.TempDir(), "clean.go")
+	err := os.WriteFile(filePath, []byte(benchmarkCleanSrc), 0o600)
+	if err != nil {
+		b.Fatal(err)
+	}
+	cfg := testConfig(true)
+	b.ReportAllocs()
+
+	for b.Loop() {
+		err := checkImports(filePath, cfg)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkCheckImportsLargeFile compares a full parse of a large, tidy
+// file with the -assume-gofmt parse that stops after the imports.
+func BenchmarkCheckImportsLargeFile(b *testing.B) {
+	var src strings.Builder
+	src.WriteString(benchmarkCleanSrc)
+	for i := range 5000 {
+		_, _ = fmt.Fprintf(&src, "\nfunc f%d() string {\n\treturn fmt.Sprint(os.Args, %d)\n}\n", i, i)
+	}
+	filePath := filepath.Join(b.TempDir(), "large.go")
+	err := os.WriteFile(filePath, []byte(src.String()), 0o600)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, assumeGofmt := range []bool{false, true} {
+		b.Run(fmt.Sprintf("assume-gofmt=%t", assumeGofmt), func(b *testing.B) {
+			cfg := testConfig(true)
+			cfg.assumeGofmt = assumeGofmt
+			b.ReportAllocs()
+
+			for b.Loop() {
+				err := checkImports(filePath, cfg)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
 	}
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// prompter asks, for -interactive, whether each fix should be written.
+// Files are checked one at a time in that mode, so it needs no locking.
+type prompter struct {
+	in   *bufio.Reader
+	out  io.Writer
+	all  bool // write the remaining fixes without asking
+	quit bool // write no more fixes
+}
+
+func newPrompter(in io.Reader, out io.Writer) *prompter {
+	return &prompter{in: bufio.NewReader(in), out: out}
+}
+
+// confirm shows the diff a fix would make to the file at path and asks
+// whether to write it. End of input is taken as quit.
+func (p *prompter) confirm(path string, original, fixed []byte) bool {
+	switch {
+	case p.all:
+		return true
+	case p.quit:
+		return false
+	}
+
+	_, _ = p.out.Write(unifiedDiff(path+".orig", path, original, fixed))
+	for {
+		_, _ = fmt.Fprintf(p.out, "Write %s? [y]es/[n]o/[a]ll/[q]uit: ", path)
+		answer, err := p.in.ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			return true
+		case "n", "no":
+			return false
+		case "a", "all":
+			p.all = true
+
+			return true
+		case "q", "quit":
+			p.quit = true
+
+			return false
+		}
+		if err != nil {
+			fprintln(p.out)
+			p.quit = true
+
+			return false
+		}
+	}
+}
+
+// isTerminal reports whether f is a character device, which is as close
+// as the standard library gets to asking whether it is a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
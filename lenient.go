@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+)
+
+var (
+	importBlockStart = regexp.MustCompile(`^import\s*\(\s*$`)
+	importBlockEnd   = regexp.MustCompile(`^\)\s*$`)
+)
+
+// maskImportBlock supports -lenient-parse for files that are not valid Go,
+// such as code generation templates. It locates the first parenthesized
+// import block textually and returns a stand-in source of the same number
+// of lines: a package clause, the block verbatim, and blank lines for
+// everything else. Parsing the stand-in yields import positions that match
+// the original file line for line.
+//
+// Only a block whose "import (" and ")" lines stand alone is recognized, and
+// the block itself must be valid Go: template actions inside it, or imports
+// outside it, defeat the fallback.
+func maskImportBlock(content []byte) ([]byte, bool) {
+	lines := bytes.Split(content, []byte("\n"))
+	start, end := -1, -1
+	for i, line := range lines {
+		switch {
+		case start < 0 && importBlockStart.Match(line):
+			start = i
+		case start >= 0 && importBlockEnd.Match(line):
+			end = i
+		}
+		if end >= 0 {
+			break
+		}
+	}
+	// The package clause needs a line of its own before the block.
+	if start < 1 || end < 0 {
+		return nil, false
+	}
+
+	masked := make([][]byte, len(lines))
+	masked[0] = []byte("package lenient")
+	copy(masked[start:end+1], lines[start:end+1])
+
+	return bytes.Join(masked, []byte("\n")), true
+}
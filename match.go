@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// pathMatcher reports whether an import path satisfies a classification
+// expression.
+type pathMatcher func(importPath string) bool
+
+// compileMatcher compiles a boolean expression over the import path, such as
+//
+//	hasPrefix("golang.org/x/") || (contains("/proto/") && !matches(`_test$`))
+//
+// The expression uses Go syntax, so it is parsed with go/parser and walked
+// once up front; regular expressions are compiled at this point too, so a
+// bad pattern is reported before any file is touched.
+func compileMatcher(src string) (pathMatcher, error) {
+	expr, err := parser.ParseExpr(src)
+	if err != nil {
+		return nil, err
+	}
+
+	return compileExpr(expr)
+}
+
+func compileExpr(expr ast.Expr) (pathMatcher, error) {
+	switch e := expr.(type) {
+	case *ast.ParenExpr:
+		return compileExpr(e.X)
+	case *ast.UnaryExpr:
+		if e.Op != token.NOT {
+			return nil, fmt.Errorf("unsupported operator %s", e.Op)
+		}
+		x, err := compileExpr(e.X)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(p string) bool { return !x(p) }, nil
+	case *ast.BinaryExpr:
+		if e.Op != token.LAND && e.Op != token.LOR {
+			return nil, fmt.Errorf("unsupported operator %s", e.Op)
+		}
+		x, err := compileExpr(e.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := compileExpr(e.Y)
+		if err != nil {
+			return nil, err
+		}
+		if e.Op == token.LAND {
+			return func(p string) bool { return x(p) && y(p) }, nil
+		}
+
+		return func(p string) bool { return x(p) || y(p) }, nil
+	case *ast.CallExpr:
+		return compileCall(e)
+	}
+
+	return nil, fmt.Errorf("unsupported expression %T (want hasPrefix, contains, or matches combined with &&, ||, !)", expr)
+}
+
+func compileCall(call *ast.CallExpr) (pathMatcher, error) {
+	fn, ok := call.Fun.(*ast.Ident)
+	if !ok {
+		return nil, errors.New("unsupported function call")
+	}
+	if len(call.Args) != 1 {
+		return nil, fmt.Errorf("%s takes exactly one string argument", fn.Name)
+	}
+	lit, ok := call.Args[0].(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return nil, fmt.Errorf("%s takes exactly one string argument", fn.Name)
+	}
+	arg, err := strconv.Unquote(lit.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	switch fn.Name {
+	case "hasPrefix":
+		return func(p string) bool { return strings.HasPrefix(p, arg) }, nil
+	case "contains":
+		return func(p string) bool { return strings.Contains(p, arg) }, nil
+	case "matches":
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, err
+		}
+
+		return re.MatchString, nil
+	}
+
+	return nil, fmt.Errorf("unknown function %q (valid: hasPrefix, contains, matches)", fn.Name)
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"cmp"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// stdPackagesByName indexes the standard library packages of Go release
+// goVersion by the name they are referred to by, for -add-missing. Each is
+// named after the last element of its path, minus a major version suffix,
+// which is what assumedName computes.
+func stdPackagesByName(goVersion string) (map[string][]string, error) {
+	packages, err := stdPackages(goVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string][]string)
+	for _, importPath := range slices.Sorted(maps.Keys(packages)) {
+		if importPath == "C" {
+			continue
+		}
+		name := assumedName(importPath)
+		byName[name] = append(byName[name], importPath)
+	}
+
+	return byName, nil
+}
+
+// findMissing records, for -add-missing, the imports the file refers to
+// without importing them: each package name used as the X of a selector
+// that resolves to nothing in the file, is not the name of an import, and
+// is not declared at the top level of another file of the same package in
+// its directory. Standard library packages come first, as with goimports;
+// only a name none of them has is looked up in the packages of the file's
+// module (see packageIndex). A name shared by several packages, such as
+// rand, is reported as a warning and left to the user.
+func (f *sourceFile) findMissing(cfg config, fsys fs.FS, name string, astFile *ast.File) {
+	if !cfg.addMissing || cfg.disabled[violationMissing] {
+		return
+	}
+
+	imported := make(map[string]bool, len(f.imports))
+	for _, imp := range f.imports {
+		imported[imp.localName()] = true
+	}
+	var declared map[string]bool
+	var module *modulePackages
+	fileImportPath := ""
+	tf := f.fset.File(astFile.Package)
+	names := slices.SortedFunc(maps.Keys(f.pkgRefs), func(a, b string) int {
+		return cmp.Compare(f.pkgRefs[a][0], f.pkgRefs[b][0])
+	})
+	for _, pkgName := range names {
+		if imported[pkgName] {
+			continue
+		}
+		candidates := cfg.stdByName[pkgName]
+		if len(candidates) == 0 && cfg.packages != nil {
+			if module == nil {
+				module, fileImportPath = cfg.packages.lookup(fsys, name)
+			}
+			candidates = module.importable(pkgName, fileImportPath, strings.HasSuffix(astFile.Name.Name, "_test"))
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+		if declared == nil {
+			declared = siblingDecls(fsys, name, astFile.Name.Name)
+		}
+		if declared[pkgName] {
+			continue
+		}
+		pos := tf.Position(tf.Pos(f.pkgRefs[pkgName][0]))
+		if len(candidates) > 1 {
+			cfg.log.warnf("%s:%d: %s could be any of %s; add the import yourself",
+				f.path, pos.Line, pkgName, strings.Join(candidates, ", "))
+
+			continue
+		}
+		f.added = append(f.added, importInfo{
+			path:    candidates[0],
+			literal: strconv.Quote(candidates[0]),
+			group:   determineImportGroup(candidates[0], cfg),
+			line:    pos.Line,
+			column:  pos.Column,
+		})
+	}
+}
+
+// siblingDecls returns the names declared at the top level of the other .go
+// files of package pkg in the directory of name, which the file can use
+// without importing anything. Files that cannot be read or parsed are
+// skipped, as is the whole directory when it cannot be listed, e.g. for
+// standard input.
+func siblingDecls(fsys fs.FS, name, pkg string) map[string]bool {
+	declared := make(map[string]bool)
+	dir := path.Dir(name)
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return declared
+	}
+
+	for _, entry := range entries {
+		sibling := path.Join(dir, entry.Name())
+		if entry.IsDir() || !strings.HasSuffix(sibling, ".go") || sibling == path.Clean(name) {
+			continue
+		}
+		content, err := fs.ReadFile(fsys, sibling)
+		if err != nil {
+			continue
+		}
+		file, err := parser.ParseFile(token.NewFileSet(), sibling, content, parser.SkipObjectResolution)
+		if err != nil || file.Name.Name != pkg {
+			continue
+		}
+		for _, decl := range file.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				if decl.Recv == nil {
+					declared[decl.Name.Name] = true
+				}
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					switch spec := spec.(type) {
+					case *ast.ValueSpec:
+						for _, ident := range spec.Names {
+							declared[ident.Name] = true
+						}
+					case *ast.TypeSpec:
+						declared[spec.Name.Name] = true
+					}
+				}
+			}
+		}
+	}
+
+	return declared
+}
+
+// packageIndex finds, for -add-missing, the packages outside the standard
+// library a file can import: those of its module, found in the directory
+// of its go.mod, and those of the modules it requires, found in its vendor
+// directory when there is one and in the module cache otherwise, or in the
+// directory a replace directive gives. Modules that were never downloaded
+// have no packages. Each module is indexed on first use and the files of a
+// directory share their go.mod, so lookups are cached by directory; files
+// are checked concurrently, hence the mutex.
+type packageIndex struct {
+	mu      sync.Mutex
+	byDir   map[string]*modulePackages
+	byGoMod map[string]*modulePackages
+}
+
+// modulePackages indexes the import paths of the packages a module can
+// reach by the name in their package clause.
+type modulePackages struct {
+	root   string // the directory of the go.mod
+	module string
+	byName map[string][]string
+}
+
+func newPackageIndex() *packageIndex {
+	return &packageIndex{
+		byDir:   make(map[string]*modulePackages),
+		byGoMod: make(map[string]*modulePackages),
+	}
+}
+
+// lookup returns the packages of the module of the file name, nil if it
+// has none, and the import path of the file's directory.
+func (p *packageIndex) lookup(fsys fs.FS, name string) (*modulePackages, string) {
+	dir, err := fileDir(fsys, name)
+	if err != nil {
+		return nil, ""
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	mod, ok := p.byDir[dir]
+	if !ok {
+		if goMod, err := findGoMod(dir); err == nil {
+			if mod, ok = p.byGoMod[goMod]; !ok {
+				mod = indexModule(goMod)
+				p.byGoMod[goMod] = mod
+			}
+		}
+		p.byDir[dir] = mod
+	}
+	if mod == nil {
+		return nil, ""
+	}
+	rel, err := filepath.Rel(mod.root, dir)
+	if err != nil {
+		return mod, ""
+	}
+
+	return mod, path.Join(mod.module, filepath.ToSlash(rel))
+}
+
+// indexModule indexes the packages the module of the go.mod at goModPath
+// can reach, or returns nil if that go.mod cannot be read.
+func indexModule(goModPath string) *modulePackages {
+	mod, err := loadGoMod(goModPath)
+	if err != nil {
+		return nil
+	}
+
+	root := filepath.Dir(goModPath)
+	packages := &modulePackages{root: root, module: mod.module, byName: make(map[string][]string)}
+	packages.add(root, mod.module)
+	vendor := filepath.Join(root, "vendor")
+	if _, err := os.Stat(filepath.Join(vendor, "modules.txt")); err == nil {
+		packages.add(vendor, "")
+	} else {
+		cache := moduleCache()
+		for _, req := range mod.require {
+			dir := ""
+			switch {
+			case mod.replaceDirs[req] != "":
+				dir = mod.replaceDirs[req]
+				if !filepath.IsAbs(dir) {
+					dir = filepath.Join(root, filepath.FromSlash(dir))
+				}
+			case mod.replaced[req] != "":
+				dir = cachedModuleDir(cache, mod.replaced[req], mod.versions[mod.replaced[req]])
+			default:
+				dir = cachedModuleDir(cache, req, mod.versions[req])
+			}
+			if dir != "" {
+				packages.add(dir, req)
+			}
+		}
+	}
+	for name, paths := range packages.byName {
+		slices.Sort(paths)
+		packages.byName[name] = slices.Compact(paths)
+	}
+
+	return packages
+}
+
+// add indexes the packages in the tree at dir, whose import paths start
+// with importPrefix. Nested modules, which have a go.mod of their own, are
+// left out, as are the directories the go command ignores.
+func (m *modulePackages) add(dir, importPrefix string) {
+	_ = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if p != dir {
+			base := d.Name()
+			if base == "vendor" || base == "testdata" || strings.HasPrefix(base, ".") || strings.HasPrefix(base, "_") {
+				return filepath.SkipDir
+			}
+			if _, err := os.Stat(filepath.Join(p, "go.mod")); err == nil {
+				return filepath.SkipDir
+			}
+		}
+		name := packageName(p)
+		if name == "" || name == "main" {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return nil
+		}
+		importPath := path.Join(importPrefix, filepath.ToSlash(rel))
+		m.byName[name] = append(m.byName[name], importPath)
+
+		return nil
+	})
+}
+
+// packageName returns the name in the package clause of the first non-test
+// .go file in dir, or "" if there is none.
+func packageName(dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(token.NewFileSet(), filepath.Join(dir, name), nil, parser.PackageClauseOnly)
+		if err == nil {
+			return file.Name.Name
+		}
+	}
+
+	return ""
+}
+
+// importable returns the packages named name that a file whose directory
+// has the import path from may import: neither its own package, unless the
+// file is an external test, nor an internal package of another tree.
+func (m *modulePackages) importable(name, from string, externalTest bool) []string {
+	if m == nil {
+		return nil
+	}
+
+	var paths []string
+	for _, importPath := range m.byName[name] {
+		if importPath == from && !externalTest {
+			continue
+		}
+		if i := strings.LastIndex(importPath+"/", "/internal/"); i >= 0 && !hasPathPrefix(from, importPath[:i]) {
+			continue
+		}
+		paths = append(paths, importPath)
+	}
+
+	return paths
+}
+
+// moduleCache returns the directory of the module cache, as the go command
+// finds it: $GOMODCACHE, or pkg/mod in the first entry of $GOPATH.
+func moduleCache() string {
+	if dir := os.Getenv("GOMODCACHE"); dir != "" {
+		return dir
+	}
+	gopath, _, _ := strings.Cut(build.Default.GOPATH, string(filepath.ListSeparator))
+	if gopath == "" {
+		return ""
+	}
+
+	return filepath.Join(gopath, "pkg", "mod")
+}
+
+// cachedModuleDir returns the directory of version of the module
+// modulePath in the module cache, or "" without a version or a cache. Upper
+// case letters are escaped there as ! and the lower case letter, so the
+// directories work on case-insensitive file systems.
+func cachedModuleDir(cache, modulePath, version string) string {
+	if cache == "" || version == "" {
+		return ""
+	}
+
+	return filepath.Join(cache, filepath.FromSlash(escapeModulePath(modulePath)+"@"+escapeModulePath(version)))
+}
+
+func escapeModulePath(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if unicode.IsUpper(r) {
+			b.WriteByte('!')
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// writeFileFS is a filesystem -fix can write back to. Files found on any
+// other fs.FS, such as a module zip, are only ever reported.
+type writeFileFS interface {
+	fs.FS
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+}
+
+// osFS is an fs.FS rooted at an OS directory, like os.DirFS, that can also
+// write files. Errors carry the full OS path rather than the name relative
+// to the root, so they stay meaningful when printed.
+type osFS struct {
+	dir string
+	// outDir, when set, receives written files instead of the originals,
+	// in a tree mirroring their paths relative to the working directory
+	// (-out-dir).
+	outDir string
+}
+
+func newOSFS(dir, outDir string) osFS {
+	return osFS{dir: dir, outDir: outDir}
+}
+
+func (f osFS) path(name string) string {
+	return filepath.Join(f.dir, filepath.FromSlash(name))
+}
+
+func (f osFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	return os.Open(f.path(name))
+}
+
+func (f osFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(f.path(name))
+}
+
+func (f osFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(f.path(name))
+}
+
+func (f osFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(f.path(name))
+}
+
+// WriteFile replaces the named file atomically: the data goes to a
+// temporary file in the same directory, which is renamed over the original
+// once complete, so an interrupted run never leaves a truncated file behind.
+// Symlinks are resolved first so the link itself survives; a file that
+// doesn't exist yet, such as a -backup copy, is created.
+func (f osFS) WriteFile(name string, data []byte, perm fs.FileMode) (err error) {
+	if f.outDir != "" {
+		return f.writeMirrored(name, data, perm)
+	}
+	target, err := filepath.EvalSymlinks(f.path(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		target, err = f.path(name), nil
+	}
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	// CreateTemp always uses 0600; without this the rename would quietly
+	// strip the executable bit and group/other permissions.
+	err = os.Chmod(tmp.Name(), perm)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), target)
+}
+
+// writeMirrored writes the named file under outDir at its path relative
+// to the working directory, creating the directories on the way, and
+// leaves the original alone.
+func (f osFS) writeMirrored(name string, data []byte, perm fs.FileMode) error {
+	abs, err := filepath.Abs(f.path(name))
+	if err != nil {
+		return err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil || !filepath.IsLocal(rel) {
+		return fmt.Errorf("%s: -out-dir only mirrors files below the working directory", f.path(name))
+	}
+
+	target := filepath.Join(f.outDir, rel)
+	err = os.MkdirAll(filepath.Dir(target), 0o755)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(target, data, perm)
+}
+
+// displayPath is the name a file is reported under: its OS path when it
+// lives on disk, and its name within fsys otherwise.
+func displayPath(fsys fs.FS, name string) string {
+	if f, ok := fsys.(osFS); ok {
+		return f.path(name)
+	}
+
+	return name
+}
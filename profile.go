@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// startProfiles starts the CPU profile of -cpuprofile. The returned stop
+// function ends it and writes the heap profile of -memprofile; run defers it
+// so profiles cover the whole run, whatever the exit path.
+func startProfiles(cfg config) (func() error, error) {
+	var cpuFile *os.File
+	if cfg.cpuProfile != "" {
+		f, err := os.Create(cfg.cpuProfile)
+		if err != nil {
+			return nil, err
+		}
+		err = pprof.StartCPUProfile(f)
+		if err != nil {
+			_ = f.Close()
+
+			return nil, err
+		}
+		cpuFile = f
+	}
+
+	return func() error {
+		var errs []error
+		if cpuFile != nil {
+			pprof.StopCPUProfile()
+			errs = append(errs, cpuFile.Close())
+		}
+		if cfg.memProfile != "" {
+			errs = append(errs, writeHeapProfile(cfg.memProfile))
+		}
+
+		return errors.Join(errs...)
+	}, nil
+}
+
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	// Collect first so the profile shows live memory, as go test does.
+	runtime.GC()
+	err = pprof.WriteHeapProfile(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
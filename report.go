@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Output formats accepted by -format.
+const (
+	formatText  = "text"
+	formatJSON  = "json"
+	formatSARIF = "sarif"
+)
+
+// violationKinds lists every kind in the order summaries print them.
+var violationKinds = []violationKind{
+	violationMultipleDecls,
+	violationWrongOrder,
+	violationMissingBlank,
+	violationExtraBlank,
+	violationSortOrder,
+	violationSharedLine,
+	violationDuplicate,
+	violationLongLine,
+	violationBlankAfterParen,
+	violationBlankBeforeParen,
+	violationBlankAfterDecl,
+	violationAlias,
+	violationLayout,
+	violationBanned,
+	violationUnused,
+	violationMissing,
+}
+
+func countViolations(flagged []*violationError) map[violationKind]int {
+	counts := make(map[violationKind]int)
+	for _, file := range flagged {
+		for _, v := range file.violations {
+			counts[v.kind]++
+		}
+	}
+
+	return counts
+}
+
+// importMove records, for -rewrite-report, where a fix took an import:
+// from which line to which, and from the group it sat with, the one most
+// imports of its blank-line separated run belonged to, to its own.
+type importMove struct {
+	path               string
+	fromLine, toLine   int
+	fromGroup, toGroup importGroup
+	unused             bool
+}
+
+func (m importMove) String() string {
+	s := fmt.Sprintf("%q: line %d -> line %d", m.path, m.fromLine, m.toLine)
+	switch {
+	case m.unused:
+		return fmt.Sprintf("%q: line %d removed as unused", m.path, m.fromLine)
+	case m.toLine == 0:
+		s = fmt.Sprintf("%q: line %d removed as a duplicate", m.path, m.fromLine)
+	}
+	if m.fromGroup != m.toGroup {
+		s += fmt.Sprintf(", group %s -> %s", m.fromGroup, m.toGroup)
+	}
+
+	return s
+}
+
+// moves returns the imports the fix to fixed moves, in their original order.
+// Imports are matched by name and path, so it runs after the aliases are
+// applied.
+func (f *sourceFile) moves(fixed []byte) []importMove {
+	fset := token.NewFileSet()
+	astFile, err := parser.ParseFile(fset, f.path, fixed, parser.ImportsOnly)
+	if err != nil && f.lenientSource != nil {
+		if masked, ok := maskImportBlock(fixed); ok {
+			astFile, err = parser.ParseFile(fset, f.path, masked, parser.ImportsOnly)
+		}
+	}
+	if err != nil {
+		return nil
+	}
+	newLines := make(map[importKey][]int)
+	for _, spec := range astFile.Imports {
+		var key importKey
+		key.path, err = strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			return nil
+		}
+		if spec.Name != nil {
+			key.name = spec.Name.Name
+		}
+		newLines[key] = append(newLines[key], fset.Position(spec.Pos()).Line)
+	}
+
+	var moves []importMove
+	for i, imp := range f.imports {
+		m := importMove{path: imp.path, fromLine: imp.line, fromGroup: f.runGroup(i), toGroup: imp.group, unused: imp.unused}
+		if lines := newLines[imp.key()]; len(lines) > 0 {
+			m.toLine, newLines[imp.key()] = lines[0], lines[1:]
+		}
+		if m.fromLine != m.toLine || m.fromGroup != m.toGroup {
+			moves = append(moves, m)
+		}
+	}
+
+	return moves
+}
+
+// runGroup returns the group most imports of the run of the i-th import
+// belong to: the imports around it with no blank line or declaration
+// boundary between them. Ties go to the group that comes first in the run.
+func (f *sourceFile) runGroup(i int) importGroup {
+	start, end := i, i+1
+	for start > 0 && f.imports[start].startLine-f.imports[start-1].endLine <= 1 {
+		start--
+	}
+	for end < len(f.imports) && f.imports[end].startLine-f.imports[end-1].endLine <= 1 {
+		end++
+	}
+
+	counts := make(map[importGroup]int)
+	best := f.imports[start].group
+	for _, imp := range f.imports[start:end] {
+		counts[imp.group]++
+		if counts[imp.group] > counts[best] {
+			best = imp.group
+		}
+	}
+
+	return best
+}
+
+// printSummary writes a one-line tally of the run, e.g.
+// "2 file(s) need formatting (wrong-order: 2, missing-blank: 1)".
+func printSummary(w io.Writer, cfg config, flagged []*violationError) {
+	if len(flagged) == 0 {
+		return
+	}
+
+	counts := countViolations(flagged)
+	parts := make([]string, 0, len(counts))
+	for _, kind := range violationKinds {
+		if counts[kind] > 0 {
+			parts = append(parts, fmt.Sprintf("%s: %d", kind, counts[kind]))
+		}
+	}
+
+	verb := "need formatting"
+	if cfg.fix {
+		verb = "fixed"
+	}
+	_, _ = fmt.Fprintf(w, "%d file(s) %s (%s)\n", len(flagged), verb, strings.Join(parts, ", "))
+}
+
+type jsonReport struct {
+	Files  []jsonFile     `json:"files"`
+	Counts map[string]int `json:"counts"`
+}
+
+type jsonFile struct {
+	Path       string          `json:"path"`
+	Fixed      bool            `json:"fixed"`
+	Violations []jsonViolation `json:"violations"`
+	Moves      []jsonMove      `json:"moves,omitempty"`
+}
+
+// jsonMove is an importMove; a to_line of 0 means the import was dropped
+// as a duplicate.
+type jsonMove struct {
+	Import    string `json:"import"`
+	FromLine  int    `json:"from_line"`
+	ToLine    int    `json:"to_line"`
+	FromGroup string `json:"from_group"`
+	ToGroup   string `json:"to_group"`
+}
+
+type jsonViolation struct {
+	Kind    string `json:"kind"`
+	Line    int    `json:"line"`
+	Import  string `json:"import,omitempty"`
+	Message string `json:"message"`
+}
+
+func writeJSONReport(w io.Writer, flagged []*violationError) error {
+	report := jsonReport{
+		Files:  make([]jsonFile, 0, len(flagged)),
+		Counts: make(map[string]int),
+	}
+	for _, file := range flagged {
+		entry := jsonFile{Path: file.path, Fixed: file.fixed}
+		for _, v := range file.violations {
+			entry.Violations = append(entry.Violations, jsonViolation{
+				Kind:    string(v.kind),
+				Line:    v.line,
+				Import:  v.path,
+				Message: v.String(),
+			})
+		}
+		for _, m := range file.moves {
+			entry.Moves = append(entry.Moves, jsonMove{
+				Import:    m.path,
+				FromLine:  m.fromLine,
+				ToLine:    m.toLine,
+				FromGroup: m.fromGroup.String(),
+				ToGroup:   m.toGroup.String(),
+			})
+		}
+		report.Files = append(report.Files, entry)
+	}
+	for kind, n := range countViolations(flagged) {
+		report.Counts[string(kind)] = n
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(report)
+}
+
+// ruleDescriptions documents each violation kind as a SARIF rule.
+var ruleDescriptions = map[violationKind]string{
+	violationMultipleDecls:    "Imports are split across multiple import declarations.",
+	violationWrongOrder:       "An import group appears out of the configured group order.",
+	violationMissingBlank:     "Two import groups are not separated by a blank line.",
+	violationExtraBlank:       "A blank line splits an import group.",
+	violationSortOrder:        "Imports within a group are not sorted.",
+	violationSharedLine:       "Several imports share one line.",
+	violationDuplicate:        "The same import appears more than once.",
+	violationLongLine:         "A trailing import comment makes the line too long.",
+	violationBlankAfterParen:  "A blank line follows the opening parenthesis of the import block.",
+	violationBlankBeforeParen: "A blank line precedes the closing parenthesis of the import block.",
+	violationBlankAfterDecl:   "The import declaration is not followed by exactly one blank line.",
+	violationAlias:            "An import does not use the alias the configuration requires.",
+	violationLayout:           "The import declaration is otherwise not laid out the way fixing would write it.",
+	violationBanned:           "An import is on the banned list of the configuration.",
+	violationUnused:           "An import is not used in the file.",
+	violationMissing:          "A package is used in the file but not imported.",
+}
+
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           sarifRegion           `json:"region"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+}
+
+// writeSARIFReport emits a minimal SARIF 2.1.0 log with one result per
+// violation at the given level, suitable for GitHub code scanning.
+func writeSARIFReport(w io.Writer, flagged []*violationError, level string) error {
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name:           "import-tidy",
+			InformationURI: "https://github.com/towiron/import-tidy",
+		}},
+		Results: []sarifResult{},
+	}
+	for _, kind := range violationKinds {
+		run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{
+			ID:               string(kind),
+			ShortDescription: sarifMessage{Text: ruleDescriptions[kind]},
+		})
+	}
+
+	for _, file := range flagged {
+		for _, v := range file.violations {
+			run.Results = append(run.Results, sarifResult{
+				RuleID:  string(v.kind),
+				Level:   level,
+				Message: sarifMessage{Text: v.String()},
+				Locations: []sarifLocation{{PhysicalLocation: sarifPhysicalLocation{
+					ArtifactLocation: sarifArtifactLocation{URI: sarifURI(file.path)},
+					Region:           sarifRegion{StartLine: v.line, StartColumn: v.column},
+				}}},
+			})
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(sarifLog{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs:    []sarifRun{run},
+	})
+}
+
+// sarifURI turns a file path into a URI reference: relative paths stay
+// relative to the repository root, absolute ones become file:// URIs.
+func sarifURI(path string) string {
+	slashed := filepath.ToSlash(path)
+	if filepath.IsAbs(path) {
+		if !strings.HasPrefix(slashed, "/") {
+			slashed = "/" + slashed // Windows drive letter
+		}
+
+		return (&url.URL{Scheme: "file", Path: slashed}).String()
+	}
+
+	return (&url.URL{Path: slashed}).String()
+}
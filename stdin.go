@@ -0,0 +1,134 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// stdinPath is the path argument that reads the source from stdin.
+const stdinPath = "-"
+
+// stdinFS serves the source read from stdin, or the file -stdout reads, as
+// its only file, and keeps what -fix writes back so it can be printed
+// instead.
+type stdinFS struct {
+	name    string
+	data    []byte
+	written []byte
+}
+
+func (f *stdinFS) Open(name string) (fs.File, error) {
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+}
+
+func (f *stdinFS) ReadFile(name string) ([]byte, error) {
+	if name != f.name {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
+	}
+	if f.written != nil {
+		return f.written, nil
+	}
+
+	return f.data, nil
+}
+
+func (f *stdinFS) Stat(name string) (fs.FileInfo, error) {
+	if name != f.name {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return stdinInfo{f}, nil
+}
+
+func (f *stdinFS) WriteFile(name string, data []byte, _ fs.FileMode) error {
+	if name != f.name {
+		return &fs.PathError{Op: "write", Path: name, Err: fs.ErrNotExist}
+	}
+	f.written = data
+
+	return nil
+}
+
+type stdinInfo struct {
+	f *stdinFS
+}
+
+func (i stdinInfo) Name() string       { return i.f.name }
+func (i stdinInfo) Size() int64        { return int64(len(i.f.data)) }
+func (i stdinInfo) Mode() fs.FileMode  { return 0o644 }
+func (i stdinInfo) ModTime() time.Time { return time.Time{} }
+func (i stdinInfo) IsDir() bool        { return false }
+func (i stdinInfo) Sys() any           { return nil }
+
+// runStdin handles the path argument "-". The source is reported under
+// -stdin-filename, the path an editor knows the buffer by. With -fix the
+// tidied source, or the source itself when it is already tidy, goes to
+// stdout for the editor to replace its buffer with; otherwise violations
+// are reported as for any file.
+func runStdin(in io.Reader, cfg config, stdout, stderr io.Writer) int {
+	data, err := io.ReadAll(in)
+	if err != nil {
+		fprintln(stderr, "Error:", err)
+
+		return exitError
+	}
+
+	return runBuffer(&stdinFS{name: cmp.Or(cfg.stdinFilename, "<standard input>"), data: data}, cfg, stdout, stderr)
+}
+
+// runStdout handles -stdout: the file at path is read, and tidied as with
+// -fix, but the result goes to stdout instead of back to the file.
+func runStdout(path string, cfg config, stdout, stderr io.Writer) int {
+	info, err := os.Stat(path)
+	if err == nil && info.IsDir() {
+		err = fmt.Errorf("-stdout needs a file, and %s is a directory", path)
+	}
+	var data []byte
+	if err == nil {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		fprintln(stderr, "Error:", err)
+
+		return exitError
+	}
+	cfg.fix = true
+
+	return runBuffer(&stdinFS{name: path, data: data}, cfg, stdout, stderr)
+}
+
+// runBuffer checks the single file fsys serves. With -fix the tidied
+// source, or the source itself when it is already tidy, goes to stdout.
+func runBuffer(fsys *stdinFS, cfg config, stdout, stderr io.Writer) int {
+	verr, err := collectViolations(checkFile(fsys, fsys.name, cfg))
+	if err != nil {
+		fprintln(stderr, "Error:", err)
+
+		return exitError
+	}
+	if cfg.fix {
+		data := fsys.data
+		if fsys.written != nil {
+			data = fsys.written
+		}
+		_, err = stdout.Write(data)
+		if err != nil {
+			fprintln(stderr, "Error:", err)
+
+			return exitError
+		}
+
+		return exitOK
+	}
+
+	var flagged []*violationError
+	if verr != nil {
+		flagged = append(flagged, verr)
+	}
+
+	return reportResults(cfg, flagged, false, stdout, stderr)
+}
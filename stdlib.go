@@ -0,0 +1,43 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"go/version"
+	"strings"
+)
+
+//go:embed stdlib.txt
+var stdlibList string
+
+// stdlibVersion is the newest Go release stdlib.txt covers, the default
+// for -go-version.
+const stdlibVersion = "go1.27"
+
+// stdPackages returns the standard library packages of Go release
+// goVersion, for -std-list, which classifies imports by the actual package
+// list instead of the dot heuristic.
+func stdPackages(goVersion string) (map[string]bool, error) {
+	if !strings.HasPrefix(goVersion, "go") {
+		goVersion = "go" + goVersion
+	}
+	if !version.IsValid(goVersion) {
+		return nil, fmt.Errorf("invalid -go-version %q", strings.TrimPrefix(goVersion, "go"))
+	}
+
+	// "C" is the cgo pseudo-package, which gofmt and goimports group with
+	// the standard library.
+	packages := map[string]bool{"C": true}
+	for line := range strings.Lines(stdlibList) {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 1 && version.Compare(fields[1], goVersion) > 0 {
+			continue
+		}
+		packages[fields[0]] = true
+	}
+
+	return packages, nil
+}
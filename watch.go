@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"time"
+)
+
+// watchInterval is how often -watch polls the targets. A changed file is
+// only processed once it has looked the same for a full interval, which
+// debounces editors that save in several steps.
+const watchInterval = 500 * time.Millisecond
+
+type fileStamp struct {
+	size    int64
+	modTime int64
+}
+
+func stampOf(info fs.FileInfo) fileStamp {
+	return fileStamp{size: info.Size(), modTime: info.ModTime().UnixNano()}
+}
+
+// watcher polls the targets for .go files that changed since they were last
+// processed. Polling keeps the tool free of platform-specific notification
+// APIs and is cheap at the scale of a single working tree.
+type watcher struct {
+	targets []string
+	cfg     config
+	seen    map[string]fileStamp
+	pending map[string]fileStamp
+}
+
+func watch(ctx context.Context, targets []string, cfg config, stdout, stderr io.Writer) int {
+	w, err := newWatcher(targets, cfg)
+	if err != nil {
+		fprintln(stderr, "Error:", err)
+
+		return exitError
+	}
+	cfg.log.noticef("watching %d file(s) for changes, press Ctrl+C to stop", len(w.seen))
+
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return exitOK
+		case <-ticker.C:
+			w.poll(stdout, stderr)
+		}
+	}
+}
+
+func newWatcher(targets []string, cfg config) (*watcher, error) {
+	w := &watcher{
+		targets: targets,
+		cfg:     cfg,
+		pending: make(map[string]fileStamp),
+	}
+
+	seen, err := w.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	w.seen = seen
+
+	return w, nil
+}
+
+func (w *watcher) snapshot() (map[string]fileStamp, error) {
+	files := make(map[string]fileStamp)
+	record := func(path string, info fs.FileInfo) error {
+		files[path] = stampOf(info)
+
+		return nil
+	}
+
+	for _, target := range w.targets {
+		target, info, err := statTarget(target)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			_ = record(target, info)
+
+			continue
+		}
+		fsys := newOSFS(target, "")
+		err = walkGoFiles(fsys, w.cfg, func(name string, info fs.FileInfo) error {
+			return record(displayPath(fsys, name), info)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// poll processes every file whose stamp changed since it was last seen and
+// has stayed the same since the previous poll.
+func (w *watcher) poll(stdout, stderr io.Writer) {
+	current, err := w.snapshot()
+	if err != nil {
+		fprintln(stderr, "Error:", err)
+
+		return
+	}
+
+	var ready []string
+	for path, stamp := range current {
+		if w.seen[path] == stamp {
+			delete(w.pending, path)
+
+			continue
+		}
+		if pending, ok := w.pending[path]; !ok || pending != stamp {
+			w.pending[path] = stamp
+
+			continue
+		}
+		ready = append(ready, path)
+	}
+	for path := range w.seen {
+		if _, ok := current[path]; !ok {
+			delete(w.seen, path)
+			delete(w.pending, path)
+		}
+	}
+
+	slices.Sort(ready)
+	for _, path := range ready {
+		delete(w.pending, path)
+		w.seen[path] = current[path]
+		w.process(path, stdout, stderr)
+	}
+}
+
+func (w *watcher) process(path string, stdout, stderr io.Writer) {
+	info, err := os.Stat(path)
+	if err != nil {
+		fprintln(stderr, "Error:", err)
+
+		return
+	}
+	if w.cfg.tooLarge(path, info) {
+		return
+	}
+
+	verr, err := collectViolations(checkImports(path, w.cfg))
+	var perr *parseError
+	switch {
+	case errors.As(err, &perr):
+		w.cfg.log.noticef("skipping %s until it parses: %v", path, perr.err)
+	case err != nil:
+		fprintln(stderr, "Error:", err)
+	case verr != nil:
+		printResult(stdout, w.cfg, verr)
+	}
+
+	// Our own rewrite must not look like a fresh edit on the next poll.
+	if info, err := os.Stat(path); err == nil {
+		w.seen[path] = stampOf(info)
+	}
+}